@@ -0,0 +1,90 @@
+package client
+
+//
+// extension of regapweb message
+//
+
+import (
+	"github.com/potix/regaprelay/gamepad"
+	"github.com/potix/regapweb/message"
+)
+
+const (
+	MsgTypeGamepadLights  = "gpLights"  // controller <------  server <------  gamepad
+	MsgTypeGamepadMacro   = "gpMacro"   // controller  ------> server  ------> gamepad
+	MsgTypeGamepadTurbo   = "gpTurbo"   // controller  ------> server  ------> gamepad
+	MsgTypeGamepadBattery = "gpBattery" // controller  ------> server  ------> gamepad
+	MsgTypeGamepadAmiibo  = "gpAmiibo"  // controller  ------> server  ------> gamepad
+)
+
+type GamepadConnectRequest struct {
+	message.GamepadConnectRequest
+	// name of remap profile ("" is the default profile)
+	RemapProfile string `json:"RemapProfile,omitempty"`
+}
+
+type GamepadState struct {
+	message.GamepadState
+	Motion *gamepad.GamepadMotion `json:"Motion,omitempty"`
+}
+
+type GamepadLights struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+	PlayerLights *gamepad.GamepadPlayerLights `json:"PlayerLights,omitempty"`
+	HomeLight    *gamepad.GamepadHomeLight    `json:"HomeLight,omitempty"`
+	LightBar     *gamepad.GamepadLightBar     `json:"LightBar,omitempty"`
+	MuteLight    *gamepad.GamepadMuteLight    `json:"MuteLight,omitempty"`
+}
+
+// run macro by name, or cancel the running macro
+type GamepadMacro struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+	Name         string `json:"Name,omitempty"`
+	Cancel       bool   `json:"Cancel,omitempty"`
+}
+
+// enable or disable turbo of the button
+// Frames <= 0 uses frames of the config
+type GamepadTurbo struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+	Button       string
+	Frames       int  `json:"Frames,omitempty"`
+	Enable       bool `json:"Enable,omitempty"`
+}
+
+// battery level is 0 (empty) to 4 (full)
+type GamepadBattery struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+	Level        int
+	Charging     bool `json:"Charging,omitempty"`
+}
+
+// load amiibo by file name in amiiboDir of the config, or remove the amiibo
+type GamepadAmiibo struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+	Name         string `json:"Name,omitempty"`
+	Remove       bool   `json:"Remove,omitempty"`
+}
+
+type Message struct {
+	message.Message
+	GamepadConnectRequest *GamepadConnectRequest `json:"GamepadConnectRequest,omitempty"`
+	GamepadState          *GamepadState          `json:"GamepadState,omitempty"`
+	GamepadLights         *GamepadLights         `json:"GamepadLights,omitempty"`
+	GamepadMacro          *GamepadMacro          `json:"GamepadMacro,omitempty"`
+	GamepadTurbo          *GamepadTurbo          `json:"GamepadTurbo,omitempty"`
+	GamepadBattery        *GamepadBattery        `json:"GamepadBattery,omitempty"`
+	GamepadAmiibo         *GamepadAmiibo         `json:"GamepadAmiibo,omitempty"`
+	// includes per-side motors and stop event
+	GamepadVibration *gamepad.GamepadVibration `json:"GamepadVibration,omitempty"`
+}
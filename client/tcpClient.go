@@ -55,7 +55,7 @@ type TcpClient struct {
 	controllerId	string
 }
 
-func (t *TcpClient) safeConnWriteMessage(msg *message.Message) error  {
+func (t *TcpClient) safeConnWriteMessage(msg *Message) error  {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("can not marshal to json: %v", err)
@@ -137,7 +137,7 @@ func (t *TcpClient) handshake(conn net.Conn) (string, error) {
 		} else {
 			// entire message
 			msgBytes = append(msgBytes, patialMsgBytes...)
-			var msg message.Message
+			var msg Message
 			if err := json.Unmarshal(msgBytes, &msg); err != nil {
 				msgBytes = msgBytes[:0]
 				return gamepadId, fmt.Errorf("can not unmarshal message: %w", err)
@@ -187,7 +187,7 @@ func (t *TcpClient) communicationLoop(conn net.Conn) error {
 		} else {
 			// entire message
 			msgBytes = append(msgBytes, patialMsgBytes...)
-			var msg message.Message
+			var msg Message
 			if err := json.Unmarshal(msgBytes, &msg); err != nil {
 				log.Printf("can not unmarshal message: %v, %v", string(msgBytes), err)
 				msgBytes = msgBytes[:0]
@@ -223,6 +223,27 @@ func (t *TcpClient) communicationLoop(conn net.Conn) error {
 					}
 					continue
 				}
+				err = t.gamepad.SelectRemapProfile(msg.GamepadConnectRequest.RemapProfile)
+				if err != nil {
+					log.Printf("can not select remap profile: %v", err)
+					resMsg := &message.Message{
+						MsgType: message.MsgTypeGamepadConnectRes,
+						Error: &message.Error{
+							Message: "can not select remap profile",
+						},
+						GamepadConnectResponse: &message.GamepadConnectResponse{
+							DelivererId: msg.GamepadConnectRequest.DelivererId,
+							ControllerId: msg.GamepadConnectRequest.ControllerId,
+							GamepadId: msg.GamepadConnectRequest.GamepadId,
+						},
+					}
+					err = t.writeMessage(conn, resMsg)
+					if err != nil {
+						log.Printf("can not write gamepad connect response: %v", err)
+						return fmt.Errorf("can not write gamepad connect response: %w", err)
+					}
+					continue
+				}
 				t.delivererId = msg.GamepadConnectRequest.DelivererId
 				t.controllerId = msg.GamepadConnectRequest.ControllerId
 				t.gamepadId = msg.GamepadConnectRequest.GamepadId
@@ -244,21 +265,67 @@ func (t *TcpClient) communicationLoop(conn net.Conn) error {
 					log.Printf("error has occured in gpConnectRes: %v", msg.Error.Message)
 				}
 			} else if msg.MsgType == message.MsgTypeGamepadState {
-				if msg.GamepadState == nil ||
-				   msg.GamepadState.DelivererId == "" ||
-				   msg.GamepadState.ControllerId == "" ||
-				   msg.GamepadState.GamepadId == "" {
-					log.Printf("no gamepad state request parameter: %v", msg.GamepadState)
+				if !t.checkGamepadId(&msg) {
+					continue
+				}
+				t.gamepad.UpdateState(&msg.GamepadState.GamepadState)
+				if msg.GamepadState.Motion != nil {
+					if err := t.gamepad.UpdateMotion(msg.GamepadState.Motion); err != nil && t.verbose {
+						log.Printf("can not update motion: %v", err)
+					}
+				}
+			} else if msg.MsgType == MsgTypeGamepadMacro {
+				if !t.checkGamepadId(&msg) {
+					continue
+				}
+				if msg.GamepadMacro.Cancel {
+					t.gamepad.CancelMacro()
+					continue
+				}
+				err = t.gamepad.RunMacro(msg.GamepadMacro.Name)
+				if err != nil {
+					log.Printf("can not run macro: %v", err)
+				}
+			} else if msg.MsgType == MsgTypeGamepadTurbo {
+				if !t.checkGamepadId(&msg) {
+					continue
+				}
+				button, err := gamepad.ButtonNameFromString(msg.GamepadTurbo.Button)
+				if err != nil {
+					log.Printf("can not change turbo: %v", err)
+					continue
+				}
+				if msg.GamepadTurbo.Enable {
+					t.gamepad.EnableTurbo(button, msg.GamepadTurbo.Frames)
+				} else {
+					t.gamepad.DisableTurbo(button)
+				}
+			} else if msg.MsgType == MsgTypeGamepadBattery {
+				if !t.checkGamepadId(&msg) {
 					continue
 				}
-				if msg.GamepadState.GamepadId != t.gamepadId ||
-				   msg.GamepadState.DelivererId != t.delivererId ||
-				   msg.GamepadState.ControllerId != t.controllerId {
-					log.Printf("ids are mismatch: gamepadId: (act) %v, (exp) %v, delivererId: (act) %v, (exp) %v, controllerId: (act) %v, (exp) %v",
-						 msg.GamepadState.GamepadId, t.gamepadId, msg.GamepadState.DelivererId, t.delivererId, msg.GamepadState.ControllerId, t.controllerId)
+				err = t.gamepad.SetBattery(&gamepad.GamepadBattery{
+					Level: msg.GamepadBattery.Level,
+					Charging: msg.GamepadBattery.Charging,
+				})
+				if err != nil {
+					log.Printf("can not set battery: %v", err)
+				}
+			} else if msg.MsgType == MsgTypeGamepadAmiibo {
+				if !t.checkGamepadId(&msg) {
 					continue
 				}
-				t.gamepad.UpdateState(msg.GamepadState)
+				if msg.GamepadAmiibo.Remove {
+					err = t.gamepad.RemoveAmiibo()
+					if err != nil {
+						log.Printf("can not remove amiibo: %v", err)
+					}
+					continue
+				}
+				err = t.gamepad.LoadAmiiboByName(msg.GamepadAmiibo.Name)
+				if err != nil {
+					log.Printf("can not load amiibo: %v", err)
+				}
 			} else {
 				log.Printf("unsupported message: %v", msg.MsgType)
 			}
@@ -266,6 +333,49 @@ func (t *TcpClient) communicationLoop(conn net.Conn) error {
 	}
 }
 
+// ids of a gamepad message must be the ids of the connected gamepad
+func (t *TcpClient) checkGamepadId(msg *Message) bool {
+	var delivererId, controllerId, gamepadId string
+	var param interface{}
+	switch msg.MsgType {
+	case message.MsgTypeGamepadState:
+		if msg.GamepadState != nil {
+			delivererId, controllerId, gamepadId = msg.GamepadState.DelivererId, msg.GamepadState.ControllerId, msg.GamepadState.GamepadId
+			param = msg.GamepadState
+		}
+	case MsgTypeGamepadMacro:
+		if msg.GamepadMacro != nil {
+			delivererId, controllerId, gamepadId = msg.GamepadMacro.DelivererId, msg.GamepadMacro.ControllerId, msg.GamepadMacro.GamepadId
+			param = msg.GamepadMacro
+		}
+	case MsgTypeGamepadTurbo:
+		if msg.GamepadTurbo != nil {
+			delivererId, controllerId, gamepadId = msg.GamepadTurbo.DelivererId, msg.GamepadTurbo.ControllerId, msg.GamepadTurbo.GamepadId
+			param = msg.GamepadTurbo
+		}
+	case MsgTypeGamepadBattery:
+		if msg.GamepadBattery != nil {
+			delivererId, controllerId, gamepadId = msg.GamepadBattery.DelivererId, msg.GamepadBattery.ControllerId, msg.GamepadBattery.GamepadId
+			param = msg.GamepadBattery
+		}
+	case MsgTypeGamepadAmiibo:
+		if msg.GamepadAmiibo != nil {
+			delivererId, controllerId, gamepadId = msg.GamepadAmiibo.DelivererId, msg.GamepadAmiibo.ControllerId, msg.GamepadAmiibo.GamepadId
+			param = msg.GamepadAmiibo
+		}
+	}
+	if delivererId == "" || controllerId == "" || gamepadId == "" {
+		log.Printf("no %v request parameter: %v", msg.MsgType, param)
+		return false
+	}
+	if gamepadId != t.gamepadId || delivererId != t.delivererId || controllerId != t.controllerId {
+		log.Printf("ids are mismatch: gamepadId: (act) %v, (exp) %v, delivererId: (act) %v, (exp) %v, controllerId: (act) %v, (exp) %v",
+			 gamepadId, t.gamepadId, delivererId, t.delivererId, controllerId, t.controllerId)
+		return false
+	}
+	return true
+}
+
 func (t *TcpClient) reconnectLoop() {
 	if t.verbose {
 		log.Printf("start reconnect loop")
@@ -307,7 +417,7 @@ func (t *TcpClient) reconnectLoop() {
 	}
 }
 
-func (t *TcpClient) onVibration(vibration *message.GamepadVibration) {
+func (t *TcpClient) onVibration(vibration *gamepad.GamepadVibration) {
 	if t.delivererId == "" || t.controllerId == "" || t.gamepadId == "" {
 		if t.verbose {
 			log.Printf("skip vibration because no ids")
@@ -317,8 +427,10 @@ func (t *TcpClient) onVibration(vibration *message.GamepadVibration) {
 	vibration.DelivererId = t.delivererId
 	vibration.ControllerId = t.controllerId
 	vibration.GamepadId = t.gamepadId
-	msg := &message.Message {
-		MsgType: message.MsgTypeGamepadVibration,
+	msg := &Message{
+		Message: message.Message{
+			MsgType: message.MsgTypeGamepadVibration,
+		},
 		GamepadVibration: vibration,
 	}
 	err := t.safeConnWriteMessage(msg)
@@ -327,14 +439,43 @@ func (t *TcpClient) onVibration(vibration *message.GamepadVibration) {
 	}
 }
 
+func (t *TcpClient) onLights(lights *gamepad.GamepadLights) {
+	if t.delivererId == "" || t.controllerId == "" || t.gamepadId == "" {
+		if t.verbose {
+			log.Printf("skip lights because no ids")
+		}
+		return
+	}
+	msg := &Message{
+		Message: message.Message{
+			MsgType: MsgTypeGamepadLights,
+		},
+		GamepadLights: &GamepadLights{
+			DelivererId: t.delivererId,
+			ControllerId: t.controllerId,
+			GamepadId: t.gamepadId,
+			PlayerLights: lights.PlayerLights,
+			HomeLight: lights.HomeLight,
+			LightBar: lights.LightBar,
+			MuteLight: lights.MuteLight,
+		},
+	}
+	err := t.safeConnWriteMessage(msg)
+	if err != nil {
+		log.Printf("can not write lights message: %v", err)
+	}
+}
+
 func (t *TcpClient) Start() error {
         go t.reconnectLoop()
 	t.gamepad.StartVibrationListener(t.onVibration)
+	t.gamepad.StartLightsListener(t.onLights)
 	return nil
 }
 
 func (t *TcpClient) Stop() {
 	t.gamepad.StopVibrationListener()
+	t.gamepad.StopLightsListener()
 	close(t.stopCh)
 	t.connMutex.Lock()
 	if t.conn != nil {
@@ -1,7 +1,10 @@
 package gamepad
 
 import (
+	"fmt"
 	"log"
+	"sync"
+	"time"
 	"github.com/potix/regapweb/message"
 )
 
@@ -9,7 +12,11 @@ type GamepadModel string
 
 const (
         ModelNSProCon GamepadModel = "nsprocon"
+        ModelNSJoyConL             = "nsjoyconl"
+        ModelNSJoyConR             = "nsjoyconr"
         ModelPS4Con                = "ps4con"
+        ModelPS5Con                = "ps5con"
+        ModelGenericHid            = "generichid"
 )
 
 type ButtonName int
@@ -40,6 +47,64 @@ const (
         ButtonChargingGrip
 )
 
+var buttonNameMap map[string]ButtonName = map[string]ButtonName{
+	"A": ButtonA,
+	"B": ButtonB,
+	"X": ButtonX,
+	"Y": ButtonY,
+	"Left": ButtonLeft,
+	"Right": ButtonRight,
+	"Up": ButtonUp,
+	"Down": ButtonDown,
+	"Plus": ButtonPlus,
+	"Minus": ButtonMinus,
+	"Home": ButtonHome,
+	"Capture": ButtonCapture,
+	"StickL": ButtonStickL,
+	"StickR": ButtonStickR,
+	"L": ButtonL,
+	"R": ButtonR,
+	"ZL": ButtonZL,
+	"ZR": ButtonZR,
+	"LeftSL": ButtonLeftSL,
+	"LeftSR": ButtonLeftSR,
+	"RightSL": ButtonRightSL,
+	"RightSR": ButtonRightSR,
+	"ChargingGrip": ButtonChargingGrip,
+}
+
+func ButtonNameFromString(name string) (ButtonName, error) {
+	buttonName, ok := buttonNameMap[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported button name: %v", name)
+	}
+	return buttonName, nil
+}
+
+// hat switch value of usb hid: 0 = north, clockwise, 8 = neutral
+func hatSwitch(up byte, right byte, down byte, left byte) byte {
+	switch {
+	case up == 1 && right == 1:
+		return 1
+	case right == 1 && down == 1:
+		return 3
+	case down == 1 && left == 1:
+		return 5
+	case left == 1 && up == 1:
+		return 7
+	case up == 1:
+		return 0
+	case right == 1:
+		return 2
+	case down == 1:
+		return 4
+	case left == 1:
+		return 6
+	default:
+		return 8
+	}
+}
+
 type BackendIf interface {
 	Setup() error
 	Start() error
@@ -51,43 +116,249 @@ type BackendIf interface {
 	StickR(float64, float64) error
 	StartVibrationListener(fn OnVibration)
 	StopVibrationListener()
+	StartLightsListener(fn OnLights)
+	StopLightsListener()
+	StartHandshakeListener(fn OnHandshake)
+	StopHandshakeListener()
+	AddFrameHook(name string, fn FrameHook)
+	RemoveFrameHook(name string)
+}
+
+// minimum interval of event driven reports if not configured
+const DefaultMinReportInterval time.Duration = 4 * time.Millisecond
+
+// backends that can change timing of periodic input reports, set before Start
+type ReportRateBackendIf interface {
+	SetReportRate(reportRate float64) error
+	SetEventDrivenReport(enable bool, minReportInterval time.Duration)
+}
+
+// FrameHook is called before each periodic input report is built.
+// frame is the number of the report.
+type FrameHook func(frame uint64)
+
+type frameHookEntry struct {
+	name string
+	fn   FrameHook
 }
 
+// events queued for a slow listener, the oldest event is dropped when full
+const listenerQueueSize int = 16
+
 type BaseBackend struct {
 	verbose			bool
-	onVibrationCh           chan *message.GamepadVibration
+	onVibrationCh           chan *GamepadVibration
 	stopVibrationListenerCh chan int
+	onLightsCh              chan *GamepadLights
+	stopLightsListenerCh    chan int
+	onHandshakeCh           chan *GamepadHandshake
+	stopHandshakeListenerCh chan int
+	listenerMutex           sync.Mutex
+	frameCount              uint64
+	frameHooks              []*frameHookEntry
+	frameMutex              sync.Mutex
 }
 
 func (b *BaseBackend) StartVibrationListener(fn OnVibration) {
-	b.onVibrationCh = make(chan *message.GamepadVibration)
-	b.stopVibrationListenerCh = make(chan int)
+	onVibrationCh := make(chan *GamepadVibration)
+	stopVibrationListenerCh := make(chan int)
+	b.listenerMutex.Lock()
+	b.onVibrationCh = onVibrationCh
+	b.stopVibrationListenerCh = stopVibrationListenerCh
+	b.listenerMutex.Unlock()
         go func() {
 		if b.verbose {
 			log.Printf("start vibration listener")
 		}
                 for {
                         select {
-                        case v := <-b.onVibrationCh:
+                        case v := <-onVibrationCh:
                                 fn(v)
-                        case <-b.stopVibrationListenerCh:
+                        case <-stopVibrationListenerCh:
+				if b.verbose {
+					log.Printf("finish vibration listener")
+				}
                                 return
                         }
                 }
-		if b.verbose {
-			log.Printf("finish vibration listener")
-		}
         }()
 }
 
 func (b *BaseBackend) StopVibrationListener() {
+	b.listenerMutex.Lock()
+	defer b.listenerMutex.Unlock()
 	if b.stopVibrationListenerCh != nil {
 		close(b.stopVibrationListenerCh)
+		b.onVibrationCh = nil
+		b.stopVibrationListenerCh = nil
+	}
+}
+
+func (b *BaseBackend) SendVibration(vibration *GamepadVibration) {
+	b.listenerMutex.Lock()
+	onVibrationCh := b.onVibrationCh
+	stopVibrationListenerCh := b.stopVibrationListenerCh
+	b.listenerMutex.Unlock()
+	if onVibrationCh == nil {
+		return
+	}
+	select {
+	case onVibrationCh <- vibration:
+	case <-stopVibrationListenerCh:
+	}
+}
+
+func (b *BaseBackend) StartLightsListener(fn OnLights) {
+	onLightsCh := make(chan *GamepadLights, listenerQueueSize)
+	stopLightsListenerCh := make(chan int)
+	b.listenerMutex.Lock()
+	b.onLightsCh = onLightsCh
+	b.stopLightsListenerCh = stopLightsListenerCh
+	b.listenerMutex.Unlock()
+        go func() {
+		if b.verbose {
+			log.Printf("start lights listener")
+		}
+                for {
+                        select {
+                        case l := <-onLightsCh:
+                                fn(l)
+                        case <-stopLightsListenerCh:
+				if b.verbose {
+					log.Printf("finish lights listener")
+				}
+                                return
+                        }
+                }
+        }()
+}
+
+func (b *BaseBackend) StopLightsListener() {
+	b.listenerMutex.Lock()
+	defer b.listenerMutex.Unlock()
+	if b.stopLightsListenerCh != nil {
+		close(b.stopLightsListenerCh)
+		b.onLightsCh = nil
+		b.stopLightsListenerCh = nil
+	}
+}
+
+// called in subcommand handling, never blocks
+func (b *BaseBackend) SendLights(lights *GamepadLights) {
+	b.listenerMutex.Lock()
+	onLightsCh := b.onLightsCh
+	b.listenerMutex.Unlock()
+	if onLightsCh == nil {
+		return
+	}
+	select {
+	case onLightsCh <- lights:
+		return
+	default:
+	}
+	select {
+	case <-onLightsCh:
+		log.Printf("lights listener is slow, drop stale lights")
+	default:
+	}
+	select {
+	case onLightsCh <- lights:
+	default:
+	}
+}
+
+func (b *BaseBackend) StartHandshakeListener(fn OnHandshake) {
+	onHandshakeCh := make(chan *GamepadHandshake, listenerQueueSize)
+	stopHandshakeListenerCh := make(chan int)
+	b.listenerMutex.Lock()
+	b.onHandshakeCh = onHandshakeCh
+	b.stopHandshakeListenerCh = stopHandshakeListenerCh
+	b.listenerMutex.Unlock()
+        go func() {
+		if b.verbose {
+			log.Printf("start handshake listener")
+		}
+                for {
+                        select {
+                        case h := <-onHandshakeCh:
+                                fn(h)
+                        case <-stopHandshakeListenerCh:
+				if b.verbose {
+					log.Printf("finish handshake listener")
+				}
+                                return
+                        }
+                }
+        }()
+}
+
+func (b *BaseBackend) StopHandshakeListener() {
+	b.listenerMutex.Lock()
+	defer b.listenerMutex.Unlock()
+	if b.stopHandshakeListenerCh != nil {
+		close(b.stopHandshakeListenerCh)
+		b.onHandshakeCh = nil
+		b.stopHandshakeListenerCh = nil
+	}
+}
+
+// called by the report writer, never blocks
+func (b *BaseBackend) SendHandshake(handshake *GamepadHandshake) {
+	b.listenerMutex.Lock()
+	onHandshakeCh := b.onHandshakeCh
+	b.listenerMutex.Unlock()
+	if onHandshakeCh == nil {
+		return
+	}
+	select {
+	case onHandshakeCh <- handshake:
+		return
+	default:
+	}
+	select {
+	case dropped := <-onHandshakeCh:
+		log.Printf("handshake listener is slow, drop handshake event: %+v", dropped)
+	default:
+	}
+	select {
+	case onHandshakeCh <- handshake:
+	default:
+	}
+}
+
+// replace the hook if the name already exists
+func (b *BaseBackend) AddFrameHook(name string, fn FrameHook) {
+	b.frameMutex.Lock()
+	defer b.frameMutex.Unlock()
+	frameHooks := make([]*frameHookEntry, 0, len(b.frameHooks) + 1)
+	for _, entry := range b.frameHooks {
+		if entry.name != name {
+			frameHooks = append(frameHooks, entry)
+		}
+	}
+	b.frameHooks = append(frameHooks, &frameHookEntry{ name: name, fn: fn })
+}
+
+func (b *BaseBackend) RemoveFrameHook(name string) {
+	b.frameMutex.Lock()
+	defer b.frameMutex.Unlock()
+	frameHooks := make([]*frameHookEntry, 0, len(b.frameHooks))
+	for _, entry := range b.frameHooks {
+		if entry.name != name {
+			frameHooks = append(frameHooks, entry)
+		}
 	}
+	b.frameHooks = frameHooks
 }
 
-func (b *BaseBackend) SendVibration(vibration *message.GamepadVibration) {
-	if b.onVibrationCh != nil {
-		b.onVibrationCh <- vibration
+// backends call this before building each periodic input report
+func (b *BaseBackend) RunFrameHooks() {
+	b.frameMutex.Lock()
+	b.frameCount += 1
+	frame := b.frameCount
+	frameHooks := b.frameHooks
+	b.frameMutex.Unlock()
+	for _, entry := range frameHooks {
+		entry.fn(frame)
 	}
 }
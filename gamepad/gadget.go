@@ -0,0 +1,59 @@
+package gamepad
+
+//
+// composite usb gadget, extra functions share the gadget with the gamepad
+//
+
+import (
+	"fmt"
+	"log"
+	"github.com/potix/regaprelay/gamepad/setup"
+)
+
+const defaultDevFilePath = "/dev/hidg0"
+
+type GadgetBackendIf interface {
+	// before Setup
+	AddGadgetFunctions([]*setup.UsbGadgetFunction)
+	// after Setup, instance name to device file of hid functions
+	GadgetHidDevFiles() (map[string]string, error)
+}
+
+// hid function without attributes has the same descriptor as the gamepad.
+// nothing drives it, the caller writes reports to its device file (see GadgetHidDevFiles)
+func addGadgetFunctions(params *setup.UsbGadgetHidSetupParams, functions []*setup.UsbGadgetFunction) {
+	for _, function := range functions {
+		if function.FunctionName == "hid" && len(function.Attributes) == 0 {
+			function = setup.NewUsbGadgetHidFunction(function.InstanceName, params.Protocol, params.Subclass, params.ReportLength, params.ReportDesc)
+		}
+		params.Functions = append(params.Functions, function)
+	}
+}
+
+// configured device file is used as is
+func resolveDevFilePath(params *setup.UsbGadgetHidSetupParams, devFilePath string) string {
+	if devFilePath != "" {
+		return devFilePath
+	}
+	discovered, err := setup.UsbGadgetHidDevFile(params, params.InstanceName)
+	if err != nil {
+		log.Printf("can not discover device file, use %v: %v", defaultDevFilePath, err)
+		return defaultDevFilePath
+	}
+	return discovered
+}
+
+func gadgetHidDevFiles(params *setup.UsbGadgetHidSetupParams, devFilePath string) (map[string]string, error) {
+	devFiles := map[string]string{ params.InstanceName: devFilePath }
+	for _, function := range params.Functions {
+		if function.FunctionName != "hid" {
+			continue
+		}
+		devFile, err := setup.UsbGadgetHidDevFile(params, function.InstanceName)
+		if err != nil {
+			return nil, fmt.Errorf("can not get device file of hid function (%v): %w", function.InstanceName, err)
+		}
+		devFiles[function.InstanceName] = devFile
+	}
+	return devFiles, nil
+}
@@ -2,22 +2,62 @@ package gamepad
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 	"github.com/potix/regapweb/message"
+	"github.com/potix/regaprelay/gamepad/setup"
 )
 
 type gamepadOptions struct {
-        verbose     bool
-	devFilePath string
-	configsHome string
-	udc         string
+        verbose           bool
+	devFilePath       string
+	spiFlashFile      string
+	configsHome       string
+	udc               string
+	leftStickShape    *StickShape
+	rightStickShape   *StickShape
+	remapProfiles     []*RemapProfile
+	remapProfile      string
+	macros            []*Macro
+	turboButtons      []*TurboButton
+	recordDir         string
+	hidCaptureFile    string
+	reportRate        float64
+	eventDriven       bool
+	minReportInterval time.Duration
+	identity          *NSIdentity
+	gadgetFunctions   []*setup.UsbGadgetFunction
+	mcuReport         bool
+	amiiboDir         string
+	amiiboFile        string
 }
 
 func defaultGamepadOptions() *gamepadOptions {
         return &gamepadOptions {
                 verbose: false,
 		devFilePath: "",
+		spiFlashFile: "",
 		configsHome: "",
 		udc: "",
+		leftStickShape: nil,
+		rightStickShape: nil,
+		remapProfiles: nil,
+		remapProfile: "",
+		macros: nil,
+		turboButtons: nil,
+		recordDir: "",
+		hidCaptureFile: "",
+		reportRate: 0,
+		eventDriven: false,
+		minReportInterval: DefaultMinReportInterval,
+		identity: nil,
+		gadgetFunctions: nil,
+		mcuReport: false,
+		amiiboDir: "",
+		amiiboFile: "",
         }
 }
 
@@ -35,6 +75,12 @@ func GamepadDevFilePath(devFilePath string) GamepadOption {
         }
 }
 
+func GamepadSpiFlashFile(spiFlashFile string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.spiFlashFile = spiFlashFile
+        }
+}
+
 func GamepadConfigsHome(configsHome string) GamepadOption {
         return func(opts *gamepadOptions) {
                 opts.configsHome = configsHome
@@ -47,13 +93,126 @@ func GamepadUdc(udc string) GamepadOption {
         }
 }
 
+func GamepadLeftStickShape(leftStickShape *StickShape) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.leftStickShape = leftStickShape
+        }
+}
+
+func GamepadRightStickShape(rightStickShape *StickShape) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.rightStickShape = rightStickShape
+        }
+}
+
+func GamepadRemapProfiles(remapProfiles []*RemapProfile) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.remapProfiles = remapProfiles
+        }
+}
+
+// default remap profile
+func GamepadRemapProfile(remapProfile string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.remapProfile = remapProfile
+        }
+}
+
+func GamepadMacros(macros []*Macro) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.macros = macros
+        }
+}
+
+func GamepadTurboButtons(turboButtons []*TurboButton) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.turboButtons = turboButtons
+        }
+}
+
+// record all states of UpdateState into the dir
+func GamepadRecordDir(recordDir string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.recordDir = recordDir
+        }
+}
+
+// capture raw hid reports into the file
+func GamepadHidCaptureFile(hidCaptureFile string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.hidCaptureFile = hidCaptureFile
+        }
+}
+
+// periodic input reports per second, 0 is the default of the model
+func GamepadReportRate(reportRate float64) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.reportRate = reportRate
+        }
+}
+
+// state changes write an input report immediately,
+// but not within minReportInterval from the previous report
+func GamepadEventDrivenReport(eventDriven bool, minReportInterval time.Duration) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.eventDriven = eventDriven
+                opts.minReportInterval = minReportInterval
+        }
+}
+
+// colors, serial, firmware version and battery of switch controllers
+func GamepadIdentity(identity *NSIdentity) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.identity = identity
+        }
+}
+
+// extra functions of the usb gadget (e.g. serial console), extra hid functions are driven by the caller
+func GamepadGadgetFunctions(functions []*setup.UsbGadgetFunction) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.gadgetFunctions = functions
+        }
+}
+
+// experimental, input report 0x31 for nfc (nsprocon, nsjoyconl, nsjoyconr), see doc/nfc.md
+func GamepadMcuReport(mcuReport bool) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.mcuReport = mcuReport
+        }
+}
+
+// amiibo dumps (540 bytes) selected by name from the remote controller
+func GamepadAmiiboDir(amiiboDir string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.amiiboDir = amiiboDir
+        }
+}
+
+// amiibo dump loaded at start
+func GamepadAmiiboFile(amiiboFile string) GamepadOption {
+        return func(opts *gamepadOptions) {
+                opts.amiiboFile = amiiboFile
+        }
+}
+
 type Gamepad struct {
-	verbose   bool
-	opts	  *gamepadOptions
-        backendIf BackendIf
+	verbose       bool
+	opts	      *gamepadOptions
+        backendIf     BackendIf
+	remapProfile  *RemapProfile
+	remapMutex    sync.Mutex
+	macroRunner   *macroRunner
+	macroMutex    sync.Mutex
+	pendingState  *message.GamepadState
+	turboStates   map[ButtonName]*turboState
+	buttonIndices map[ButtonName][]int
+	heldButtons   map[ButtonName]bool
+	turboMutex    sync.Mutex
+	recorder      *recorder
+	recorderMutex sync.Mutex
 }
 
-type OnVibration func(*message.GamepadVibration)
+type OnVibration func(*GamepadVibration)
 
 func (g *Gamepad) StartVibrationListener(fn OnVibration) {
 	g.backendIf.StartVibrationListener(fn)
@@ -62,32 +221,257 @@ func (g *Gamepad) StopVibrationListener() {
 	g.backendIf.StopVibrationListener()
 }
 
+type OnLights func(*GamepadLights)
+
+func (g *Gamepad) StartLightsListener(fn OnLights) {
+	g.backendIf.StartLightsListener(fn)
+}
+
+func (g *Gamepad) StopLightsListener() {
+	g.backendIf.StopLightsListener()
+}
+
+type OnHandshake func(*GamepadHandshake)
+
+// usb handshake of switch controllers
+func (g *Gamepad) StartHandshakeListener(fn OnHandshake) {
+	g.backendIf.StartHandshakeListener(fn)
+}
+
+func (g *Gamepad) StopHandshakeListener() {
+	g.backendIf.StopHandshakeListener()
+}
+
+func (g *Gamepad) shapeAxes(axes []float64) []float64 {
+	if g.opts.leftStickShape == nil && g.opts.rightStickShape == nil {
+		return axes
+	}
+	shapedAxes := make([]float64, len(axes))
+	copy(shapedAxes, axes)
+	if len(shapedAxes) >= 2 {
+		shapedAxes[0], shapedAxes[1] = g.opts.leftStickShape.apply(shapedAxes[0], shapedAxes[1])
+	}
+	if len(shapedAxes) >= 4 {
+		shapedAxes[2], shapedAxes[3] = g.opts.rightStickShape.apply(shapedAxes[2], shapedAxes[3])
+	}
+	return shapedAxes
+}
+
+func (g *Gamepad) findRemapProfile(name string) (*RemapProfile, error) {
+	if name == "" {
+		name = g.opts.remapProfile
+		if name == "" {
+			return nil, nil
+		}
+	}
+	for _, remapProfile := range g.opts.remapProfiles {
+		if remapProfile.Name == name {
+			return remapProfile, nil
+		}
+	}
+	return nil, fmt.Errorf("not found remap profile: %v", name)
+}
+
+// select remap profile by name ("" is the default profile)
+func (g *Gamepad) SelectRemapProfile(name string) error {
+	remapProfile, err := g.findRemapProfile(name)
+	if err != nil {
+		return err
+	}
+	g.remapMutex.Lock()
+	defer g.remapMutex.Unlock()
+	g.remapProfile = remapProfile
+	if g.verbose {
+		log.Printf("select remap profile: %v", name)
+	}
+	return nil
+}
+
 func (g *Gamepad) UpdateState(state *message.GamepadState) error {
-	return g.backendIf.UpdateState(state)
+	g.recordState(state)
+	return g.updateState(state)
+}
+
+// not recorded, for replayed states
+func (g *Gamepad) updateState(state *message.GamepadState) error {
+	g.macroMutex.Lock()
+	if g.macroRunner != nil {
+		// the latest state is applied when the macro ends
+		g.pendingState = state
+		g.macroMutex.Unlock()
+		return nil
+	}
+	g.macroMutex.Unlock()
+	return g.applyState(state)
+}
+
+func (g *Gamepad) applyState(state *message.GamepadState) error {
+	g.remapMutex.Lock()
+	remapProfile := g.remapProfile
+	g.remapMutex.Unlock()
+	shapedState := *remapProfile.apply(state)
+	shapedState.Axes = g.shapeAxes(shapedState.Axes)
+	g.updateHeldButtons(&shapedState)
+	return g.backendIf.UpdateState(&shapedState)
+}
+
+func (g *Gamepad) UpdateMotion(motion *GamepadMotion) error {
+	motionBackendIf, ok := g.backendIf.(MotionBackendIf)
+	if !ok {
+		return fmt.Errorf("motion is not supported")
+	}
+	return motionBackendIf.UpdateMotion(motion)
+}
+
+func (g *Gamepad) LoadAmiibo(filePath string) error {
+	nfcBackendIf, ok := g.backendIf.(NfcBackendIf)
+	if !ok {
+		return fmt.Errorf("nfc is not supported")
+	}
+	amiibo, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("can not read amiibo file (%v): %w", filePath, err)
+	}
+	return nfcBackendIf.LoadAmiibo(amiibo)
+}
+
+// name is a file name in the amiibo dir
+func (g *Gamepad) LoadAmiiboByName(name string) error {
+	if g.opts.amiiboDir == "" {
+		return fmt.Errorf("no amiibo dir")
+	}
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("invalid amiibo name: %v", name)
+	}
+	return g.LoadAmiibo(filepath.Join(g.opts.amiiboDir, name))
+}
+
+func (g *Gamepad) RemoveAmiibo() error {
+	nfcBackendIf, ok := g.backendIf.(NfcBackendIf)
+	if !ok {
+		return fmt.Errorf("nfc is not supported")
+	}
+	return nfcBackendIf.RemoveAmiibo()
+}
+
+func (g *Gamepad) StartHidCapture(filePath string) error {
+	hidCaptureBackendIf, ok := g.backendIf.(HidCaptureBackendIf)
+	if !ok {
+		return fmt.Errorf("hid capture is not supported")
+	}
+	return hidCaptureBackendIf.StartHidCapture(filePath)
+}
+
+func (g *Gamepad) StopHidCapture() {
+	hidCaptureBackendIf, ok := g.backendIf.(HidCaptureBackendIf)
+	if !ok {
+		return
+	}
+	hidCaptureBackendIf.StopHidCapture()
+}
+
+// override or extend subcommands of switch controllers, nil handler restores the default
+func (g *Gamepad) SetSubCommandHandler(subCommand byte, handler NSSubCommandHandler) error {
+	subCommandBackendIf, ok := g.backendIf.(SubCommandBackendIf)
+	if !ok {
+		return fmt.Errorf("sub command is not supported")
+	}
+	subCommandBackendIf.SetSubCommandHandler(subCommand, handler)
+	return nil
+}
+
+func (g *Gamepad) SubCommandStats() (map[byte]*NSSubCommandStat, error) {
+	subCommandBackendIf, ok := g.backendIf.(SubCommandBackendIf)
+	if !ok {
+		return nil, fmt.Errorf("sub command is not supported")
+	}
+	return subCommandBackendIf.SubCommandStats(), nil
+}
+
+func (g *Gamepad) SetBattery(battery *GamepadBattery) error {
+	identityBackendIf, ok := g.backendIf.(IdentityBackendIf)
+	if !ok {
+		return fmt.Errorf("battery is not supported")
+	}
+	return identityBackendIf.SetBattery(battery)
+}
+
+func (g *Gamepad) GadgetHidDevFiles() (map[string]string, error) {
+	gadgetBackendIf, ok := g.backendIf.(GadgetBackendIf)
+	if !ok {
+		return nil, fmt.Errorf("gadget is not supported")
+	}
+	return gadgetBackendIf.GadgetHidDevFiles()
 }
 
 func (g *Gamepad) Press(buttons ...ButtonName) error {
+	if g.isMacroRunning() {
+		return nil
+	}
+	g.setHeldButtons(buttons, true)
 	return g.backendIf.Press(buttons)
 }
 
 func (g *Gamepad) Release(buttons ...ButtonName) error {
+	if g.isMacroRunning() {
+		return nil
+	}
+	g.setHeldButtons(buttons, false)
 	return g.backendIf.Release(buttons)
 }
 
 func (g *Gamepad) StickL(xAxis float64, yAxis float64) error {
+	if g.isMacroRunning() {
+		return nil
+	}
+	xAxis, yAxis = g.opts.leftStickShape.apply(xAxis, yAxis)
 	return g.backendIf.StickL(xAxis, yAxis)
 }
 
 func (g *Gamepad) StickR(xAxis float64, yAxis float64) error {
+	if g.isMacroRunning() {
+		return nil
+	}
+	xAxis, yAxis = g.opts.rightStickShape.apply(xAxis, yAxis)
 	return g.backendIf.StickR(xAxis, yAxis)
 }
 
+// raw inputs are written to the backend as is for exact playback (e.g. TAS),
+// stick shaping, remapping, turbo holding and macro gating are bypassed
+func (g *Gamepad) PressRaw(buttons ...ButtonName) error {
+	return g.backendIf.Press(buttons)
+}
+
+func (g *Gamepad) ReleaseRaw(buttons ...ButtonName) error {
+	return g.backendIf.Release(buttons)
+}
+
+func (g *Gamepad) StickLRaw(xAxis float64, yAxis float64) error {
+	return g.backendIf.StickL(xAxis, yAxis)
+}
+
+func (g *Gamepad) StickRRaw(xAxis float64, yAxis float64) error {
+	return g.backendIf.StickR(xAxis, yAxis)
+}
+
+// fn is called before each periodic input report, replaced if the name already exists
+func (g *Gamepad) AddFrameHook(name string, fn FrameHook) {
+	g.backendIf.AddFrameHook(name, fn)
+}
+
+func (g *Gamepad) RemoveFrameHook(name string) {
+	g.backendIf.RemoveFrameHook(name)
+}
+
 func (g *Gamepad) Start() error {
 	return g.backendIf.Start()
 }
 
 func (g *Gamepad) Stop() {
+	g.CancelMacro()
+	g.disableAllTurbo()
 	g.backendIf.Stop()
+	g.StopRecording()
 }
 
 func NewGamepad(model GamepadModel, macAddr string, spiMemory60 string, spiMemory80 string, opts ...GamepadOption) (*Gamepad, error) {
@@ -98,25 +482,115 @@ func NewGamepad(model GamepadModel, macAddr string, spiMemory60 string, spiMemor
                 }
                 opt(baseOpts)
         }
-	var err error
+        newGamepad := &Gamepad{
+                verbose: baseOpts.verbose,
+                opts: baseOpts,
+                backendIf: nil,
+		remapProfile: nil,
+		turboStates: make(map[ButtonName]*turboState),
+		buttonIndices: buttonIndices(model),
+		heldButtons: make(map[ButtonName]bool),
+        }
+	err := newGamepad.SelectRemapProfile("")
+	if err != nil {
+		return nil, fmt.Errorf("can not select default remap profile: %w", err)
+	}
 	var newBackendIf BackendIf
 	if model == ModelNSProCon {
-		newBackendIf, err = NewNSProCon(baseOpts.verbose, macAddr, spiMemory60, spiMemory80, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		newBackendIf, err = NewNSProCon(baseOpts.verbose, macAddr, spiMemory60, spiMemory80, baseOpts.spiFlashFile, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
 		if err != nil {
 			return nil, fmt.Errorf("can not create procon: %v", err)
 		}
+	} else if model == ModelNSJoyConL {
+		newBackendIf, err = NewNSJoyConL(baseOpts.verbose, macAddr, spiMemory60, spiMemory80, baseOpts.spiFlashFile, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		if err != nil {
+			return nil, fmt.Errorf("can not create joycon (L): %v", err)
+		}
+	} else if model == ModelNSJoyConR {
+		newBackendIf, err = NewNSJoyConR(baseOpts.verbose, macAddr, spiMemory60, spiMemory80, baseOpts.spiFlashFile, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		if err != nil {
+			return nil, fmt.Errorf("can not create joycon (R): %v", err)
+		}
 	} else if model == ModelPS4Con {
-		newBackendIf = NewPS4Con(baseOpts.verbose, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		newBackendIf, err = NewPS4Con(baseOpts.verbose, macAddr, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		if err != nil {
+			return nil, fmt.Errorf("can not create ps4con: %v", err)
+		}
+	} else if model == ModelPS5Con {
+		newBackendIf, err = NewPS5Con(baseOpts.verbose, macAddr, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
+		if err != nil {
+			return nil, fmt.Errorf("can not create ps5con: %v", err)
+		}
+	} else if model == ModelGenericHid {
+		newBackendIf = NewGenericHid(baseOpts.verbose, baseOpts.devFilePath, baseOpts.configsHome, baseOpts.udc)
 	}
 	if newBackendIf == nil {
 		return nil, fmt.Errorf("unsupported model: %v", model)
 	}
+	if baseOpts.identity != nil {
+		identityBackendIf, ok := newBackendIf.(IdentityBackendIf)
+		if !ok {
+			return nil, fmt.Errorf("identity is not supported: %v", model)
+		}
+		err = identityBackendIf.SetIdentity(baseOpts.identity)
+		if err != nil {
+			return nil, fmt.Errorf("can not set identity: %w", err)
+		}
+	}
+	if baseOpts.mcuReport {
+		mcuReportBackendIf, ok := newBackendIf.(McuReportBackendIf)
+		if !ok {
+			return nil, fmt.Errorf("mcu report is not supported: %v", model)
+		}
+		mcuReportBackendIf.SetMcuReport(true)
+	}
+	if len(baseOpts.gadgetFunctions) > 0 {
+		gadgetBackendIf, ok := newBackendIf.(GadgetBackendIf)
+		if !ok {
+			return nil, fmt.Errorf("gadget functions are not supported: %v", model)
+		}
+		gadgetBackendIf.AddGadgetFunctions(baseOpts.gadgetFunctions)
+	}
 	err = newBackendIf.Setup()
 	if err != nil {
 		return nil, fmt.Errorf("backend setup error: %w", err)
 	}
-        return &Gamepad{
-                verbose: baseOpts.verbose,
-                backendIf: newBackendIf,
-        }, nil
+        newGamepad.backendIf = newBackendIf
+	if baseOpts.reportRate != 0 || baseOpts.eventDriven {
+		reportRateBackendIf, ok := newBackendIf.(ReportRateBackendIf)
+		if !ok {
+			return nil, fmt.Errorf("report rate is not supported: %v", model)
+		}
+		if baseOpts.reportRate != 0 {
+			err = reportRateBackendIf.SetReportRate(baseOpts.reportRate)
+			if err != nil {
+				return nil, fmt.Errorf("can not set report rate: %w", err)
+			}
+		}
+		reportRateBackendIf.SetEventDrivenReport(baseOpts.eventDriven, baseOpts.minReportInterval)
+	}
+	if baseOpts.hidCaptureFile != "" {
+		err := newGamepad.StartHidCapture(baseOpts.hidCaptureFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not start hid capture: %w", err)
+		}
+	}
+	if baseOpts.recordDir != "" {
+		_, err := newGamepad.StartRecording(baseOpts.recordDir)
+		if err != nil {
+			return nil, fmt.Errorf("can not start recording: %w", err)
+		}
+	}
+	if baseOpts.amiiboFile != "" {
+		err := newGamepad.LoadAmiibo(baseOpts.amiiboFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not load amiibo: %w", err)
+		}
+	}
+	for _, turboButton := range baseOpts.turboButtons {
+		if turboButton.Enable {
+			newGamepad.EnableTurbo(turboButton.Button, turboButton.Frames)
+		}
+	}
+	return newGamepad, nil
 }
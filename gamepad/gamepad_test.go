@@ -0,0 +1,117 @@
+package gamepad
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"github.com/potix/regapweb/message"
+)
+
+// backend keeping the last values, frames are advanced by RunFrameHooks
+type testBackend struct {
+	*BaseBackend
+	pressed map[ButtonName]bool
+	stickL  [2]float64
+	stickR  [2]float64
+	state   *message.GamepadState
+	mutex   sync.Mutex
+}
+
+func (b *testBackend) Setup() error {
+	return nil
+}
+
+func (b *testBackend) Start() error {
+	return nil
+}
+
+func (b *testBackend) Stop() {
+}
+
+func (b *testBackend) UpdateState(state *message.GamepadState) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = state
+	b.pressed = make(map[ButtonName]bool)
+	for button, indices := range standardButtonIndices {
+		for _, i := range indices {
+			if i < len(state.Buttons) && state.Buttons[i].Pressed {
+				b.pressed[button] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (b *testBackend) Press(buttons []ButtonName) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, button := range buttons {
+		b.pressed[button] = true
+	}
+	return nil
+}
+
+func (b *testBackend) Release(buttons []ButtonName) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, button := range buttons {
+		delete(b.pressed, button)
+	}
+	return nil
+}
+
+func (b *testBackend) StickL(xAxis float64, yAxis float64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stickL = [2]float64{ xAxis, yAxis }
+	return nil
+}
+
+func (b *testBackend) StickR(xAxis float64, yAxis float64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stickR = [2]float64{ xAxis, yAxis }
+	return nil
+}
+
+func (b *testBackend) pressedButtons() []ButtonName {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buttons := make([]ButtonName, 0, len(b.pressed))
+	for button, _ := range b.pressed {
+		buttons = append(buttons, button)
+	}
+	sort.Slice(buttons, func(i, j int) bool { return buttons[i] < buttons[j] })
+	return buttons
+}
+
+func (b *testBackend) frameHookCount() int {
+	b.frameMutex.Lock()
+	defer b.frameMutex.Unlock()
+	return len(b.frameHooks)
+}
+
+func newTestGamepad(t *testing.T, opts ...GamepadOption) (*Gamepad, *testBackend) {
+	t.Helper()
+	baseOpts := defaultGamepadOptions()
+	for _, opt := range opts {
+		opt(baseOpts)
+	}
+	backend := &testBackend{
+		BaseBackend: &BaseBackend{},
+		pressed: make(map[ButtonName]bool),
+	}
+	g := &Gamepad{
+		verbose: false,
+		opts: baseOpts,
+		backendIf: backend,
+		turboStates: make(map[ButtonName]*turboState),
+		buttonIndices: standardButtonIndices,
+		heldButtons: make(map[ButtonName]bool),
+	}
+	if err := g.SelectRemapProfile(""); err != nil {
+		t.Fatalf("can not select remap profile: %v", err)
+	}
+	return g, backend
+}
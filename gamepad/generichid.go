@@ -0,0 +1,393 @@
+package gamepad
+
+//
+// standard usb hid gamepad without any vendor handshake.
+// buttons (14), hat switch, left stick (X, Y), right stick (Z, Rz), triggers (Rx, Ry)
+//
+
+import(
+        "fmt"
+        "log"
+	"os"
+	"sync"
+	"time"
+	"math"
+	"github.com/potix/regaprelay/gamepad/setup"
+	"github.com/potix/regapweb/message"
+)
+
+const genericHidReportInterval = 8 * time.Millisecond
+
+// button bits in the input report
+const (
+	genericHidButtonB       uint16 = 1 << iota
+	genericHidButtonA
+	genericHidButtonY
+	genericHidButtonX
+	genericHidButtonL
+	genericHidButtonR
+	genericHidButtonZL
+	genericHidButtonZR
+	genericHidButtonMinus
+	genericHidButtonPlus
+	genericHidButtonStickL
+	genericHidButtonStickR
+	genericHidButtonHome
+	genericHidButtonCapture
+)
+
+type genericHidController struct {
+	buttons      uint16
+	up           byte
+	down         byte
+	left         byte
+	right        byte
+	leftStick    *stick
+	rightStick   *stick
+	leftTrigger  float64
+	rightTrigger float64
+}
+
+type GenericHid struct  {
+	*BaseBackend
+	setupParams *setup.UsbGadgetHidSetupParams
+	verbose     bool
+	devFilePath string
+	devFile     *os.File
+	stopCh      chan int
+	mutex       sync.Mutex
+	controller  *genericHidController
+}
+
+func (g *GenericHid) writeReport(f *os.File, reportBytes []byte) error {
+	wl, err := f.Write(reportBytes)
+	if err != nil {
+		return fmt.Errorf("can not write report to gadget device file: %w", err)
+	}
+	if wl != len(reportBytes) {
+		return fmt.Errorf("partial write report to gadget device file: write len = %v", wl)
+	}
+	return nil
+}
+
+func (g *GenericHid) axisToByte(v float64) byte {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	return byte(math.Round((1 + v) * 127.5))
+}
+
+func (g *GenericHid) triggerToByte(v float64) byte {
+	if v > 1 {
+		v = 1
+	} else if v < 0 {
+		v = 0
+	}
+	return byte(math.Round(v * 255))
+}
+
+func (g *GenericHid) buildInputReport() []byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	buttons := g.controller.buttons
+	if g.controller.leftStick.press == 1 {
+		buttons |= genericHidButtonStickL
+	}
+	if g.controller.rightStick.press == 1 {
+		buttons |= genericHidButtonStickR
+	}
+	return []byte{
+		byte(buttons & 0xff), byte(buttons >> 8),
+		hatSwitch(g.controller.up, g.controller.right, g.controller.down, g.controller.left),
+		g.axisToByte(g.controller.leftStick.x),
+		g.axisToByte(g.controller.leftStick.y),
+		g.axisToByte(g.controller.rightStick.x),
+		g.axisToByte(g.controller.rightStick.y),
+		g.triggerToByte(g.controller.leftTrigger),
+		g.triggerToByte(g.controller.rightTrigger),
+	}
+}
+
+func (g *GenericHid) writeInputReportLoop(f *os.File) {
+	ticker := time.NewTicker(genericHidReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.RunFrameHooks()
+			err := g.writeReport(f, g.buildInputReport())
+			if err != nil {
+				log.Printf("can not write report to gadget device file: %v", err)
+				return
+			}
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+func (g *GenericHid) AddGadgetFunctions(functions []*setup.UsbGadgetFunction) {
+	addGadgetFunctions(g.setupParams, functions)
+}
+
+func (g *GenericHid) GadgetHidDevFiles() (map[string]string, error) {
+	return gadgetHidDevFiles(g.setupParams, g.devFilePath)
+}
+
+func (g *GenericHid) Setup() error {
+	err := setup.UsbGadgetHidSetup(g.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not setup usb gadget hid device in generichid: %w", err)
+	}
+	err = setup.UsbGadgetHidEnable(g.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not enable usb gadget hid device in generichid: %w", err)
+	}
+	time.Sleep(time.Second)
+	g.devFilePath = resolveDevFilePath(g.setupParams, g.devFilePath)
+	_, err =  os.Stat(g.devFilePath)
+	if err != nil {
+		return fmt.Errorf("not found device file  (%v) in generichid: %w", g.devFilePath, err)
+	}
+	return nil
+}
+
+func (g *GenericHid) Start() error {
+        f, err := os.OpenFile(g.devFilePath, os.O_RDWR, 0644)
+        if err != nil {
+                return fmt.Errorf("can not open device file (%v) in generichid: %w", g.devFilePath, err)
+        }
+	g.devFile = f
+	go g.writeInputReportLoop(f)
+	return nil
+}
+
+func (g *GenericHid) Stop() {
+	close(g.stopCh)
+	g.devFile.Close()
+	err := setup.UsbGadgetHidDisable(g.setupParams)
+	if err != nil {
+		log.Printf("can not disable usb gadget hid device in generichid: %v", err)
+	}
+	err = setup.UsbGadgetHidCleanup(g.setupParams)
+	if err != nil {
+		log.Printf("can not cleanup usb gadget hid device in generichid: %v", err)
+	}
+}
+
+func (g *GenericHid) setButton(bit uint16, pressed bool) {
+	if pressed {
+		g.controller.buttons |= bit
+	} else {
+		g.controller.buttons &^= bit
+	}
+}
+
+func (g *GenericHid) boolToByte(v bool) byte {
+	if v {
+		return byte(1)
+	} else {
+		return byte(0)
+	}
+}
+
+func (g *GenericHid) UpdateState(state *message.GamepadState) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, button := range state.Buttons {
+		switch i {
+		case 0:
+			g.setButton(genericHidButtonB, button.Pressed)
+		case 1:
+			g.setButton(genericHidButtonA, button.Pressed)
+		case 2:
+			g.setButton(genericHidButtonY, button.Pressed)
+		case 3:
+			g.setButton(genericHidButtonX, button.Pressed)
+		case 4:
+			g.setButton(genericHidButtonL, button.Pressed)
+		case 5:
+			g.setButton(genericHidButtonR, button.Pressed)
+		case 6:
+			g.setButton(genericHidButtonZL, button.Pressed)
+			g.controller.leftTrigger = button.Value
+		case 7:
+			g.setButton(genericHidButtonZR, button.Pressed)
+			g.controller.rightTrigger = button.Value
+		case 8:
+			g.setButton(genericHidButtonMinus, button.Pressed)
+		case 9:
+			g.setButton(genericHidButtonPlus, button.Pressed)
+		case 10:
+			g.controller.leftStick.press = g.boolToByte(button.Pressed)
+		case 11:
+			g.controller.rightStick.press = g.boolToByte(button.Pressed)
+		case 12:
+			g.controller.up = g.boolToByte(button.Pressed)
+		case 13:
+			g.controller.down = g.boolToByte(button.Pressed)
+		case 14:
+			g.controller.left = g.boolToByte(button.Pressed)
+		case 15:
+			g.controller.right = g.boolToByte(button.Pressed)
+		case 16:
+			g.setButton(genericHidButtonHome, button.Pressed)
+		case 17:
+			g.setButton(genericHidButtonCapture, button.Pressed)
+		default:
+			log.Printf("can not update state because unsupported button in generichid: button index = %v", i)
+		}
+	}
+	for i, axis := range state.Axes {
+		switch i {
+		case 0:
+			g.controller.leftStick.x = axis
+		case 1:
+			g.controller.leftStick.y = axis
+		case 2:
+			g.controller.rightStick.x = axis
+		case 3:
+			g.controller.rightStick.y = axis
+		default:
+			log.Printf("can not update state because unsupported axis in generichid: axis index = %v", i)
+		}
+	}
+	if g.verbose {
+		log.Printf("buttons = %016b, left stick = %+v, right stick = %+v, left trigger = %v, right trigger = %v",
+			g.controller.buttons, g.controller.leftStick, g.controller.rightStick, g.controller.leftTrigger, g.controller.rightTrigger)
+	}
+	return nil
+}
+
+func (g *GenericHid) updateButton(button ButtonName, pressed bool) error {
+	switch button {
+	case ButtonA:
+		g.setButton(genericHidButtonA, pressed)
+	case ButtonB:
+		g.setButton(genericHidButtonB, pressed)
+	case ButtonX:
+		g.setButton(genericHidButtonX, pressed)
+	case ButtonY:
+		g.setButton(genericHidButtonY, pressed)
+	case ButtonLeft:
+		g.controller.left = g.boolToByte(pressed)
+	case ButtonRight:
+		g.controller.right = g.boolToByte(pressed)
+	case ButtonUp:
+		g.controller.up = g.boolToByte(pressed)
+	case ButtonDown:
+		g.controller.down = g.boolToByte(pressed)
+	case ButtonPlus:
+		g.setButton(genericHidButtonPlus, pressed)
+	case ButtonMinus:
+		g.setButton(genericHidButtonMinus, pressed)
+	case ButtonHome:
+		g.setButton(genericHidButtonHome, pressed)
+	case ButtonCapture:
+		g.setButton(genericHidButtonCapture, pressed)
+	case ButtonStickL:
+		g.controller.leftStick.press = g.boolToByte(pressed)
+	case ButtonStickR:
+		g.controller.rightStick.press = g.boolToByte(pressed)
+	case ButtonL:
+		g.setButton(genericHidButtonL, pressed)
+	case ButtonR:
+		g.setButton(genericHidButtonR, pressed)
+	case ButtonZL:
+		g.setButton(genericHidButtonZL, pressed)
+		g.controller.leftTrigger = float64(g.boolToByte(pressed))
+	case ButtonZR:
+		g.setButton(genericHidButtonZR, pressed)
+		g.controller.rightTrigger = float64(g.boolToByte(pressed))
+	default:
+		return fmt.Errorf("unsupported button in generichid: %v", button)
+	}
+	return nil
+}
+
+func (g *GenericHid) Press(buttons []ButtonName) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, button := range buttons {
+		err := g.updateButton(button, true)
+		if err != nil {
+			return fmt.Errorf("can not press: %w", err)
+		}
+	}
+	return nil
+}
+
+func (g *GenericHid) Release(buttons []ButtonName) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, button := range buttons {
+		err := g.updateButton(button, false)
+		if err != nil {
+			return fmt.Errorf("can not release: %w", err)
+		}
+	}
+	return nil
+}
+
+func (g *GenericHid) StickL(xAxis float64, yAxis float64) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.controller.leftStick.x = xAxis
+	g.controller.leftStick.y = yAxis
+	return nil
+}
+
+func (g *GenericHid) StickR(xAxis float64, yAxis float64) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.controller.rightStick.x = xAxis
+	g.controller.rightStick.y = yAxis
+	return nil
+}
+
+func NewGenericHid(verbose bool, devFilePath string, configsHome string, udc string) *GenericHid {
+        setupParams := &setup.UsbGadgetHidSetupParams{
+                ConfigsHome:     configsHome,
+                GadgetName:      "generichid",
+                IdProduct:       "0x0104",
+                IdVendor:        "0x1d6b",
+                BcdDevice:       "0x0100",
+                BcdUsb:          "0x0200",
+                BMaxPacketSize0: "64",
+                BDeviceProtocol: "0",
+                BDeviceSubClass: "0",
+                BDeviceClass:    "0",
+                StringsLang:     "0x409",
+                ISerial:         "000000000001",
+                IProduct:        "Regaprelay Gamepad",
+                IManufacturer:   "regaprelay",
+                ConfigName:      "c",
+                ConfigNumber:    "1",
+                ConfigString:    "Generic HID Gamepad",
+                BmAttributes:    "0x80",
+                MaxPower:        "500",
+                FunctionName:    "hid",
+                InstanceName:    "usb0",
+                Protocol:        "0",
+                Subclass:        "0",
+                ReportLength:    "9",
+                ReportDesc:      "05010905A10115002501350045017501950E05091901290E810275019502810305012507463B017504950165140939814265009501810126FF0046FF00093009310932093509330934750895068102C0",
+		UDC:             udc,
+        }
+	return &GenericHid{
+		BaseBackend: &BaseBackend{
+			verbose: verbose,
+		},
+		verbose: verbose,
+		setupParams: setupParams,
+		devFilePath: devFilePath,
+		devFile: nil,
+		stopCh: make(chan int),
+		controller: &genericHidController{
+			leftStick: &stick{},
+			rightStick: &stick{},
+		},
+	}
+}
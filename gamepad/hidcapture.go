@@ -0,0 +1,218 @@
+package gamepad
+
+//
+// raw hid report capture
+//
+// file format (all integers are little endian)
+//   header: magic "RGHIDCAP" (8 bytes), version (uint16, 1), reserved (uint16)
+//   record: timestamp (uint64, microseconds since unix epoch),
+//           direction (uint8, 0 = host to device (read), 1 = device to host (written)),
+//           length (uint16), report (length bytes, report id first)
+//
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type HidCaptureDirection byte
+
+const (
+	HidCaptureDirectionOut HidCaptureDirection = 0 // host to device
+	HidCaptureDirectionIn                      = 1 // device to host
+)
+
+const (
+	hidCaptureMagic   string = "RGHIDCAP"
+	hidCaptureVersion uint16 = 1
+)
+
+type HidCaptureBackendIf interface {
+	StartHidCapture(filePath string) error
+	StopHidCapture()
+}
+
+type HidCaptureRecord struct {
+	Time      time.Time
+	Direction HidCaptureDirection
+	Report    []byte
+}
+
+type HidCaptureWriter struct {
+	filePath string
+	file     *os.File
+	writer   *bufio.Writer
+	mutex    sync.Mutex
+}
+
+func (h *HidCaptureWriter) Write(direction HidCaptureDirection, report []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	record := make([]byte, 11 + len(report))
+	binary.LittleEndian.PutUint64(record[0:8], uint64(time.Now().UnixMicro()))
+	record[8] = byte(direction)
+	binary.LittleEndian.PutUint16(record[9:11], uint16(len(report)))
+	copy(record[11:], report)
+	_, err := h.writer.Write(record)
+	if err != nil {
+		return fmt.Errorf("can not write hid capture record (%v): %w", h.filePath, err)
+	}
+	// records are kept on crash
+	err = h.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("can not flush hid capture file (%v): %w", h.filePath, err)
+	}
+	return nil
+}
+
+func (h *HidCaptureWriter) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	err := h.writer.Flush()
+	if err != nil {
+		h.file.Close()
+		return fmt.Errorf("can not flush hid capture file (%v): %w", h.filePath, err)
+	}
+	return h.file.Close()
+}
+
+func NewHidCaptureWriter(filePath string) (*HidCaptureWriter, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can not open hid capture file (%v): %w", filePath, err)
+	}
+	writer := bufio.NewWriter(file)
+	header := make([]byte, 12)
+	copy(header[0:8], hidCaptureMagic)
+	binary.LittleEndian.PutUint16(header[8:10], hidCaptureVersion)
+	_, err = writer.Write(header)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can not write hid capture header (%v): %w", filePath, err)
+	}
+	return &HidCaptureWriter{
+		filePath: filePath,
+		file: file,
+		writer: writer,
+	}, nil
+}
+
+// capture of backends, does nothing until start
+type hidCapturer struct {
+	writer *HidCaptureWriter
+	mutex  sync.Mutex
+}
+
+// caller must hold the mutex
+func (h *hidCapturer) close() {
+	if h.writer == nil {
+		return
+	}
+	if err := h.writer.Close(); err != nil {
+		log.Printf("can not close hid capture writer: %v", err)
+	}
+	h.writer = nil
+}
+
+func (h *hidCapturer) start(filePath string) error {
+	writer, err := NewHidCaptureWriter(filePath)
+	if err != nil {
+		return fmt.Errorf("can not create hid capture writer: %w", err)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.close()
+	h.writer = writer
+	return nil
+}
+
+func (h *hidCapturer) stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.close()
+}
+
+func (h *hidCapturer) capture(direction HidCaptureDirection, report []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.writer == nil {
+		return
+	}
+	if err := h.writer.Write(direction, report); err != nil {
+		log.Printf("can not capture hid report, stop capture: %v", err)
+		h.close()
+	}
+}
+
+func newHidCapturer() *hidCapturer {
+	return &hidCapturer{}
+}
+
+type HidCaptureReader struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// returns io.EOF at the end of the file
+func (h *HidCaptureReader) Next() (*HidCaptureRecord, error) {
+	header := make([]byte, 11)
+	_, err := io.ReadFull(h.reader, header)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("can not read hid capture record header: %w", err)
+	}
+	length := binary.LittleEndian.Uint16(header[9:11])
+	report := make([]byte, length)
+	_, err = io.ReadFull(h.reader, report)
+	if err != nil {
+		return nil, fmt.Errorf("can not read hid capture record report: %w", err)
+	}
+	return &HidCaptureRecord{
+		Time: time.UnixMicro(int64(binary.LittleEndian.Uint64(header[0:8]))),
+		Direction: HidCaptureDirection(header[8]),
+		Report: report,
+	}, nil
+}
+
+func (h *HidCaptureReader) Close() error {
+	return h.file.Close()
+}
+
+func OpenHidCapture(filePath string) (*HidCaptureReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can not open hid capture file (%v): %w", filePath, err)
+	}
+	reader := bufio.NewReader(file)
+	header := make([]byte, 12)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can not read hid capture header (%v): %w", filePath, err)
+	}
+	if !bytes.Equal(header[:8], []byte(hidCaptureMagic)) {
+		file.Close()
+		return nil, fmt.Errorf("invalid hid capture magic (%v): %x", filePath, header[:8])
+	}
+	version := binary.LittleEndian.Uint16(header[8:10])
+	if version != hidCaptureVersion {
+		file.Close()
+		return nil, fmt.Errorf("unsupported hid capture version (%v): %v", filePath, version)
+	}
+	return &HidCaptureReader{
+		file: file,
+		reader: reader,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package gamepad
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHidCaptureRoundTrip(t *testing.T) {
+	records := []struct {
+		direction HidCaptureDirection
+		report    []byte
+	}{
+		{ direction: HidCaptureDirectionOut, report: []byte{ 0x80, 0x01 } },
+		{ direction: HidCaptureDirectionIn, report: append([]byte{ 0x81, 0x01 }, make([]byte, 62)...) },
+		{ direction: HidCaptureDirectionOut, report: []byte{} },
+		{ direction: HidCaptureDirectionIn, report: bytes.Repeat([]byte{ 0x30 }, 362) },
+	}
+	filePath := filepath.Join(t.TempDir(), "capture.bin")
+	writer, err := NewHidCaptureWriter(filePath)
+	if err != nil {
+		t.Fatalf("can not create writer: %v", err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record.direction, record.report); err != nil {
+			t.Fatalf("can not write record: %v", err)
+		}
+	}
+	// records are flushed without close
+	defer writer.Close()
+	reader, err := OpenHidCapture(filePath)
+	if err != nil {
+		t.Fatalf("can not open capture: %v", err)
+	}
+	defer reader.Close()
+	for i, record := range records {
+		r, err := reader.Next()
+		if err != nil {
+			t.Fatalf("can not read record %v: %v", i, err)
+		}
+		if r.Direction != record.direction {
+			t.Errorf("record %v: direction = %v, want %v", i, r.Direction, record.direction)
+		}
+		if !bytes.Equal(r.Report, record.report) {
+			t.Errorf("record %v: report = %x, want %x", i, r.Report, record.report)
+		}
+		if r.Time.IsZero() {
+			t.Errorf("record %v: no time", i)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("after last record: err = %v, want io.EOF", err)
+	}
+}
+
+func TestOpenHidCaptureInvalidHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{ name: "short", header: []byte(hidCaptureMagic) },
+		{ name: "magic", header: []byte("XXHIDCAP\x01\x00\x00\x00") },
+		{ name: "version", header: []byte(hidCaptureMagic + "\x02\x00\x00\x00") },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "capture.bin")
+			if err := os.WriteFile(filePath, tt.header, 0644); err != nil {
+				t.Fatalf("can not write file: %v", err)
+			}
+			reader, err := OpenHidCapture(filePath)
+			if err == nil {
+				reader.Close()
+				t.Errorf("OpenHidCapture succeeded with header %x", tt.header)
+			}
+		})
+	}
+}
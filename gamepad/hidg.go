@@ -0,0 +1,53 @@
+package gamepad
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// f_hid can answer GET_REPORT requests from the host since linux 6.13.
+// A report registered with userspaceReq = 0 is cached in the kernel and
+// returned for every later GET_REPORT of the same report id.
+// see include/uapi/linux/usb/g_hid.h
+const (
+	hidgMaxReportLength   = 64
+	hidgIocWriteGetReport = 0x40486742 // _IOW('g', 0x42, struct usb_hidg_report)
+)
+
+type hidgReport struct {
+	reportId     uint8
+	userspaceReq uint8
+	length       uint16
+	data         [hidgMaxReportLength]byte
+	padding      [4]byte
+}
+
+func hidgSetGetReport(f *os.File, reportId byte, reportBytes []byte) error {
+	if len(reportBytes) > hidgMaxReportLength {
+		return fmt.Errorf("too long get report (%x): length = %v", reportId, len(reportBytes))
+	}
+	report := &hidgReport{
+		reportId: reportId,
+		userspaceReq: 0,
+		length: uint16(len(reportBytes)),
+	}
+	copy(report.data[:], reportBytes)
+	// f.Fd() switches the file to blocking mode, then Close does not unblock Read
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("can not get raw connection of gadget device file: %w", err)
+	}
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(hidgIocWriteGetReport), uintptr(unsafe.Pointer(report)))
+	})
+	if err != nil {
+		return fmt.Errorf("can not control gadget device file: %w", err)
+	}
+	if errno != 0 {
+		return fmt.Errorf("can not set get report (%x) to gadget device file: %w", reportId, errno)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gamepad
+
+// GamepadPlayerLights is player leds set by the host.
+// On and Flashing are bit patterns of 4 leds (5 leds of the dualsense, bit 0 is the first led).
+type GamepadPlayerLights struct {
+	Player   int /* 1 - 8, 0 = unknown */
+	On       byte
+	Flashing byte
+}
+
+// GamepadHomeLightCycle is a mini cycle of the home light.
+// FadeDuration and HoldDuration are multiplier of BaseDuration.
+type GamepadHomeLightCycle struct {
+	Intensity    byte /* 0x0 - 0xf */
+	FadeDuration byte /* 0x0 - 0xf */
+	HoldDuration byte /* 0x0 - 0xf */
+}
+
+// GamepadHomeLight is home light pattern set by the host.
+type GamepadHomeLight struct {
+	BaseDuration   byte /* 0x1 - 0xf (8ms - 175ms), 0x0 = off */
+	StartIntensity byte /* 0x0 - 0xf */
+	RepeatCount    byte /* 0x0 = forever */
+	Cycles         []*GamepadHomeLightCycle
+}
+
+// GamepadLightBar is the color of the light bar of sony controllers.
+type GamepadLightBar struct {
+	Red   byte
+	Green byte
+	Blue  byte
+}
+
+// GamepadMuteLight is the mic mute led of the dualsense.
+type GamepadMuteLight struct {
+	Mode byte /* 0 = off, 1 = on, 2 = breathing */
+}
+
+type GamepadLights struct {
+	PlayerLights *GamepadPlayerLights `json:"PlayerLights,omitempty"`
+	HomeLight    *GamepadHomeLight    `json:"HomeLight,omitempty"`
+	LightBar     *GamepadLightBar     `json:"LightBar,omitempty"`
+	MuteLight    *GamepadMuteLight    `json:"MuteLight,omitempty"`
+}
+
+// player leds pattern of the switch
+var playerLightsPatternMap map[byte]int = map[byte]int{
+	0x1: 1, 0x3: 2, 0x7: 3, 0xf: 4,
+	0x9: 5, 0x5: 6, 0xd: 7, 0x6: 8,
+}
+
+func decodePlayerLights(arg byte) *GamepadPlayerLights {
+	on := arg & 0x0f
+	flashing := (arg >> 4) & 0x0f
+	player, ok := playerLightsPatternMap[on]
+	if !ok {
+		player = 0
+	}
+	return &GamepadPlayerLights{
+		Player:   player,
+		On:       on,
+		Flashing: flashing,
+	}
+}
+
+func decodeHomeLight(args []byte) *GamepadHomeLight {
+	homeLight := &GamepadHomeLight{
+		Cycles: make([]*GamepadHomeLightCycle, 0, 15),
+	}
+	if len(args) < 2 {
+		return homeLight
+	}
+	nCycles := int(args[0] >> 4)
+	homeLight.BaseDuration = args[0] & 0x0f
+	homeLight.StartIntensity = args[1] >> 4
+	homeLight.RepeatCount = args[1] & 0x0f
+	// 2 cycles are packed into 3 bytes
+	// intensity (cycle 1 | cycle 2), fade/hold (cycle 1), fade/hold (cycle 2)
+	for i := 0; i < nCycles; i++ {
+		offset := 2 + (i/2)*3
+		if offset+1+i%2 >= len(args) {
+			break
+		}
+		intensity := args[offset] >> 4
+		if i%2 == 1 {
+			intensity = args[offset] & 0x0f
+		}
+		duration := args[offset+1+i%2]
+		homeLight.Cycles = append(homeLight.Cycles, &GamepadHomeLightCycle{
+			Intensity:    intensity,
+			FadeDuration: duration >> 4,
+			HoldDuration: duration & 0x0f,
+		})
+	}
+	return homeLight
+}
@@ -0,0 +1,97 @@
+package gamepad
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodePlayerLights(t *testing.T) {
+	tests := []struct {
+		arg  byte
+		want *GamepadPlayerLights
+	}{
+		{ arg: 0x01, want: &GamepadPlayerLights{ Player: 1, On: 0x1, Flashing: 0x0 } },
+		{ arg: 0x0f, want: &GamepadPlayerLights{ Player: 4, On: 0xf, Flashing: 0x0 } },
+		{ arg: 0x06, want: &GamepadPlayerLights{ Player: 8, On: 0x6, Flashing: 0x0 } },
+		{ arg: 0xf0, want: &GamepadPlayerLights{ Player: 0, On: 0x0, Flashing: 0xf } },
+		{ arg: 0x32, want: &GamepadPlayerLights{ Player: 0, On: 0x2, Flashing: 0x3 } },
+	}
+	for _, tt := range tests {
+		if got := decodePlayerLights(tt.arg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodePlayerLights(%02x) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeHomeLight(t *testing.T) {
+	tests := []struct {
+		name string
+		args []byte
+		want *GamepadHomeLight
+	}{
+		{
+			name: "short",
+			args: []byte{ 0x1f },
+			want: &GamepadHomeLight{ Cycles: []*GamepadHomeLightCycle{} },
+		},
+		{
+			name: "no cycle",
+			args: []byte{ 0x0f, 0xf0 },
+			want: &GamepadHomeLight{ BaseDuration: 0xf, StartIntensity: 0xf, RepeatCount: 0x0, Cycles: []*GamepadHomeLightCycle{} },
+		},
+		{
+			name: "two cycles",
+			args: []byte{ 0x2a, 0x31, 0xf0, 0x12, 0x34 },
+			want: &GamepadHomeLight{ BaseDuration: 0xa, StartIntensity: 0x3, RepeatCount: 0x1, Cycles: []*GamepadHomeLightCycle{
+				&GamepadHomeLightCycle{ Intensity: 0xf, FadeDuration: 0x1, HoldDuration: 0x2 },
+				&GamepadHomeLightCycle{ Intensity: 0x0, FadeDuration: 0x3, HoldDuration: 0x4 },
+			} },
+		},
+		{
+			name: "three cycles",
+			args: []byte{ 0x31, 0x00, 0x8f, 0x11, 0x22, 0x50, 0x33 },
+			want: &GamepadHomeLight{ BaseDuration: 0x1, Cycles: []*GamepadHomeLightCycle{
+				&GamepadHomeLightCycle{ Intensity: 0x8, FadeDuration: 0x1, HoldDuration: 0x1 },
+				&GamepadHomeLightCycle{ Intensity: 0xf, FadeDuration: 0x2, HoldDuration: 0x2 },
+				&GamepadHomeLightCycle{ Intensity: 0x5, FadeDuration: 0x3, HoldDuration: 0x3 },
+			} },
+		},
+		{
+			name: "truncated cycles",
+			args: []byte{ 0x21, 0x00, 0x8f, 0x11 },
+			want: &GamepadHomeLight{ BaseDuration: 0x1, Cycles: []*GamepadHomeLightCycle{
+				&GamepadHomeLightCycle{ Intensity: 0x8, FadeDuration: 0x1, HoldDuration: 0x1 },
+			} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeHomeLight(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeHomeLight(%x) = %+v, want %+v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendLightsSlowListener(t *testing.T) {
+	b := &BaseBackend{}
+	blockCh := make(chan int)
+	b.StartLightsListener(func(*GamepadLights) {
+		<-blockCh
+	})
+	defer b.StopLightsListener()
+	defer close(blockCh)
+	doneCh := make(chan int)
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < listenerQueueSize * 2; i++ {
+			b.SendLights(&GamepadLights{ PlayerLights: decodePlayerLights(byte(i)) })
+		}
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendLights is blocked by the listener")
+	}
+}
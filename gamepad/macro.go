@@ -0,0 +1,188 @@
+package gamepad
+
+//
+// macro of timed button/stick sequences
+//
+
+import (
+	"fmt"
+	"log"
+)
+
+type MacroStick struct {
+	X float64
+	Y float64
+}
+
+// MacroStep is held for Frames input reports (60Hz on switch controllers).
+// StickL and StickR are not changed if nil.
+type MacroStep struct {
+	Press   []ButtonName
+	Release []ButtonName
+	StickL  *MacroStick
+	StickR  *MacroStick
+	Frames  int
+}
+
+type Macro struct {
+	Name  string
+	Steps []*MacroStep
+}
+
+type macroRunner struct {
+	macro           *Macro
+	step            int
+	remainingFrames int
+	pressed         map[ButtonName]bool
+	stickLMoved     bool
+	stickRMoved     bool
+}
+
+const (
+	macroFrameHookName string = "macro"
+)
+
+func (g *Gamepad) findMacro(name string) (*Macro, error) {
+	for _, macro := range g.opts.macros {
+		if macro.Name == name {
+			return macro, nil
+		}
+	}
+	return nil, fmt.Errorf("not found macro: %v", name)
+}
+
+// release buttons and sticks touched by the macro, and apply the state received while running
+// caller must hold the macroMutex
+func (g *Gamepad) cleanupMacro(applyPendingState bool) {
+	runner := g.macroRunner
+	if runner == nil {
+		return
+	}
+	g.macroRunner = nil
+	g.backendIf.RemoveFrameHook(macroFrameHookName)
+	buttons := make([]ButtonName, 0, len(runner.pressed))
+	for button, _ := range runner.pressed {
+		buttons = append(buttons, button)
+	}
+	if len(buttons) > 0 {
+		if err := g.backendIf.Release(buttons); err != nil {
+			log.Printf("can not release buttons of macro (%v): %v", runner.macro.Name, err)
+		}
+	}
+	if runner.stickLMoved {
+		if err := g.backendIf.StickL(0, 0); err != nil {
+			log.Printf("can not reset left stick of macro (%v): %v", runner.macro.Name, err)
+		}
+	}
+	if runner.stickRMoved {
+		if err := g.backendIf.StickR(0, 0); err != nil {
+			log.Printf("can not reset right stick of macro (%v): %v", runner.macro.Name, err)
+		}
+	}
+	if !applyPendingState || g.pendingState == nil {
+		return
+	}
+	pendingState := g.pendingState
+	g.pendingState = nil
+	if err := g.applyState(pendingState); err != nil {
+		log.Printf("can not apply state after macro (%v): %v", runner.macro.Name, err)
+	}
+}
+
+func (g *Gamepad) applyMacroStep(runner *macroRunner, step *MacroStep) {
+	if len(step.Release) > 0 {
+		if err := g.backendIf.Release(step.Release); err != nil {
+			log.Printf("can not release buttons in macro (%v): %v", runner.macro.Name, err)
+		}
+		for _, button := range step.Release {
+			delete(runner.pressed, button)
+		}
+	}
+	if len(step.Press) > 0 {
+		if err := g.backendIf.Press(step.Press); err != nil {
+			log.Printf("can not press buttons in macro (%v): %v", runner.macro.Name, err)
+		}
+		for _, button := range step.Press {
+			runner.pressed[button] = true
+		}
+	}
+	if step.StickL != nil {
+		if err := g.backendIf.StickL(step.StickL.X, step.StickL.Y); err != nil {
+			log.Printf("can not move left stick in macro (%v): %v", runner.macro.Name, err)
+		}
+		runner.stickLMoved = true
+	}
+	if step.StickR != nil {
+		if err := g.backendIf.StickR(step.StickR.X, step.StickR.Y); err != nil {
+			log.Printf("can not move right stick in macro (%v): %v", runner.macro.Name, err)
+		}
+		runner.stickRMoved = true
+	}
+}
+
+// called before each input report, so a step shows up in Frames reports at least
+func (g *Gamepad) onMacroFrame(frame uint64) {
+	g.macroMutex.Lock()
+	defer g.macroMutex.Unlock()
+	runner := g.macroRunner
+	if runner == nil {
+		return
+	}
+	if runner.remainingFrames == 0 {
+		if runner.step >= len(runner.macro.Steps) {
+			if g.verbose {
+				log.Printf("finish macro: %v", runner.macro.Name)
+			}
+			g.cleanupMacro(true)
+			return
+		}
+		step := runner.macro.Steps[runner.step]
+		g.applyMacroStep(runner, step)
+		runner.step += 1
+		runner.remainingFrames = step.Frames
+		if runner.remainingFrames < 1 {
+			runner.remainingFrames = 1
+		}
+	}
+	runner.remainingFrames -= 1
+}
+
+// run macro by name. the running macro is cancelled.
+// while a macro is running, other inputs are ignored and the latest state is applied after it.
+func (g *Gamepad) RunMacro(name string) error {
+	macro, err := g.findMacro(name)
+	if err != nil {
+		return err
+	}
+	g.macroMutex.Lock()
+	defer g.macroMutex.Unlock()
+	g.cleanupMacro(false)
+	if g.verbose {
+		log.Printf("start macro: %v", name)
+	}
+	g.macroRunner = &macroRunner{
+		macro: macro,
+		step: 0,
+		remainingFrames: 0,
+		pressed: make(map[ButtonName]bool),
+		stickLMoved: false,
+		stickRMoved: false,
+	}
+	g.backendIf.AddFrameHook(macroFrameHookName, g.onMacroFrame)
+	return nil
+}
+
+func (g *Gamepad) CancelMacro() {
+	g.macroMutex.Lock()
+	defer g.macroMutex.Unlock()
+	if g.macroRunner != nil && g.verbose {
+		log.Printf("cancel macro: %v", g.macroRunner.macro.Name)
+	}
+	g.cleanupMacro(true)
+}
+
+func (g *Gamepad) isMacroRunning() bool {
+	g.macroMutex.Lock()
+	defer g.macroMutex.Unlock()
+	return g.macroRunner != nil
+}
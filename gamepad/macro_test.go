@@ -0,0 +1,125 @@
+package gamepad
+
+import (
+	"reflect"
+	"testing"
+	"github.com/potix/regapweb/message"
+)
+
+type testMacroFrame struct {
+	pressed []ButtonName
+	stickL  [2]float64
+	running bool
+}
+
+func TestMacroFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []*MacroStep
+		frames []testMacroFrame
+	}{
+		{
+			name: "press and release",
+			steps: []*MacroStep{
+				&MacroStep{ Press: []ButtonName{ ButtonA }, Frames: 2 },
+				&MacroStep{ Release: []ButtonName{ ButtonA }, Frames: 1 },
+			},
+			frames: []testMacroFrame{
+				{ pressed: []ButtonName{ ButtonA }, running: true },
+				{ pressed: []ButtonName{ ButtonA }, running: true },
+				{ pressed: []ButtonName{}, running: true },
+				{ pressed: []ButtonName{}, running: false },
+			},
+		},
+		{
+			name: "zero frames is one frame",
+			steps: []*MacroStep{
+				&MacroStep{ Press: []ButtonName{ ButtonB }, Frames: 0 },
+				&MacroStep{ Press: []ButtonName{ ButtonX }, Frames: 1 },
+			},
+			frames: []testMacroFrame{
+				{ pressed: []ButtonName{ ButtonB }, running: true },
+				{ pressed: []ButtonName{ ButtonB, ButtonX }, running: true },
+				{ pressed: []ButtonName{}, running: false },
+			},
+		},
+		{
+			name: "stick is reset at the end",
+			steps: []*MacroStep{
+				&MacroStep{ StickL: &MacroStick{ X: 1, Y: -1 }, Frames: 1 },
+				&MacroStep{ Frames: 1 },
+			},
+			frames: []testMacroFrame{
+				{ pressed: []ButtonName{}, stickL: [2]float64{ 1, -1 }, running: true },
+				{ pressed: []ButtonName{}, stickL: [2]float64{ 1, -1 }, running: true },
+				{ pressed: []ButtonName{}, running: false },
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, backend := newTestGamepad(t, GamepadMacros([]*Macro{ &Macro{ Name: "m", Steps: tt.steps } }))
+			if err := g.RunMacro("m"); err != nil {
+				t.Fatalf("can not run macro: %v", err)
+			}
+			for i, frame := range tt.frames {
+				backend.RunFrameHooks()
+				if pressed := backend.pressedButtons(); !reflect.DeepEqual(pressed, frame.pressed) {
+					t.Errorf("frame %v: pressed = %v, want %v", i, pressed, frame.pressed)
+				}
+				if backend.stickL != frame.stickL {
+					t.Errorf("frame %v: left stick = %v, want %v", i, backend.stickL, frame.stickL)
+				}
+				if running := g.isMacroRunning(); running != frame.running {
+					t.Errorf("frame %v: running = %v, want %v", i, running, frame.running)
+				}
+			}
+			if count := backend.frameHookCount(); count != 0 {
+				t.Errorf("frame hooks = %v after macro", count)
+			}
+		})
+	}
+}
+
+func TestMacroPendingState(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+	}{
+		{ name: "finish", cancel: false },
+		{ name: "cancel", cancel: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := []*MacroStep{ &MacroStep{ Press: []ButtonName{ ButtonA }, Frames: 2 } }
+			g, backend := newTestGamepad(t, GamepadMacros([]*Macro{ &Macro{ Name: "m", Steps: steps } }))
+			if err := g.RunMacro("m"); err != nil {
+				t.Fatalf("can not run macro: %v", err)
+			}
+			backend.RunFrameHooks()
+			state := &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ &message.GamepadButtonState{}, &message.GamepadButtonState{}, &message.GamepadButtonState{ Pressed: true } },
+				Axes: []float64{},
+			}
+			if err := g.UpdateState(state); err != nil {
+				t.Fatalf("can not update state: %v", err)
+			}
+			if backend.state != nil {
+				t.Fatalf("state is applied while the macro is running")
+			}
+			if tt.cancel {
+				g.CancelMacro()
+			} else {
+				for g.isMacroRunning() {
+					backend.RunFrameHooks()
+				}
+			}
+			if backend.state == nil {
+				t.Fatalf("state is not applied after the macro")
+			}
+			if pressed := backend.pressedButtons(); !reflect.DeepEqual(pressed, []ButtonName{ ButtonY }) {
+				t.Errorf("pressed = %v, want %v", pressed, []ButtonName{ ButtonY })
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package gamepad
+
+// GamepadMotion is 6-axis motion sample of the remote controller.
+// accelerometer is G, gyroscope is degree per second.
+type GamepadMotion struct {
+	AccelX float64
+	AccelY float64
+	AccelZ float64
+	GyroX  float64
+	GyroY  float64
+	GyroZ  float64
+}
+
+type MotionBackendIf interface {
+	UpdateMotion(*GamepadMotion) error
+}
+
+func (m *GamepadMotion) interpolate(next *GamepadMotion, ratio float64) *GamepadMotion {
+	return &GamepadMotion{
+		AccelX: m.AccelX + (next.AccelX-m.AccelX)*ratio,
+		AccelY: m.AccelY + (next.AccelY-m.AccelY)*ratio,
+		AccelZ: m.AccelZ + (next.AccelZ-m.AccelZ)*ratio,
+		GyroX:  m.GyroX + (next.GyroX-m.GyroX)*ratio,
+		GyroY:  m.GyroY + (next.GyroY-m.GyroY)*ratio,
+		GyroZ:  m.GyroZ + (next.GyroZ-m.GyroZ)*ratio,
+	}
+}
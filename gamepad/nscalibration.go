@@ -0,0 +1,113 @@
+package gamepad
+
+//
+// stick calibration of nintendo switch controllers
+//
+
+import (
+	"math"
+)
+
+// spi flash address of factory stick calibration
+const (
+	spiAddrLeftStickCalibration  uint32 = 0x603d
+	spiAddrRightStickCalibration uint32 = 0x6046
+	stickCalibrationSize         int    = 9
+)
+
+// 12 bit raw values
+type stickCalibration struct {
+	xCenter uint16
+	yCenter uint16
+	xMin    uint16 /* below center */
+	yMin    uint16 /* below center */
+	xMax    uint16 /* above center */
+	yMax    uint16 /* above center */
+}
+
+func defaultStickCalibration() *stickCalibration {
+	return &stickCalibration{
+		xCenter: 2048,
+		yCenter: 2048,
+		xMin: 2047,
+		yMin: 2047,
+		xMax: 2047,
+		yMax: 2047,
+	}
+}
+
+func decodeStickCalibrationPair(data []byte) (uint16, uint16) {
+	x := uint16(data[1]) << 8 & 0xf00 | uint16(data[0])
+	y := uint16(data[2]) << 4 | uint16(data[1]) >> 4
+	return x, y
+}
+
+func isErasedSpiData(data []byte) bool {
+	for _, b := range data {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// left: max above center, center, min below center
+func decodeLeftStickCalibration(data []byte) *stickCalibration {
+	if len(data) < stickCalibrationSize || isErasedSpiData(data) {
+		return defaultStickCalibration()
+	}
+	c := &stickCalibration{}
+	c.xMax, c.yMax = decodeStickCalibrationPair(data[0:3])
+	c.xCenter, c.yCenter = decodeStickCalibrationPair(data[3:6])
+	c.xMin, c.yMin = decodeStickCalibrationPair(data[6:9])
+	return c
+}
+
+// right: center, min below center, max above center
+func decodeRightStickCalibration(data []byte) *stickCalibration {
+	if len(data) < stickCalibrationSize || isErasedSpiData(data) {
+		return defaultStickCalibration()
+	}
+	c := &stickCalibration{}
+	c.xCenter, c.yCenter = decodeStickCalibrationPair(data[0:3])
+	c.xMin, c.yMin = decodeStickCalibrationPair(data[3:6])
+	c.xMax, c.yMax = decodeStickCalibrationPair(data[6:9])
+	return c
+}
+
+func (c *stickCalibration) encodeAxis(v float64, center uint16, min uint16, max uint16) uint16 {
+	v = clampAxis(v)
+	raw := float64(center)
+	if v >= 0 {
+		raw += v * float64(max)
+	} else {
+		raw += v * float64(min)
+	}
+	return uint16(math.Max(0, math.Min(4095, math.Round(raw))))
+}
+
+func (c *stickCalibration) encode(x float64, y float64) (uint16, uint16) {
+	return c.encodeAxis(x, c.xCenter, c.xMin, c.xMax), c.encodeAxis(y, c.yCenter, c.yMin, c.yMax)
+}
+
+func encodeStickCalibrationPair(data []byte, x uint16, y uint16) {
+	data[0] = byte(x & 0xff)
+	data[1] = byte(x >> 8 & 0x0f) | byte(y & 0x0f) << 4
+	data[2] = byte(y >> 4)
+}
+
+func (c *stickCalibration) encodeLeft() []byte {
+	data := make([]byte, stickCalibrationSize)
+	encodeStickCalibrationPair(data[0:3], c.xMax, c.yMax)
+	encodeStickCalibrationPair(data[3:6], c.xCenter, c.yCenter)
+	encodeStickCalibrationPair(data[6:9], c.xMin, c.yMin)
+	return data
+}
+
+func (c *stickCalibration) encodeRight() []byte {
+	data := make([]byte, stickCalibrationSize)
+	encodeStickCalibrationPair(data[0:3], c.xCenter, c.yCenter)
+	encodeStickCalibrationPair(data[3:6], c.xMin, c.yMin)
+	encodeStickCalibrationPair(data[6:9], c.xMax, c.yMax)
+	return data
+}
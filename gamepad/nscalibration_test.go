@@ -0,0 +1,108 @@
+package gamepad
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStickCalibrationPair(t *testing.T) {
+	tests := []struct {
+		name string
+		x    uint16
+		y    uint16
+		data []byte
+	}{
+		{ name: "zero", x: 0x000, y: 0x000, data: []byte{ 0x00, 0x00, 0x00 } },
+		{ name: "center and range", x: 0x800, y: 0x600, data: []byte{ 0x00, 0x08, 0x60 } },
+		{ name: "max", x: 0xfff, y: 0xfff, data: []byte{ 0xff, 0xff, 0xff } },
+		{ name: "mixed", x: 0x123, y: 0xabc, data: []byte{ 0x23, 0xc1, 0xab } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, 3)
+			encodeStickCalibrationPair(data, tt.x, tt.y)
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("encodeStickCalibrationPair(%03x, %03x) = %x, want %x", tt.x, tt.y, data, tt.data)
+			}
+			x, y := decodeStickCalibrationPair(tt.data)
+			if x != tt.x || y != tt.y {
+				t.Errorf("decodeStickCalibrationPair(%x) = %03x, %03x, want %03x, %03x", tt.data, x, y, tt.x, tt.y)
+			}
+		})
+	}
+}
+
+func TestStickCalibrationRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		calibration *stickCalibration
+	}{
+		{ name: "default", calibration: defaultStickCalibration() },
+		{ name: "generated", calibration: generatedStickCalibration() },
+		{ name: "asymmetric", calibration: &stickCalibration{
+			xCenter: 0x7f0,
+			yCenter: 0x812,
+			xMin: 0x5a1,
+			yMin: 0x603,
+			xMax: 0x6b4,
+			yMax: 0x5c5,
+		} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left := decodeLeftStickCalibration(tt.calibration.encodeLeft())
+			if *left != *tt.calibration {
+				t.Errorf("left = %+v, want %+v", left, tt.calibration)
+			}
+			right := decodeRightStickCalibration(tt.calibration.encodeRight())
+			if *right != *tt.calibration {
+				t.Errorf("right = %+v, want %+v", right, tt.calibration)
+			}
+		})
+	}
+}
+
+func TestDecodeErasedStickCalibration(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{ name: "erased", data: bytes.Repeat([]byte{ 0xff }, stickCalibrationSize) },
+		{ name: "short", data: []byte{ 0x00, 0x08, 0x60 } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c := decodeLeftStickCalibration(tt.data); *c != *defaultStickCalibration() {
+				t.Errorf("left = %+v, want default", c)
+			}
+			if c := decodeRightStickCalibration(tt.data); *c != *defaultStickCalibration() {
+				t.Errorf("right = %+v, want default", c)
+			}
+		})
+	}
+}
+
+func TestStickCalibrationEncode(t *testing.T) {
+	tests := []struct {
+		name        string
+		calibration *stickCalibration
+		x           float64
+		y           float64
+		wantX       uint16
+		wantY       uint16
+	}{
+		{ name: "default center", calibration: defaultStickCalibration(), x: 0, y: 0, wantX: 2048, wantY: 2048 },
+		{ name: "default full tilt", calibration: defaultStickCalibration(), x: 1, y: -1, wantX: 4095, wantY: 1 },
+		{ name: "default over range", calibration: defaultStickCalibration(), x: 2, y: -2, wantX: 4095, wantY: 1 },
+		{ name: "generated full tilt", calibration: generatedStickCalibration(), x: -1, y: 1, wantX: 0x200, wantY: 0xe00 },
+		{ name: "generated half tilt", calibration: generatedStickCalibration(), x: 0.5, y: -0.5, wantX: 0xb00, wantY: 0x500 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := tt.calibration.encode(tt.x, tt.y)
+			if x != tt.wantX || y != tt.wantY {
+				t.Errorf("encode(%v, %v) = %03x, %03x, want %03x, %03x", tt.x, tt.y, x, y, tt.wantX, tt.wantY)
+			}
+		})
+	}
+}
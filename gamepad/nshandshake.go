@@ -0,0 +1,197 @@
+package gamepad
+
+//
+// usb handshake state machine of switch controllers
+//
+// switch:         0x80 01 (mac) -> 0x80 02 (handshake) -> 0x80 03 (baud rate) -> 0x80 02 -> 0x80 04 (disable usb timeout)
+// steam, sdl:     0x80 02 -> 0x80 03 -> 0x80 02 -> 0x80 04, or subcommands without 0x80
+// linux (hid-nintendo): 0x80 01 -> 0x80 02 -> 0x80 03 -> 0x80 02 -> 0x80 04
+//
+// 0x80 commands are accepted in any state, so out of order hosts start over from the command.
+// input reports are written in the streaming states (disable usb timeout, subcommand).
+// if the host does not finish the handshake in time, the usb status (0x81 01) is written again,
+// and after the retries input reports are written anyway.
+//
+
+import (
+	"log"
+	"time"
+)
+
+type comEvent int
+
+const (
+	comEventRequestMac comEvent = iota
+	comEventHandshake
+	comEventBaudRate
+	comEventDisableUsbTimeout
+	comEventEnableUsbTimeout
+	comEventSubCommand
+	comEventTimeout
+	comEventGiveUp
+	comEventReset
+)
+
+const (
+	comStateTimeout    time.Duration = 2 * time.Second
+	comStateMaxRetries int           = 3
+)
+
+// usb status (0x81 01), the host starts the handshake
+var usbStatusReport []byte = []byte{ 0x01, 0x00, 0x03 }
+
+var comStateNames map[comState]string = map[comState]string{
+	comStateInit: "init",
+	comStateEnableUsbTimeout: "enableUsbTimeout",
+	comStateMac: "mac",
+	comStateHandshake: "handshake",
+	comStateBaudRate: "baudRate",
+	comStateHandshake2: "handshake2",
+	comStateDisableUsbTimeout: "disableUsbTimeout",
+	comStateSubCommand: "subCommand",
+}
+
+var comEventNames map[comEvent]string = map[comEvent]string{
+	comEventRequestMac: "requestMac",
+	comEventHandshake: "handshake",
+	comEventBaudRate: "baudRate",
+	comEventDisableUsbTimeout: "disableUsbTimeout",
+	comEventEnableUsbTimeout: "enableUsbTimeout",
+	comEventSubCommand: "subCommand",
+	comEventTimeout: "timeout",
+	comEventGiveUp: "giveUp",
+	comEventReset: "reset",
+}
+
+// GamepadHandshake is a transition of the usb handshake of switch controllers
+type GamepadHandshake struct {
+	Event     string
+	From      string
+	To        string
+	Retry     int
+	Streaming bool
+}
+
+func (c comState) String() string {
+	name, ok := comStateNames[c]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+func (c comEvent) String() string {
+	name, ok := comEventNames[c]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+func (c comState) streaming() bool {
+	return c == comStateDisableUsbTimeout || c == comStateSubCommand
+}
+
+// waiting for the next command of the handshake
+func (c comState) waiting() bool {
+	switch c {
+	case comStateInit, comStateMac, comStateHandshake, comStateBaudRate, comStateHandshake2:
+		return true
+	default:
+		return false
+	}
+}
+
+func nextComState(state comState, event comEvent) comState {
+	switch event {
+	case comEventRequestMac:
+		return comStateMac
+	case comEventHandshake:
+		if state == comStateBaudRate {
+			return comStateHandshake2
+		}
+		return comStateHandshake
+	case comEventBaudRate:
+		return comStateBaudRate
+	case comEventDisableUsbTimeout:
+		return comStateDisableUsbTimeout
+	case comEventEnableUsbTimeout:
+		return comStateEnableUsbTimeout
+	case comEventSubCommand:
+		if state.streaming() {
+			return state
+		}
+		// the host talks subcommands without the usb handshake
+		return comStateSubCommand
+	case comEventTimeout:
+		return comStateInit
+	case comEventGiveUp:
+		return comStateSubCommand
+	case comEventReset:
+		return comStateInit
+	default:
+		return state
+	}
+}
+
+// caller must hold the mutex, returns event to send after unlock
+func (n *NSProCon) transitComState(event comEvent) *GamepadHandshake {
+	from := n.comState
+	to := nextComState(from, event)
+	n.comStateTime = time.Now()
+	switch event {
+	case comEventTimeout:
+		n.comRetry += 1
+	case comEventDisableUsbTimeout:
+		n.usbTimeout = false
+	case comEventEnableUsbTimeout:
+		n.usbTimeout = true
+	case comEventReset:
+		n.comRetry = 0
+		n.usbTimeout = true
+	}
+	if to.streaming() {
+		n.comRetry = 0
+	}
+	if from == to && event == comEventSubCommand {
+		return nil
+	}
+	n.comState = to
+	if n.verbose {
+		log.Printf("com state: %v -> %v (%v, retry = %v)", from, to, event, n.comRetry)
+	}
+	return &GamepadHandshake{
+		Event: event.String(),
+		From: from.String(),
+		To: to.String(),
+		Retry: n.comRetry,
+		Streaming: to.streaming(),
+	}
+}
+
+func (n *NSProCon) handleComEvent(event comEvent) {
+	n.mutex.Lock()
+	handshake := n.transitComState(event)
+	n.mutex.Unlock()
+	if handshake != nil {
+		n.SendHandshake(handshake)
+	}
+}
+
+// called by the writer, returns true if the usb status should be written again
+func (n *NSProCon) checkComStateTimeout() bool {
+	n.mutex.Lock()
+	if !n.comState.waiting() || time.Since(n.comStateTime) < comStateTimeout {
+		n.mutex.Unlock()
+		return false
+	}
+	event := comEventTimeout
+	if n.comRetry >= comStateMaxRetries {
+		log.Printf("give up usb handshake in state %v, start input reports", n.comState)
+		event = comEventGiveUp
+	}
+	handshake := n.transitComState(event)
+	n.mutex.Unlock()
+	n.SendHandshake(handshake)
+	return event == comEventTimeout
+}
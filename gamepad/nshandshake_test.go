@@ -0,0 +1,74 @@
+package gamepad
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextComState(t *testing.T) {
+	tests := []struct {
+		state comState
+		event comEvent
+		next  comState
+	}{
+		{ state: comStateInit, event: comEventRequestMac, next: comStateMac },
+		{ state: comStateMac, event: comEventHandshake, next: comStateHandshake },
+		{ state: comStateHandshake, event: comEventBaudRate, next: comStateBaudRate },
+		{ state: comStateBaudRate, event: comEventHandshake, next: comStateHandshake2 },
+		{ state: comStateHandshake2, event: comEventDisableUsbTimeout, next: comStateDisableUsbTimeout },
+		{ state: comStateInit, event: comEventHandshake, next: comStateHandshake },
+		{ state: comStateDisableUsbTimeout, event: comEventRequestMac, next: comStateMac },
+		{ state: comStateDisableUsbTimeout, event: comEventEnableUsbTimeout, next: comStateEnableUsbTimeout },
+		{ state: comStateInit, event: comEventSubCommand, next: comStateSubCommand },
+		{ state: comStateHandshake, event: comEventSubCommand, next: comStateSubCommand },
+		{ state: comStateDisableUsbTimeout, event: comEventSubCommand, next: comStateDisableUsbTimeout },
+		{ state: comStateSubCommand, event: comEventSubCommand, next: comStateSubCommand },
+		{ state: comStateHandshake, event: comEventTimeout, next: comStateInit },
+		{ state: comStateBaudRate, event: comEventGiveUp, next: comStateSubCommand },
+		{ state: comStateSubCommand, event: comEventReset, next: comStateInit },
+		{ state: comStateMac, event: comEvent(-1), next: comStateMac },
+	}
+	for _, tt := range tests {
+		t.Run(tt.state.String() + "/" + tt.event.String(), func(t *testing.T) {
+			if next := nextComState(tt.state, tt.event); next != tt.next {
+				t.Errorf("nextComState(%v, %v) = %v, want %v", tt.state, tt.event, next, tt.next)
+			}
+		})
+	}
+}
+
+func TestSendHandshakeSlowListener(t *testing.T) {
+	b := &BaseBackend{}
+	blockCh := make(chan int)
+	receivedCh := make(chan *GamepadHandshake, listenerQueueSize * 2)
+	b.StartHandshakeListener(func(h *GamepadHandshake) {
+		<-blockCh
+		receivedCh <- h
+	})
+	defer b.StopHandshakeListener()
+	doneCh := make(chan int)
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < listenerQueueSize * 2; i++ {
+			b.SendHandshake(&GamepadHandshake{ Retry: i })
+		}
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendHandshake is blocked by the listener")
+	}
+	close(blockCh)
+	// the newest event is kept
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case h := <-receivedCh:
+			if h.Retry == listenerQueueSize * 2 - 1 {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the newest event is not received")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package gamepad
+
+//
+// identity of switch controllers (colors, serial, firmware version, battery)
+//
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	spiAddrColorInfo      uint32 = 0x601b
+	spiAddrBodyColor             = 0x6050
+	spiAddrButtonColor           = 0x6053
+	spiAddrLeftGripColor         = 0x6056
+	spiAddrRightGripColor        = 0x6059
+)
+
+const (
+	colorInfoBodyButton byte = 0x01
+	colorInfoWithGrip        = 0x02
+)
+
+// nil or "" keeps the default.
+// colors are rgb (3 bytes), FirmwareVersion is major and minor (2 bytes).
+type NSIdentity struct {
+	BodyColor       []byte
+	ButtonColor     []byte
+	LeftGripColor   []byte
+	RightGripColor  []byte
+	Serial          string
+	FirmwareVersion []byte
+	Battery         *GamepadBattery
+}
+
+// Level is 0 (empty) to 4 (full)
+type GamepadBattery struct {
+	Level    int
+	Charging bool
+}
+
+type IdentityBackendIf interface {
+	// before Setup
+	SetIdentity(*NSIdentity) error
+	SetBattery(*GamepadBattery) error
+}
+
+func checkColor(name string, color []byte) error {
+	if color != nil && len(color) != 3 {
+		return fmt.Errorf("invalid %v color: %x", name, color)
+	}
+	return nil
+}
+
+// battery nibble of input reports, level (0, 2, 4, 6, 8) | charging
+func (b *GamepadBattery) nibble() (byte, error) {
+	if b.Level < 0 || b.Level > 4 {
+		return 0, fmt.Errorf("invalid battery level: %v", b.Level)
+	}
+	nibble := byte(b.Level * 2)
+	if b.Charging {
+		nibble |= 0x01
+	}
+	return nibble, nil
+}
+
+func (n *NSProCon) SetIdentity(identity *NSIdentity) error {
+	if identity == nil {
+		return nil
+	}
+	colors := []struct {
+		name  string
+		addr  uint32
+		color []byte
+	}{
+		{ "body", spiAddrBodyColor, identity.BodyColor },
+		{ "button", spiAddrButtonColor, identity.ButtonColor },
+		{ "left grip", spiAddrLeftGripColor, identity.LeftGripColor },
+		{ "right grip", spiAddrRightGripColor, identity.RightGripColor },
+	}
+	for _, c := range colors {
+		if err := checkColor(c.name, c.color); err != nil {
+			return err
+		}
+	}
+	if identity.FirmwareVersion != nil && len(identity.FirmwareVersion) != 2 {
+		return fmt.Errorf("invalid firmware version: %x", identity.FirmwareVersion)
+	}
+	var serial []byte
+	if identity.Serial != "" {
+		encodedSerial, err := encodeSpiSerial(identity.Serial)
+		if err != nil {
+			return err
+		}
+		serial = encodedSerial
+	}
+	// identity is applied to the in-memory image only, the factory area is
+	// overwritten on every load and must not leak into the spi flash file.
+	for _, c := range colors {
+		if c.color == nil {
+			continue
+		}
+		if err := n.spiFlash.patch(c.addr, c.color); err != nil {
+			return fmt.Errorf("can not write %v color: %w", c.name, err)
+		}
+	}
+	if serial != nil {
+		if err := n.spiFlash.patch(spiAddrSerial, serial); err != nil {
+			return fmt.Errorf("can not write serial: %w", err)
+		}
+	}
+	if identity.LeftGripColor != nil || identity.RightGripColor != nil {
+		if err := n.spiFlash.patch(spiAddrColorInfo, []byte{ colorInfoWithGrip }); err != nil {
+			return fmt.Errorf("can not write color info: %w", err)
+		}
+	} else if identity.BodyColor != nil || identity.ButtonColor != nil {
+		colorInfo, err := n.spiFlash.read(spiAddrColorInfo, 1)
+		if err != nil {
+			return fmt.Errorf("can not read color info: %w", err)
+		}
+		if colorInfo[0] != colorInfoWithGrip {
+			if err := n.spiFlash.patch(spiAddrColorInfo, []byte{ colorInfoBodyButton }); err != nil {
+				return fmt.Errorf("can not write color info: %w", err)
+			}
+		}
+	}
+	n.mutex.Lock()
+	if identity.Serial != "" {
+		n.setupParams.ISerial = identity.Serial
+	}
+	if identity.FirmwareVersion != nil {
+		n.firmwareVersion = identity.FirmwareVersion
+	}
+	n.mutex.Unlock()
+	if identity.Battery != nil {
+		if err := n.SetBattery(identity.Battery); err != nil {
+			return err
+		}
+	}
+	if n.verbose {
+		log.Printf("set identity: %+v", identity)
+	}
+	return nil
+}
+
+func (n *NSProCon) SetBattery(battery *GamepadBattery) error {
+	nibble, err := battery.nibble()
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.battery = nibble
+	return nil
+}
@@ -0,0 +1,68 @@
+package gamepad
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetIdentitySpiImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity *NSIdentity
+		addr     uint32
+		want     []byte
+		err      bool
+	}{
+		{
+			name: "serial",
+			identity: &NSIdentity{ Serial: "XCW12345678901" },
+			addr: spiAddrSerial,
+			want: append([]byte("XCW12345678901"), 0x00, 0x00),
+		},
+		{
+			name: "too long serial",
+			identity: &NSIdentity{ Serial: "XCW12345678901234" },
+			err: true,
+		},
+		{
+			name: "body color",
+			identity: &NSIdentity{ BodyColor: []byte{ 0x11, 0x22, 0x33 } },
+			addr: spiAddrBodyColor,
+			want: []byte{ 0x11, 0x22, 0x33 },
+		},
+		{
+			name: "grip color",
+			identity: &NSIdentity{ LeftGripColor: []byte{ 0x44, 0x55, 0x66 } },
+			addr: spiAddrColorInfo,
+			want: []byte{ colorInfoWithGrip },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spiFlashFile := filepath.Join(t.TempDir(), "spiflash.bin")
+			n, err := NewNSProCon(false, "", "", "", spiFlashFile, "", "", "")
+			if err != nil {
+				t.Fatalf("can not create nsprocon: %v", err)
+			}
+			err = n.SetIdentity(tt.identity)
+			if tt.err != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			data, err := n.spiFlash.read(tt.addr, len(tt.want))
+			if err != nil {
+				t.Fatalf("can not read spi flash: %v", err)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Errorf("read(%x) = %x, want %x", tt.addr, data, tt.want)
+			}
+			if _, err := os.Stat(spiFlashFile); !os.IsNotExist(err) {
+				t.Errorf("identity is saved to spi flash file: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package gamepad
+
+//
+// NFC/IR MCU of nintendo switch controllers (NFC only)
+//
+
+import(
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	amiiboSize int = 540
+)
+
+// MCU modes (subcommand 0x21 0x21 / report 0x31 status)
+const (
+	mcuModeSuspend byte = 0x00
+	mcuModeStandby      = 0x01
+	mcuModeNfc          = 0x04
+	mcuModeIr           = 0x05
+)
+
+// MCU commands in output report 0x11
+const (
+	mcuCommandRequestStatus byte = 0x01
+	mcuCommandNfc                = 0x02
+)
+
+// NFC commands in output report 0x11
+const (
+	nfcCommandStartDiscovery byte = 0x01
+	nfcCommandStopPolling         = 0x02
+	nfcCommandStartPolling        = 0x04
+	nfcCommandReadNtag            = 0x06
+	nfcCommandWriteNtag           = 0x08
+)
+
+// NFC states in MCU NFC status
+const (
+	nfcStateNone        byte = 0x00
+	nfcStatePolling          = 0x01
+	nfcStateTagDetected      = 0x09
+)
+
+// MCU packet types of report 0x31
+const (
+	mcuPacketTypeStatus   byte = 0x01
+	mcuPacketTypeNfcState      = 0x2a
+	mcuPacketTypeNfcRead       = 0x3a
+	mcuPacketTypeEmpty         = 0xff
+)
+
+const (
+	mcuPacketSize       int = 313
+	mcuConfigReplySize  int = 34
+)
+
+type NfcBackendIf interface {
+	LoadAmiibo([]byte) error
+	RemoveAmiibo() error
+}
+
+// nfc needs input report 0x31, which is not in the report descriptor of a real pro controller
+type McuReportBackendIf interface {
+	// before Setup
+	SetMcuReport(bool)
+}
+
+// from dump (firmware version 3.5)
+var mcuStatusHeader []byte = []byte{ 0x00, 0xff, 0x00, 0x03, 0x00, 0x05 }
+
+// from dump, ntag215 read response between uid and tag data
+var ntagReadHeader []byte = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x7d, 0xfd, 0xf0, 0x79, 0x36, 0x51, 0xab, 0xd7, 0x46, 0x6e, 0x39,
+	0xc1, 0x91, 0xba, 0xbe, 0xb8, 0x56, 0xce, 0xed, 0xf1, 0xce, 0x44, 0xcc, 0x75, 0xea, 0xfb,
+	0x27, 0x09, 0x4d, 0x08, 0x7a, 0xe8, 0x03, 0x00, 0x3b, 0x3c, 0x77, 0x78, 0x86, 0x00, 0x00,
+}
+
+type nsMcu struct {
+	verbose        bool
+	mode           byte
+	nfcState       byte
+	amiibo         []byte
+	pendingPackets [][]byte
+	mutex          sync.Mutex
+}
+
+func mcuCrc8(data []byte) byte {
+	crc := byte(0)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc & 0x80 != 0 {
+				crc = crc << 1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// zero padded packet with crc8 at the end
+func (m *nsMcu) buildPacket(size int, dataList ...[]byte) []byte {
+	packet := make([]byte, size)
+	offset := 0
+	for _, data := range dataList {
+		offset += copy(packet[offset:size - 1], data)
+	}
+	packet[size - 1] = mcuCrc8(packet[:size - 1])
+	return packet
+}
+
+func (m *nsMcu) buildStatusPacket(size int) []byte {
+	return m.buildPacket(size, []byte{ mcuPacketTypeStatus }, mcuStatusHeader, []byte{ m.mode })
+}
+
+func (m *nsMcu) amiiboUid() []byte {
+	// uid0-2 (page 0), uid3-6 (page 1), page 0 byte 3 is bcc0
+	uid := make([]byte, 0, 7)
+	uid = append(uid, m.amiibo[0:3]...)
+	uid = append(uid, m.amiibo[4:8]...)
+	return uid
+}
+
+func (m *nsMcu) buildNfcStatePacket() []byte {
+	nfcState := m.nfcState
+	if nfcState == nfcStatePolling && m.amiibo != nil {
+		nfcState = nfcStateTagDetected
+	}
+	packet := []byte{ mcuPacketTypeNfcState, 0x00, 0x05, 0x00 /* seq */, 0x00 /* ack seq */, 0x09, 0x31, nfcState }
+	if nfcState == nfcStateTagDetected {
+		// ntag215, uid length = 7
+		packet = append(packet, 0x00, 0x00, 0x00, 0x01, 0x01, 0x02, 0x00, 0x07)
+		packet = append(packet, m.amiiboUid()...)
+	}
+	return m.buildPacket(mcuPacketSize, packet)
+}
+
+func (m *nsMcu) buildNtagReadPackets() [][]byte {
+	first := m.buildPacket(mcuPacketSize,
+		[]byte{ mcuPacketTypeNfcRead, 0x00, 0x07, 0x01, 0x00, 0x01, 0x31, 0x02, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x07 },
+		m.amiiboUid(), ntagReadHeader, m.amiibo[:245])
+	second := m.buildPacket(mcuPacketSize,
+		[]byte{ mcuPacketTypeNfcRead, 0x00, 0x07, 0x02, 0x00, 0x09, 0x27 },
+		m.amiibo[245:])
+	return [][]byte{ first, second }
+}
+
+// subcommand 0x22
+func (m *nsMcu) setState(state byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if state == 0x00 {
+		m.mode = mcuModeSuspend
+	} else {
+		m.mode = mcuModeStandby
+	}
+	m.nfcState = nfcStateNone
+	m.pendingPackets = nil
+}
+
+// subcommand 0x21, returns reply data of subcommand
+func (m *nsMcu) configure(config []byte) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// config[0] = 0x21 (set mode), config[1] = 0x00, config[2] = mode
+	if len(config) >= 3 && config[0] == 0x21 {
+		switch config[2] {
+		case mcuModeStandby, mcuModeNfc:
+			m.mode = config[2]
+		default:
+			log.Printf("unsupported mcu mode: %x", config[2])
+			m.mode = mcuModeStandby
+		}
+		m.nfcState = nfcStateNone
+		m.pendingPackets = nil
+	}
+	return m.buildStatusPacket(mcuConfigReplySize)
+}
+
+// output report 0x11
+func (m *nsMcu) handleRequest(request []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(request) < 2 {
+		return
+	}
+	switch request[0] {
+	case mcuCommandRequestStatus:
+		m.pendingPackets = append(m.pendingPackets, m.buildStatusPacket(mcuPacketSize))
+	case mcuCommandNfc:
+		switch request[1] {
+		case nfcCommandStartDiscovery, nfcCommandStartPolling:
+			m.nfcState = nfcStatePolling
+		case nfcCommandStopPolling:
+			m.nfcState = nfcStateNone
+		case nfcCommandReadNtag:
+			if m.amiibo == nil {
+				log.Printf("can not read ntag because no amiibo")
+				return
+			}
+			m.pendingPackets = append(m.pendingPackets, m.buildNtagReadPackets()...)
+		case nfcCommandWriteNtag:
+			log.Printf("unsupported ntag write")
+		default:
+			if m.verbose {
+				log.Printf("unsupported nfc command (%x): %x", request[1], request[2:])
+			}
+		}
+	default:
+		if m.verbose {
+			log.Printf("unsupported mcu command (%x): %x", request[0], request[1:])
+		}
+	}
+}
+
+// mcu data of report 0x31
+func (m *nsMcu) buildReport() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.pendingPackets) > 0 {
+		packet := m.pendingPackets[0]
+		m.pendingPackets = m.pendingPackets[1:]
+		return packet
+	}
+	if m.mode == mcuModeNfc {
+		return m.buildNfcStatePacket()
+	}
+	return m.buildPacket(mcuPacketSize, []byte{ mcuPacketTypeEmpty })
+}
+
+func (m *nsMcu) loadAmiibo(amiibo []byte) error {
+	if len(amiibo) != amiiboSize {
+		return fmt.Errorf("invalid amiibo size: %v", len(amiibo))
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.amiibo = make([]byte, amiiboSize)
+	copy(m.amiibo, amiibo)
+	return nil
+}
+
+func (m *nsMcu) removeAmiibo() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.amiibo = nil
+}
+
+func newNSMcu(verbose bool) *nsMcu {
+	return &nsMcu{
+		verbose: verbose,
+		mode: mcuModeSuspend,
+		nfcState: nfcStateNone,
+		amiibo: nil,
+		pendingPackets: nil,
+	}
+}
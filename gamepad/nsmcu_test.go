@@ -0,0 +1,26 @@
+package gamepad
+
+import (
+	"testing"
+)
+
+func TestMcuCrc8(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		crc  byte
+	}{
+		{ name: "empty", data: []byte{}, crc: 0x00 },
+		{ name: "zero", data: []byte{ 0x00 }, crc: 0x00 },
+		{ name: "one", data: []byte{ 0x01 }, crc: 0x07 },
+		{ name: "all bits", data: []byte{ 0xff }, crc: 0xf3 },
+		{ name: "check string", data: []byte("123456789"), crc: 0xf4 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if crc := mcuCrc8(tt.data); crc != tt.crc {
+				t.Errorf("mcuCrc8(%x) = %02x, want %02x", tt.data, crc, tt.crc)
+			}
+		})
+	}
+}
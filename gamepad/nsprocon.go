@@ -6,6 +6,7 @@ import(
 	"time"
 	"math"
 	"os"
+	"sync"
 	"github.com/potix/regaprelay/gamepad/setup"
 	"github.com/potix/regapweb/message"
 	"encoding/hex"
@@ -21,6 +22,7 @@ const (
 	comStateBaudRate
 	comStateHandshake2
 	comStateDisableUsbTimeout
+	comStateSubCommand
 )
 
 
@@ -28,13 +30,28 @@ const (
 const (
 	reportIdInput01    byte = 0x01
 	reportIdInput10         = 0x10
+	reportIdInput11         = 0x11
 	reportIdOutput21        = 0x21
 	reportIdOutput30        = 0x30
+	reportIdOutput31        = 0x31
 	usbReportIdInput80      = 0x80
 	usbReportIdOutput81     = 0x81
 )
 
 // Sub-types of the 0x81 input report, used for initialization.
+// dumped from a real pro controller, input report 0x31 is not declared
+const (
+	nsReportLength string = "203"
+	nsReportDesc   string = "050115000904A1018530050105091901290A150025017501950A5500650081020509190B290E150025017501950481027501950281030B01000100A1000B300001000B310001000B320001000B35000100150027FFFF0000751095048102C00B39000100150025073500463B0165147504950181020509190F2912150025017501950481027508953481030600FF852109017508953F8103858109027508953F8103850109037508953F9183851009047508953F9183858009057508953F9183858209067508953F9183C0"
+)
+
+// experimental, input report 0x31 (361 bytes) is added to nsReportDesc.
+// not verified against a hardware capture, see doc/nfc.md
+const (
+	nsMcuReportLength string = "362"
+	nsMcuReportDesc   string = "050115000904A1018530050105091901290A150025017501950A5500650081020509190B290E150025017501950481027501950281030B01000100A1000B300001000B310001000B320001000B35000100150027FFFF0000751095048102C00B39000100150025073500463B0165147504950181020509190F2912150025017501950481027508953481030600FF852109017508953F81038531090775089669018103858109027508953F8103850109037508953F9183851009047508953F9183858009057508953F9183858209067508953F9183C0"
+)
+
 const (
 	subTypeRequestMac        byte = 0x01
 	subTypeHandshake              = 0x02
@@ -60,7 +77,10 @@ const (
 	subCommandSetHciState                   = 0x06
 	subCommandSetShipmentLowPowerState      = 0x08
 	subCommandReadSpi                       = 0x10
+	subCommandWriteSpi                      = 0x11
+	subCommandEraseSpiSector                = 0x12
 	subCommandSetNfcIrMcuConfiguration      = 0x21
+	subCommandSetNfcIrMcuState              = 0x22
 	subCommandSetPlayerLights               = 0x30
 	subCommand33                            = 0x33
 	subCommandSetHomeLight                  = 0x38
@@ -69,6 +89,14 @@ const (
 	subCommandEnableVibration               = 0x48
 )
 
+// msec
+const (
+	vibrationDefaultInterval float64 = 1000.0 / 60.0
+	vibrationMaxInterval     float64 = 200.0
+)
+
+const nsDefaultReportInterval time.Duration = time.Second / 60
+
 var vibrationAmpHfaMap map[uint8]int = map[uint8]int{
     0x00: 0,   0x02: 10,   0x04: 12,
     0x06: 14,  0x08: 17,   0x0a: 20,
@@ -143,6 +171,23 @@ var vibrationAmpLfaMap map[uint16]int = map[uint16]int{
     0x8071: 981, 0x0072: 1000,
 }
 
+// sensitivity of the imu selected by subcommand 0x41
+// gyro: mdps/LSB
+var imuGyroSensitivityMap map[byte]float64 = map[byte]float64{
+	0x00: 8.75, /* +-250dps */
+	0x01: 17.5, /* +-500dps */
+	0x02: 35.0, /* +-1000dps */
+	0x03: 70.0, /* +-2000dps */
+}
+
+// accelerometer: mG/LSB
+var imuAccelerometerSensitivityMap map[byte]float64 = map[byte]float64{
+	0x00: 0.244, /* +-8G */
+	0x01: 0.122, /* +-4G */
+	0x02: 0.061, /* +-2G */
+	0x03: 0.488, /* +-16G */
+}
+
 type buttons struct {
         a            byte
         b            byte
@@ -187,28 +232,67 @@ type imuSensitivity struct {
 
 }
 
+type nsReport struct {
+	reportId    byte
+	reportBytes []byte
+}
+
 type NSProCon struct  {
 	*BaseBackend
-	setupParams     *setup.UsbGadgetHidSetupParams
-	verbose         bool
-	macAddr         []byte
-	reverseMacAddr  []byte
-	spiMemory60     []byte
-	spiMemory80     []byte
-	devFilePath     string
-	devFile         *os.File
-	comState        comState
-	usbTimeout      bool
-	reportCounter   byte
-	imuEnable       byte
-	vibrationEnable byte
-	stopCh          chan int
-	controller      *controller
-	imuSensitivity  *imuSensitivity
+	setupParams              *setup.UsbGadgetHidSetupParams
+	verbose                  bool
+	macAddr                  []byte
+	reverseMacAddr           []byte
+	spiFlash                 *spiFlash
+	devFilePath              string
+	supervisor               *supervisor
+	deviceType               byte
+	comState                 comState
+	comStateTime             time.Time
+	comRetry                 int
+	usbTimeout               bool
+	reportCounter            byte
+	reportMode               byte
+	imuEnable                byte
+	vibrationEnable          byte
+	vibrating                bool
+	lastVibrationTime        time.Time
+	vibrationInterval        float64
+	controller               *controller
+	imuSensitivity           *imuSensitivity
+	motion                   *GamepadMotion
+	prevMotion               *GamepadMotion
+	mcu                      *nsMcu
+	leftStickCalibration     *stickCalibration
+	rightStickCalibration    *stickCalibration
+	reportCh                 chan *nsReport
+	hidCapturer              *hidCapturer
+	firmwareVersion          []byte
+	battery                  byte
+	subCommandHandlers       map[byte]NSSubCommandHandler
+	mcuReport                bool
+	defaultSubCommandHandler NSSubCommandHandler
+	subCommandStats          map[byte]*NSSubCommandStat
+	subCommandMutex          sync.Mutex
+	reportInterval           time.Duration
+	eventDrivenReport        bool
+	minReportInterval        time.Duration
+	stateChangedCh           chan int
+	mutex                    sync.Mutex
 }
 
 func (n *NSProCon) writeReport(f *os.File, reportId byte, reportBytes []byte) (error) {
-	buf := make([]byte, 64)
+	bufLen := 64
+	n.mutex.Lock()
+	mcuReport := n.mcuReport
+	n.mutex.Unlock()
+	if len(reportBytes) + 1 > bufLen {
+		if !mcuReport {
+			return fmt.Errorf("too long report (%x): length = %v", reportId, len(reportBytes) + 1)
+		}
+		bufLen = len(reportBytes) + 1
+	}
+	buf := make([]byte, bufLen)
 	buf[0] = reportId
 	for i, b := range reportBytes {
 		buf[i + 1] = b
@@ -220,6 +304,7 @@ func (n *NSProCon) writeReport(f *os.File, reportId byte, reportBytes []byte) (e
 	if wl != len(buf) {
 		return fmt.Errorf("partial write report (%x) to gadget device file: write len = %v", reportId, wl)
 	}
+	n.hidCapturer.capture(HidCaptureDirectionIn, buf)
 	if n.verbose {
 		log.Printf("wrote %x", buf)
 	}
@@ -229,90 +314,107 @@ func (n *NSProCon) writeReport(f *os.File, reportId byte, reportBytes []byte) (e
 
 
 
+// frequency of the rumble data
+// encoded = round(log2(freq / 10) * 32)
+// high: encoded = (hf >> 2) + 0x60, low: encoded = lf + 0x40
+func (n *NSProCon) decodeVibrationFrequency(encoded int) float64 {
+	return math.Round(10.0 * math.Pow(2, float64(encoded) / 32.0))
+}
+
+func (n *NSProCon) decodeVibrationMotor(bytes []byte) (*GamepadVibrationMotor, error) {
+	var hf uint16 = uint16(bytes[1]&0x01)<<8 | uint16(bytes[0])
+	var hfAmp uint8 = uint8(bytes[1] & 0xfe)
+	var lf uint8 = uint8(bytes[2] & 0x7f)
+	var lfAmp uint16 = uint16(bytes[2]&0x80)<<8 | uint16(bytes[3])
+	hamp, ok := vibrationAmpHfaMap[hfAmp]
+	if !ok {
+		return nil, fmt.Errorf("not found high amplitude (%v): %+v", hfAmp, bytes)
+	}
+	lamp, ok := vibrationAmpLfaMap[lfAmp]
+	if !ok {
+		return nil, fmt.Errorf("not found low amplitude (%v): %+v", lfAmp, bytes)
+	}
+	return &GamepadVibrationMotor{
+		HighFrequency: n.decodeVibrationFrequency(int(hf >> 2) + 0x60),
+		HighAmplitude: float64(hamp) / 1000.0,
+		LowFrequency:  n.decodeVibrationFrequency(int(lf) + 0x40),
+		LowAmplitude:  float64(lamp) / 1000.0,
+	}, nil
+}
+
+func (n *NSProCon) sendVibrationStopped() {
+	if !n.vibrating {
+		return
+	}
+	n.vibrating = false
+	if n.verbose {
+		log.Printf("vibration stopped")
+	}
+	n.SendVibration(&GamepadVibration{ Stopped: true })
+}
+
 func (n *NSProCon) sendVibrationRequest(bytes []byte) error {
 	if len(bytes) < 8 {
 		return fmt.Errorf("invalid vibration data (%x)", bytes)
 	}
-	lhamp := 0
-	llamp := 0
-	rhamp := 0
-	rlamp := 0
-	leftSkip := false
-	rightSkip := false
-	ok := false
-	if bytes[0] == 0 && bytes[1] == 0 && bytes[2] == 0 && bytes[3] == 0 {
-		leftSkip = true
-	}
-	if bytes[4] == 0 && bytes[5] == 0 && bytes[6] == 0 && bytes[7] == 0 {
-		rightSkip = true
-	}
-	if !leftSkip {
-		//var lhf uint16 = uint16(bytes[1]&0x01)<<8 | uint16(bytes[0])
-		var lhfAmp uint8 = uint8(bytes[1] & 0xfe)
-		//var llf uint8 = uint8(bytes[2] & 0x7f)
-		var llfAmp uint16 = uint16(bytes[2]&0x80)<<8 | uint16(bytes[3])
-		lhamp, ok = vibrationAmpHfaMap[lhfAmp]
-		if !ok {
-			return fmt.Errorf("ont found left hight amplitude (%v): %+v", lhfAmp, bytes)
-		}
-		llamp, ok = vibrationAmpLfaMap[llfAmp]
-		if !ok {
-			return fmt.Errorf("not found left low amplitude (%v): %+v", llfAmp, bytes)
+	// rumble data comes with every output report, so the cadence of reports is the duration of the vibration
+	now := time.Now()
+	if !n.lastVibrationTime.IsZero() {
+		interval := float64(now.Sub(n.lastVibrationTime)) / float64(time.Millisecond)
+		if interval < vibrationMaxInterval {
+			n.vibrationInterval = n.vibrationInterval * 0.75 + interval * 0.25
 		}
 	}
-	if !rightSkip {
-		//var rhf uint16 = uint16(bytes[5]&0x01)<<8 | uint16(bytes[4])
-		var rhfAmp uint8 = uint8(bytes[5] & 0xfe)
-		//var rlf uint8 = uint8(bytes[6] & 0x7f)
-		var rlfAmp uint16 = uint16(bytes[6]&0x80)<<8 | uint16(bytes[7])
-		rhamp, ok = vibrationAmpHfaMap[rhfAmp]
-		if !ok {
-			return fmt.Errorf("not found right high amplitude (%v): %+v", rhfAmp, bytes)
+	n.lastVibrationTime = now
+	if n.vibrationEnable == 0 {
+		n.sendVibrationStopped()
+		return nil
+	}
+	left := &GamepadVibrationMotor{}
+	right := &GamepadVibrationMotor{}
+	var err error
+	if bytes[0] != 0 || bytes[1] != 0 || bytes[2] != 0 || bytes[3] != 0 {
+		left, err = n.decodeVibrationMotor(bytes[0:4])
+		if err != nil {
+			return fmt.Errorf("can not decode left vibration: %w", err)
 		}
-		rlamp, ok = vibrationAmpLfaMap[rlfAmp]
-		if !ok {
-			return fmt.Errorf("not found right low amplitude (%v): %+v", rlfAmp, bytes)
+	}
+	if bytes[4] != 0 || bytes[5] != 0 || bytes[6] != 0 || bytes[7] != 0 {
+		right, err = n.decodeVibrationMotor(bytes[4:8])
+		if err != nil {
+			return fmt.Errorf("can not decode right vibration: %w", err)
 		}
 	}
-	if lhamp == 0 && llamp == 0 && rhamp == 0 && rlamp == 0 {
+	if left.HighAmplitude == 0 && left.LowAmplitude == 0 && right.HighAmplitude == 0 && right.LowAmplitude == 0 {
+		n.sendVibrationStopped()
 		return nil
 	}
+	n.vibrating = true
 	if n.verbose {
-		log.Printf("lhamp = %v, llamp = %v, rhamp = %v, rlamp = %v", lhamp, llamp, rhamp, rlamp)
+		log.Printf("left = %+v, right = %+v", left, right)
 	}
-	hamp := float64(lhamp + rhamp) / 2.0 / 1000.0
-	lamp := float64(llamp + rlamp) / 2.0 / 1000.0
-	if hamp > 1 {
-		hamp = 1.0
-	}
-	if lamp > 1 {
-		lamp = 1.0
-	}
-	vibrationMessage := &message.GamepadVibration {
-		Duration:        1000,
-		StartDelay:      0,
-		StrongMagnitude: hamp,
-		WeakMagnitude:   lamp,
+	vibrationMessage := &GamepadVibration{
+		GamepadVibration: message.GamepadVibration{
+			// twice of the cadence, covers jitter until the next report
+			Duration:        math.Round(n.vibrationInterval * 2),
+			StartDelay:      0,
+			StrongMagnitude: math.Max(left.HighAmplitude, right.HighAmplitude),
+			WeakMagnitude:   math.Max(left.LowAmplitude, right.LowAmplitude),
+		},
+		Left: left,
+		Right: right,
 	}
 	n.SendVibration(vibrationMessage)
 	return nil
 }
 
-func (n *NSProCon) buildAck(subCmd byte, existsReportData bool) byte {
-	ack := byte(0x80)
-	if existsReportData {
-		ack |= subCmd
-	}
-	return ack
-}
-
-func (n *NSProCon) readReportLoop(f * os.File) {
+func (n *NSProCon) readReportLoop(f *os.File, stopCh chan int) {
 	// usb reset magic 
-	n.writeReport(f, usbReportIdOutput81, []byte{ 0x01, 0x00, 0x03 })
+	n.queueReport(stopCh, usbReportIdOutput81, usbStatusReport)
 	buf := make([]byte, 64)
 	for {
 		select {
-		case <-n.stopCh:
+		case <-stopCh:
 			return
 		default:
 		}
@@ -321,6 +423,7 @@ func (n *NSProCon) readReportLoop(f * os.File) {
 			log.Printf("can not read request report from gadget device file: %v", err)
 			return
 		}
+		n.hidCapturer.capture(HidCaptureDirectionOut, buf[:rl])
 		if n.verbose {
 			log.Printf("read %x", buf[:rl])
 		}
@@ -328,218 +431,82 @@ func (n *NSProCon) readReportLoop(f * os.File) {
 		case usbReportIdInput80:
 			switch buf[1] {
 			case subTypeRequestMac:
-				reportBytes := []byte{ buf[1], 0x00 /* padding */, usbDeviceTypeProController }
+				reportBytes := []byte{ buf[1], 0x00 /* padding */, n.deviceType }
 				reportBytes = append(reportBytes, n.macAddr...)
-				err = n.writeReport(f, usbReportIdOutput81, reportBytes)
+				err = n.queueReport(stopCh, usbReportIdOutput81, reportBytes)
 				if err != nil {
 					log.Printf("can not write reponse report (81) to gadget device file: %v", err)
 					return
 				}
-				n.comState = comStateMac
+				n.handleComEvent(comEventRequestMac)
 			case subTypeHandshake:
-				err = n.writeReport(f, usbReportIdOutput81, []byte{ buf[1] })
+				err = n.queueReport(stopCh, usbReportIdOutput81, []byte{ buf[1] })
 				if err != nil {
 					log.Printf("can not write reponse report (81) to gadget device file: %v", err)
 					return
 				}
-				if n.comState == comStateBaudRate  {
-					n.comState = comStateHandshake2
-				} else {
-					n.comState = comStateHandshake
-				}
+				n.handleComEvent(comEventHandshake)
 			case subTypeBaudRate:
-				err = n.writeReport(f, usbReportIdOutput81, []byte{ buf[1] })
+				err = n.queueReport(stopCh, usbReportIdOutput81, []byte{ buf[1] })
 				if err != nil {
 					log.Printf("can not write reponse report (81) to gadget device file: %v", err)
 					return
 				}
-				n.comState = comStateBaudRate
+				n.handleComEvent(comEventBaudRate)
 			case subTypeDisableUsbTimeout:
-				n.usbTimeout = false
-				n.comState = comStateDisableUsbTimeout
+				n.handleComEvent(comEventDisableUsbTimeout)
 				log.Printf("diable usb timeout")
 			case subTypeEnableUsbTimeout:
-				n.usbTimeout = true
-				n.comState = comStateEnableUsbTimeout
+				n.handleComEvent(comEventEnableUsbTimeout)
 			default:
 				log.Printf("unsupported sub type (%x): %x", buf[1], buf[2:rl])
 			}
 		case reportIdInput01:
+			if rl < 11 {
+				log.Printf("too short report (01): %x", buf[:rl])
+				continue
+			}
 			// XXX buf[1]  = counter : What should i do?
 			err = n.sendVibrationRequest(buf[2:10])
 			if err != nil {
 				log.Printf("can not forward vibration report (01) to user: %v", err)
 			}
-			switch buf[10] {
-			case subCommandBluetoothManualPairing:
-				// buf[11:43] ???
-				// skip 0x81 01 01, 0x81 01 02
-				// last response only
-				ack := n.buildAck(subCommandBluetoothManualPairing, true)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandBluetoothManualPairing,
-					[]byte{ 0x03 } ))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandBluetoothManualPairing, err)
-					return
-				}
-			case subCommandRequestDeviceInfo:
-				ack := n.buildAck(subCommandRequestDeviceInfo, true)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandRequestDeviceInfo,
-					[]byte{ 0x03, 0x48, 0x03, 0x02 }, n.reverseMacAddr, []byte{ 0x03 /* ??? */, 0x02 /* default */ } ))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandRequestDeviceInfo, err)
-					return
-				}
-			case subCommandSetInputReportMode:
-				if buf[11] == 0x30 {
-					if n.verbose {
-						log.Printf("Standard full mode. Pushes current state @60Hz")
-					}
-				}
-				ack := n.buildAck(subCommandSetInputReportMode, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetInputReportMode))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetInputReportMode, err)
-					return
-				}
-			case subCommandTriggerButtonsElapsedTime:
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), 0x83 /* from dump */, subCommandTriggerButtonsElapsedTime))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", 0x83 /* from dump */, subCommandTriggerButtonsElapsedTime, err)
-					return
-				}
-			case subCommandSetHciState:
-				// buf[11] = 0x00 Disconnect 
-				ack := n.buildAck(subCommandSetHciState, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetHciState))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetHciState, err)
-					return
-				}
-				// usb disconnect magic
-				// n.writeReport(f, usbReportIdOutput81, []byte{ 0x01, 0x03 })
-			case subCommandSetShipmentLowPowerState:
-				// buf[11] nothig to do
-				ack := n.buildAck(subCommandSetShipmentLowPowerState, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetShipmentLowPowerState))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetShipmentLowPowerState, err)
-					return
-				}
-			case subCommandReadSpi:
-				var mem []byte
-				switch buf[12] {
-				case 0x60:
-					mem = n.spiMemory60
-				case 0x80:
-					mem = n.spiMemory80
-				default:
-					log.Printf("unsupported spi memory address (%x:%x%x) to gadget device file: %v", subCommandReadSpi, buf[12], buf[11], err)
-					err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), 0x00, subCommandReadSpi))
-					if err != nil {
-						log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", 0x00, subCommandReadSpi, err)
-						return
-					}
-					return
-				}
-				if len(mem) < int(buf[11] + buf[15]) {
-					log.Printf("unsupported spi memory address (%x:%x%x) to gadget device file: %v", subCommandReadSpi, buf[12], buf[11], err)
-					err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), 0x00, subCommandReadSpi))
-					if err != nil {
-						log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", 0x00, subCommandReadSpi, err)
-						return
-					}
-				}
-				ack := n.buildAck(subCommandReadSpi, true)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(),
-					 ack, subCommandReadSpi, buf[11:16], mem[buf[11]:buf[11] + buf[15]]))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandReadSpi, err)
-					return
-				}
-                        case subCommandSetNfcIrMcuConfiguration:
-				// ignore????
-				// XXX buf[11] ????
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), 0xa0 /* from dump */, subCommandSetNfcIrMcuConfiguration,
-				       []byte{ 0x01, 0x00, 0xff, 0x00, 0x03, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-					       0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5c, /* XXX ??? */} ))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", 0xa0 /* from dump */, subCommandSetNfcIrMcuConfiguration, err)
-					return
-				}
-			case subCommandSetPlayerLights:
-				// buf[11] nothig to do
-				ack := n.buildAck(subCommandSetPlayerLights, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetPlayerLights))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetPlayerLights, err)
-					return
-				}
-			case subCommand33:
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), 0x80 /* from dump */, subCommand33, []byte{ 0x03 /* XXX ???? */ }))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", 0x80 /* from dump */, subCommand33, err)
-					return
-				}
-			case subCommandSetHomeLight:
-				// buf[11:36] nothing to do
-				ack := n.buildAck(subCommandSetHomeLight, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetHomeLight))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetHomeLight, err)
-					return
-				}
-			case subCommandEnableImu:
-				n.imuEnable = buf[11]
-				ack := n.buildAck(subCommandEnableImu, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandEnableImu))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandEnableImu, err)
-					return
-				}
-			case subCommandSetImuSensitivity:
-                                n.imuSensitivity.gyroSensitivity              = buf[11]
-                                n.imuSensitivity.accelerometerSensitivity     = buf[12]
-                                n.imuSensitivity.gyroPerformanceRate          = buf[13]
-                                n.imuSensitivity.accelerometerFilterBandwidth = buf[14]
-				ack := n.buildAck(subCommandSetImuSensitivity, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandSetImuSensitivity))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandSetImuSensitivity, err)
-					return
-				}
-			case subCommandEnableVibration:
-				n.vibrationEnable = buf[11]
-				if n.verbose {
-					if n.vibrationEnable == 0 {
-						log.Printf("vibration disabled")
-					} else {
-						log.Printf("vibration enabled")
-					}
-				}
-				ack := n.buildAck(subCommandEnableVibration, false)
-				err = n.writeReport(f, reportIdOutput21, n.buildOutput21(n.buildControllerReport(), ack, subCommandEnableVibration))
-				if err != nil {
-					log.Printf("can not write reponse report (21:%x:%x) to gadget device file: %v", ack, subCommandEnableVibration, err)
-					return
-				}
-			default:
-				log.Printf("unsupported sub command (%x): %x", buf[10], buf[11:rl])
+			n.handleComEvent(comEventSubCommand)
+			err = n.handleSubCommand(stopCh, buf[10], buf[11:rl])
+			if err != nil {
+				log.Printf("can not write reponse report (21:%x) to gadget device file: %v", buf[10], err)
+				return
 			}
 		case reportIdInput10:
+			if rl < 10 {
+				log.Printf("too short report (10): %x", buf[:rl])
+				continue
+			}
 			// XXX buf[1]  = counter : What should i do?
 			err = n.sendVibrationRequest(buf[2:10])
 			if err != nil {
 				log.Printf("can not forward vibration report (10) to user: %v", err)
 			}
+		case reportIdInput11:
+			if rl < 11 {
+				log.Printf("too short report (11): %x", buf[:rl])
+				continue
+			}
+			// XXX buf[1]  = counter : What should i do?
+			err = n.sendVibrationRequest(buf[2:10])
+			if err != nil {
+				log.Printf("can not forward vibration report (11) to user: %v", err)
+			}
+			n.mcu.handleRequest(buf[10:rl])
 		}
 	}
 }
 
+// caller must hold the mutex
 func (n *NSProCon) buildControllerReport() []byte {
         now := time.Now()
         timestamp := byte(((now.UnixNano() / int64(time.Millisecond)) % 256))
-	byte1 := byte(8) /* buttery full */            << 4 |
+	byte1 := n.battery                             << 4 |
 	         byte(1) /* XXX connection info ??? */
 	byte2 := n.controller.buttons.y            |
 		 n.controller.buttons.x       << 1 |
@@ -565,10 +532,22 @@ func (n *NSProCon) buildControllerReport() []byte {
 		 n.controller.buttons.leftSl << 5 |
 		 n.controller.buttons.l      << 6 |
 		 n.controller.buttons.zl     << 7
-	lx := uint16(math.Round((1 + n.controller.leftStick.x) * 2047.5))
-	ly := uint16(math.Round((1 + n.controller.leftStick.y) * 2047.5))
-	rx := uint16(math.Round((1 + n.controller.rightStick.x) * 2047.5))
-	ry := uint16(math.Round((1 + n.controller.rightStick.y) * 2047.5))
+	// encode against the factory calibration served from spi flash
+	lx, ly := n.leftStickCalibration.encode(n.controller.leftStick.x, n.controller.leftStick.y)
+	rx, ry := n.rightStickCalibration.encode(n.controller.rightStick.x, n.controller.rightStick.y)
+	// single joy-con fills only its own half
+	switch n.deviceType {
+	case usbDeviceTypeChargingGripJoyConL:
+		byte2 = 0
+		byte3 &= 0xa9 /* minus, left stick, capture, charging grip */
+		rx = 0
+		ry = 0
+	case usbDeviceTypeChargingGripJoyConR:
+		byte4 = 0
+		byte3 &= 0x96 /* plus, right stick, home, charging grip */
+		lx = 0
+		ly = 0
+	}
 	// 0 - 4095 (12 bit)
 	// 16 bit 8byte -> 12bit 6byte
 	stickBytes := make([]byte, 6)
@@ -587,51 +566,238 @@ func (n *NSProCon) buildControllerReport() []byte {
 	 }
 }
 
-func (n *NSProCon) buildOutput21(controller []byte, ack byte, subCmd byte, dataList ...[]byte) []byte {
-	report := append(controller, ack, subCmd)
+func (n *NSProCon) buildOutput21(ack byte, subCmd byte, dataList ...[]byte) []byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	report := append(n.buildControllerReport(), ack, subCmd)
 	for _, data := range dataList {
 		report = append(report, data...)
 	}
 	return report
 }
 
+func (n *NSProCon) imuToBytes(v float64, sensitivity float64) []byte {
+	raw := math.Round(v * 1000 / sensitivity)
+	if raw > math.MaxInt16 {
+		raw = math.MaxInt16
+	} else if raw < math.MinInt16 {
+		raw = math.MinInt16
+	}
+	i := int16(raw)
+	return []byte{ byte(uint16(i) & 0xff), byte(uint16(i) >> 8) }
+}
+
+// caller must hold the mutex
+func (n *NSProCon) buildImuReport() []byte {
+	// 3 frames (5msec interval) of accelerometer (x, y, z) and gyro (x, y, z)
+	imu := make([]byte, 0, 36)
+	motion := n.motion
+	if motion == nil {
+		motion = &GamepadMotion{}
+	}
+	prevMotion := n.prevMotion
+	if prevMotion == nil {
+		prevMotion = motion
+	}
+	n.prevMotion = motion
+	gyroSensitivity, ok := imuGyroSensitivityMap[n.imuSensitivity.gyroSensitivity]
+	if !ok {
+		gyroSensitivity = imuGyroSensitivityMap[0x03]
+	}
+	accelerometerSensitivity, ok := imuAccelerometerSensitivityMap[n.imuSensitivity.accelerometerSensitivity]
+	if !ok {
+		accelerometerSensitivity = imuAccelerometerSensitivityMap[0x00]
+	}
+	for i := 1; i <= 3; i++ {
+		m := prevMotion.interpolate(motion, float64(i) / 3.0)
+		imu = append(imu, n.imuToBytes(m.AccelX, accelerometerSensitivity)...)
+		imu = append(imu, n.imuToBytes(m.AccelY, accelerometerSensitivity)...)
+		imu = append(imu, n.imuToBytes(m.AccelZ, accelerometerSensitivity)...)
+		imu = append(imu, n.imuToBytes(m.GyroX, gyroSensitivity)...)
+		imu = append(imu, n.imuToBytes(m.GyroY, gyroSensitivity)...)
+		imu = append(imu, n.imuToBytes(m.GyroZ, gyroSensitivity)...)
+	}
+	return imu
+}
+
 func (n *NSProCon) buildOutput30() []byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	report := n.buildControllerReport()
         if n.imuEnable != 0 {
-                // XXX  not supported imu in gamepad api
-                // XXX  no idea
-		// XXX  report = append(report, imu...)
+		report = append(report, n.buildImuReport()...)
         }
 	return report
 }
 
-func (n *NSProCon) writeControllerReportLoop(f *os.File) {
-	ticker := time.NewTicker(time.Millisecond * 1000 / 60)
+func (n *NSProCon) buildOutput31() []byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	report := n.buildControllerReport()
+        if n.imuEnable != 0 {
+		report = append(report, n.buildImuReport()...)
+        } else {
+		report = append(report, make([]byte, 36)...)
+	}
+	return append(report, n.mcu.buildReport()...)
+}
+
+// queue report to the writer
+func (n *NSProCon) queueReport(stopCh chan int, reportId byte, reportBytes []byte) error {
+	select {
+	case n.reportCh <- &nsReport{ reportId: reportId, reportBytes: reportBytes }:
+		return nil
+	case <-stopCh:
+		return fmt.Errorf("can not queue report (%x) because stopped", reportId)
+	}
+}
+
+// frame hooks run only on reports of the ticker, so frames keep the report rate
+func (n *NSProCon) buildPeriodicReport(runFrameHooks bool) (byte, []byte, bool) {
+	n.mutex.Lock()
+	comState := n.comState
+	reportMode := n.reportMode
+	mcuReport := n.mcuReport
+	n.mutex.Unlock()
+	if !comState.streaming() {
+		return 0, nil, false
+	}
+	if runFrameHooks {
+		n.RunFrameHooks()
+	}
+	// without mcu report, 0x31 mode streams 0x30 reports
+	if reportMode == reportIdOutput31 && mcuReport {
+		return reportIdOutput31, n.buildOutput31(), true
+	}
+	return reportIdOutput30, n.buildOutput30(), true
+}
+
+// wake up the writer in event driven report mode
+func (n *NSProCon) notifyStateChanged() {
+	select {
+	case n.stateChangedCh <- 1:
+	default:
+	}
+}
+
+func (n *NSProCon) writePeriodicReport(f *os.File, runFrameHooks bool) error {
+	reportId, reportBytes, ok := n.buildPeriodicReport(runFrameHooks)
+	// changes until here are included in this report
+	select {
+	case <-n.stateChangedCh:
+	default:
+	}
+	if !ok {
+		return nil
+	}
+	return n.writeReport(f, reportId, reportBytes)
+}
+
+// only this loop writes to the device file.
+// queued replies have priority over periodic reports.
+// in event driven report mode, a state change writes a report immediately
+// unless the previous periodic report is within the minimum interval.
+func (n *NSProCon) writeReportLoop(f *os.File, stopCh chan int) {
+	n.mutex.Lock()
+	reportInterval := n.reportInterval
+	eventDrivenReport := n.eventDrivenReport
+	minReportInterval := n.minReportInterval
+	n.mutex.Unlock()
+	ticker := time.NewTicker(reportInterval)
 	defer ticker.Stop()
+	var stateChangedCh chan int
+	if eventDrivenReport {
+		stateChangedCh = n.stateChangedCh
+	}
+	var lastReportTime time.Time
+	var pendingReportCh <-chan time.Time
 	for {
 		select {
-		case <-ticker.C:
-			if n.comState < comStateDisableUsbTimeout {
-				continue
+		case report := <-n.reportCh:
+			err := n.writeReport(f, report.reportId, report.reportBytes)
+			if err != nil {
+				log.Printf("can not write report (%x) to gadget device file: %v", report.reportId, err)
+				return
 			}
-			err := n.writeReport(f, reportIdOutput30, n.buildControllerReport())
+			continue
+		default:
+		}
+		runFrameHooks := false
+		select {
+		case report := <-n.reportCh:
+			err := n.writeReport(f, report.reportId, report.reportBytes)
 			if err != nil {
-				log.Printf("can not write report (30) to gadget device file: %v", err)
+				log.Printf("can not write report (%x) to gadget device file: %v", report.reportId, err)
 				return
 			}
-		case <-n.stopCh:
+			continue
+		case <-ticker.C:
+			if n.checkComStateTimeout() {
+				err := n.writeReport(f, usbReportIdOutput81, usbStatusReport)
+				if err != nil {
+					log.Printf("can not write usb status report (81) to gadget device file: %v", err)
+					return
+				}
+			}
+			runFrameHooks = true
+		case <-stateChangedCh:
+			if pendingReportCh != nil {
+				continue
+			}
+			wait := minReportInterval - time.Since(lastReportTime)
+			if wait > 0 {
+				pendingReportCh = time.After(wait)
+				continue
+			}
+		case <-pendingReportCh:
+		case <-stopCh:
 			return
 		}
+		pendingReportCh = nil
+		err := n.writePeriodicReport(f, runFrameHooks)
+		if err != nil {
+			log.Printf("can not write periodic report to gadget device file: %v", err)
+			return
+		}
+		lastReportTime = time.Now()
+		if !runFrameHooks {
+			// next tick is a full interval after the event driven report
+			ticker.Reset(reportInterval)
+			select {
+			case <-ticker.C:
+			default:
+			}
+		}
 	}
 }
 
-func (n *NSProCon) Setup() error {
-	err := setup.UsbGadgetHidCleanup(n.setupParams)
-	if err != nil {
-		return fmt.Errorf("can not cleanup usb gadget hid device in nsprocon: %w", err)
+func (n *NSProCon) SetReportRate(reportRate float64) error {
+	if reportRate <= 0 {
+		return fmt.Errorf("invalid report rate: %v", reportRate)
 	}
-	time.Sleep(time.Second)
-	err = setup.UsbGadgetHidSetup(n.setupParams)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.reportInterval = time.Duration(float64(time.Second) / reportRate)
+	return nil
+}
+
+func (n *NSProCon) SetEventDrivenReport(enable bool, minReportInterval time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.eventDrivenReport = enable
+	n.minReportInterval = minReportInterval
+}
+
+func (n *NSProCon) AddGadgetFunctions(functions []*setup.UsbGadgetFunction) {
+	addGadgetFunctions(n.setupParams, functions)
+}
+
+func (n *NSProCon) GadgetHidDevFiles() (map[string]string, error) {
+	return gadgetHidDevFiles(n.setupParams, n.devFilePath)
+}
+
+func (n *NSProCon) Setup() error {
+	err := setup.UsbGadgetHidSetup(n.setupParams)
 	if err != nil {
 		return fmt.Errorf("can not setup usb gadget hid device in nsprocon: %w", err)
 	}
@@ -640,27 +806,75 @@ func (n *NSProCon) Setup() error {
 		return fmt.Errorf("can not enable usb gadget hid device in nsprocon: %w", err)
 	}
 	time.Sleep(time.Second)
-	_, err =  os.Stat("/dev/hidg0")
+	n.devFilePath = resolveDevFilePath(n.setupParams, n.devFilePath)
+	_, err =  os.Stat(n.devFilePath)
 	if err != nil {
 		return fmt.Errorf("not found device file  (%v) in nsprocon: %w", n.devFilePath, err)
 	}
 	return nil
 }
 
+// session of the supervisor, the loops stop each other
+func (n *NSProCon) runSession(f *os.File, stopCh chan int) {
+	loopStopCh := make(chan int)
+	n.mutex.Lock()
+	// timeout of the handshake starts with the session
+	n.comStateTime = time.Now()
+	n.mutex.Unlock()
+	exitCh := make(chan int, 2)
+	go func() {
+		n.readReportLoop(f, loopStopCh)
+		exitCh <- 1
+	}()
+	go func() {
+		n.writeReportLoop(f, loopStopCh)
+		exitCh <- 1
+	}()
+	exited := 0
+	select {
+	case <-exitCh:
+		exited += 1
+	case <-stopCh:
+	}
+	close(loopStopCh)
+	// unblock read
+	if err := f.Close(); err != nil {
+		log.Printf("can not close device file (%v) in nsprocon: %v", n.devFilePath, err)
+	}
+	for ; exited < 2; exited++ {
+		<-exitCh
+	}
+}
+
+// the host starts over from the usb handshake
+func (n *NSProCon) resetSession() {
+	n.mutex.Lock()
+	handshake := n.transitComState(comEventReset)
+	n.reportCounter = 0
+	n.reportMode = reportIdOutput30
+	n.imuEnable = 0
+	n.vibrationEnable = 0
+	n.vibrating = false
+	n.vibrationInterval = vibrationDefaultInterval
+	n.mutex.Unlock()
+	n.mcu.setState(0x00)
+	n.SendHandshake(handshake)
+	// no writer while the session is stopped
+	for len(n.reportCh) > 0 {
+		<-n.reportCh
+	}
+}
+
 func (n *NSProCon) Start() error {
-        f, err := os.OpenFile(n.devFilePath, os.O_RDWR, 0644)
-        if err != nil {
-                return fmt.Errorf("can not open device file (%v) in nsprocon: %w", n.devFilePath, err)
-        }
-	n.devFile = f
-	go n.readReportLoop(f)
-	go n.writeControllerReportLoop(f)
-	return nil
+	n.supervisor = newSupervisor(n.verbose, "nsprocon", n.devFilePath, n.setupParams.UDC, n.runSession, n.resetSession)
+	return n.supervisor.start()
 }
 
 func (n *NSProCon) Stop() {
-	close(n.stopCh)
-	n.devFile.Close()
+	if n.supervisor != nil {
+		n.supervisor.stop()
+	}
+	n.hidCapturer.stop()
 	err := setup.UsbGadgetHidDisable(n.setupParams)
 	if err != nil {
 		log.Printf("can not disable usb gadget hid device in nsprocon: %v", err)
@@ -671,6 +885,21 @@ func (n *NSProCon) Stop() {
 	}
 }
 
+func (n *NSProCon) StartHidCapture(filePath string) error {
+	err := n.hidCapturer.start(filePath)
+	if err != nil {
+		return fmt.Errorf("can not start hid capture: %w", err)
+	}
+	if n.verbose {
+		log.Printf("start hid capture: %v", filePath)
+	}
+	return nil
+}
+
+func (n *NSProCon) StopHidCapture() {
+	n.hidCapturer.stop()
+}
+
 func (n *NSProCon) boolToByte(v bool) byte {
 	if v {
 		return byte(1)
@@ -679,7 +908,111 @@ func (n *NSProCon) boolToByte(v bool) byte {
 	}
 }
 
+// a single joy-con is held sideways, so buttons and stick are rotated.
+// joy-con (L): rail up, stick on the left side
+func (n *NSProCon) updateStateJoyConL(state *message.GamepadState) {
+	for i, button := range state.Buttons {
+		switch i {
+		case 0:
+			n.controller.buttons.left = n.boolToByte(button.Pressed)
+		case 1:
+			n.controller.buttons.down = n.boolToByte(button.Pressed)
+		case 2:
+			n.controller.buttons.up = n.boolToByte(button.Pressed)
+		case 3:
+			n.controller.buttons.right = n.boolToByte(button.Pressed)
+		case 4:
+			n.controller.buttons.leftSl = n.boolToByte(button.Pressed)
+		case 5:
+			n.controller.buttons.leftSr = n.boolToByte(button.Pressed)
+		case 8, 9:
+			n.controller.buttons.minus = n.boolToByte(button.Pressed)
+		case 10, 11:
+			n.controller.leftStick.press = n.boolToByte(button.Pressed)
+		case 16, 17:
+			n.controller.buttons.capture = n.boolToByte(button.Pressed)
+		case 6, 7, 12, 13, 14, 15:
+			// not exists
+		default:
+			log.Printf("can not update state because unsupported button in nsjoyconl: button index = %v", i)
+		}
+	}
+	for i, axis := range state.Axes {
+		switch i {
+		case 0:
+			n.controller.leftStick.y = axis * -1.0
+		case 1:
+			n.controller.leftStick.x = axis * -1.0
+		case 2, 3:
+			// not exists
+		default:
+			log.Printf("can not update state because unsupported axis in nsjoyconl: axis index = %v", i)
+		}
+	}
+}
+
+// joy-con (R): rail up, stick on the left side
+func (n *NSProCon) updateStateJoyConR(state *message.GamepadState) {
+	for i, button := range state.Buttons {
+		switch i {
+		case 0:
+			n.controller.buttons.a = n.boolToByte(button.Pressed)
+		case 1:
+			n.controller.buttons.x = n.boolToByte(button.Pressed)
+		case 2:
+			n.controller.buttons.b = n.boolToByte(button.Pressed)
+		case 3:
+			n.controller.buttons.y = n.boolToByte(button.Pressed)
+		case 4:
+			n.controller.buttons.rightSl = n.boolToByte(button.Pressed)
+		case 5:
+			n.controller.buttons.rightSr = n.boolToByte(button.Pressed)
+		case 8, 9:
+			n.controller.buttons.plus = n.boolToByte(button.Pressed)
+		case 10, 11:
+			n.controller.rightStick.press = n.boolToByte(button.Pressed)
+		case 16, 17:
+			n.controller.buttons.home = n.boolToByte(button.Pressed)
+		case 6, 7, 12, 13, 14, 15:
+			// not exists
+		default:
+			log.Printf("can not update state because unsupported button in nsjoyconr: button index = %v", i)
+		}
+	}
+	for i, axis := range state.Axes {
+		switch i {
+		case 0:
+			n.controller.rightStick.y = axis
+		case 1:
+			n.controller.rightStick.x = axis
+		case 2, 3:
+			// not exists
+		default:
+			log.Printf("can not update state because unsupported axis in nsjoyconr: axis index = %v", i)
+		}
+	}
+}
+
 func (n *NSProCon) UpdateState(state *message.GamepadState) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer n.notifyStateChanged()
+	switch n.deviceType {
+	case usbDeviceTypeChargingGripJoyConL:
+		n.updateStateJoyConL(state)
+	case usbDeviceTypeChargingGripJoyConR:
+		n.updateStateJoyConR(state)
+	default:
+		n.updateStateProCon(state)
+	}
+	if n.verbose {
+		log.Printf("buttons = %+v, left stick = %+v, right stick = %+v",
+			n.controller.buttons, n.controller.leftStick, n.controller.rightStick)
+	}
+	return nil
+}
+
+func (n *NSProCon) updateStateProCon(state *message.GamepadState) {
 	for i, button := range state.Buttons {
 		switch i {
 		case 0:
@@ -736,14 +1069,12 @@ func (n *NSProCon) UpdateState(state *message.GamepadState) error {
 			log.Printf("can not update state because unsupported axis in nsprocon: axis index = %v", i)
 		}
 	}
-	if n.verbose {
-		log.Printf("buttons = %+v, left stick = %+v, right stick = %+v",
-			n.controller.buttons, n.controller.leftStick, n.controller.rightStick)
-	}
-	return nil
 }
 
 func (n *NSProCon) Press(buttons []ButtonName) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer n.notifyStateChanged()
 	for _, button := range buttons {
 		switch button {
 		case ButtonA:
@@ -800,6 +1131,9 @@ func (n *NSProCon) Press(buttons []ButtonName) error {
 }
 
 func (n *NSProCon) Release(buttons []ButtonName) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer n.notifyStateChanged()
 	for _, button := range buttons {
 		switch button {
 		case ButtonA:
@@ -855,19 +1189,66 @@ func (n *NSProCon) Release(buttons []ButtonName) error {
 	return nil
 }
 
+func (n *NSProCon) UpdateMotion(motion *GamepadMotion) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.motion = motion
+	return nil
+}
+
+func (n *NSProCon) LoadAmiibo(amiibo []byte) error {
+	return n.mcu.loadAmiibo(amiibo)
+}
+
+func (n *NSProCon) SetMcuReport(enable bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.mcuReport = enable
+	if enable {
+		n.setupParams.ReportLength = nsMcuReportLength
+		n.setupParams.ReportDesc = nsMcuReportDesc
+	} else {
+		n.setupParams.ReportLength = nsReportLength
+		n.setupParams.ReportDesc = nsReportDesc
+	}
+}
+
+func (n *NSProCon) RemoveAmiibo() error {
+	n.mcu.removeAmiibo()
+	return nil
+}
+
 func (n *NSProCon) StickL(xAxis float64, yAxis float64) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer n.notifyStateChanged()
 	n.controller.leftStick.x = xAxis
 	n.controller.leftStick.y = yAxis * -1.0
 	return nil
 }
 
 func (n *NSProCon) StickR(xAxis float64, yAxis float64) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer n.notifyStateChanged()
 	n.controller.rightStick.x = xAxis
 	n.controller.rightStick.y = yAxis * -1.0
 	return nil
 }
 
-func NewNSProCon(verbose bool, macAddr string, spiMemory60 string, spiMemory80 string, devFilePath string, configsHome string, udc string) (*NSProCon, error) {
+func NewNSProCon(verbose bool, macAddr string, spiMemory60 string, spiMemory80 string, spiFlashFile string, devFilePath string, configsHome string, udc string) (*NSProCon, error) {
+	return newNSCon(usbDeviceTypeProController, verbose, macAddr, spiMemory60, spiMemory80, spiFlashFile, devFilePath, configsHome, udc)
+}
+
+func NewNSJoyConL(verbose bool, macAddr string, spiMemory60 string, spiMemory80 string, spiFlashFile string, devFilePath string, configsHome string, udc string) (*NSProCon, error) {
+	return newNSCon(usbDeviceTypeChargingGripJoyConL, verbose, macAddr, spiMemory60, spiMemory80, spiFlashFile, devFilePath, configsHome, udc)
+}
+
+func NewNSJoyConR(verbose bool, macAddr string, spiMemory60 string, spiMemory80 string, spiFlashFile string, devFilePath string, configsHome string, udc string) (*NSProCon, error) {
+	return newNSCon(usbDeviceTypeChargingGripJoyConR, verbose, macAddr, spiMemory60, spiMemory80, spiFlashFile, devFilePath, configsHome, udc)
+}
+
+func newNSCon(deviceType byte, verbose bool, macAddr string, spiMemory60 string, spiMemory80 string, spiFlashFile string, devFilePath string, configsHome string, udc string) (*NSProCon, error) {
 	setupParams := &setup.UsbGadgetHidSetupParams{
 		ConfigsHome:     configsHome,
 		GadgetName:      "nsprocon",
@@ -892,13 +1273,32 @@ func NewNSProCon(verbose bool, macAddr string, spiMemory60 string, spiMemory80 s
 		InstanceName:    "usb0",
 		Protocol:        "0",
 		Subclass:        "0",
-		ReportLength:    "203",
-		ReportDesc:      "050115000904A1018530050105091901290A150025017501950A5500650081020509190B290E150025017501950481027501950281030B01000100A1000B300001000B310001000B320001000B35000100150027FFFF0000751095048102C00B39000100150025073500463B0165147504950181020509190F2912150025017501950481027508953481030600FF852109017508953F8103858109027508953F8103850109037508953F9183851009047508953F9183858009057508953F9183858209067508953F9183C0",
+		ReportLength:    nsReportLength,
+		ReportDesc:      nsReportDesc,
 		UDC:	         udc,
 	}
-	defaultDevFilePath := "/dev/hidg0"
-	if devFilePath == "" {
-		devFilePath = defaultDevFilePath
+	if deviceType != usbDeviceTypeProController {
+		// joy-con is attached to the charging grip on usb
+		setupParams.GadgetName = "nsjoycon"
+		setupParams.IdProduct = "0x200e"
+		setupParams.IProduct = "Charging Grip"
+		setupParams.ConfigString = "Nintendo Switch Charging Grip"
+	}
+	if macAddr == "" {
+		generatedMacAddr, err := GenerateNSMacAddr()
+		if err != nil {
+			return nil, fmt.Errorf("can not generate mac address: %w", err)
+		}
+		log.Printf("no mac address, use random mac address: %v", generatedMacAddr)
+		macAddr = generatedMacAddr
+	}
+	if spiMemory60 == "" {
+		generatedSpiMemory60, err := generateSpiMemory60(deviceType, "")
+		if err != nil {
+			return nil, fmt.Errorf("can not generate spi memory 60XX: %w", err)
+		}
+		log.Printf("no spi memory 60XX, use generated factory data")
+		spiMemory60 = hex.EncodeToString(generatedSpiMemory60)
 	}
         decodedMacAddr, err := hex.DecodeString(macAddr)
         if err != nil {
@@ -906,17 +1306,29 @@ func NewNSProCon(verbose bool, macAddr string, spiMemory60 string, spiMemory80 s
         }
         decodedSpiMemory60, err := hex.DecodeString(spiMemory60)
         if err != nil {
-                return nil, fmt.Errorf("can not decode spi memory 60XX string (%v): %w", decodedSpiMemory60, err)
+                return nil, fmt.Errorf("can not decode spi memory 60XX string (%v): %w", spiMemory60, err)
         }
         decodedSpiMemory80, err := hex.DecodeString(spiMemory80)
         if err != nil {
-                return nil, fmt.Errorf("can not decode spi memory 80XX string (%v): %w", decodedSpiMemory80, err)
+                return nil, fmt.Errorf("can not decode spi memory 80XX string (%v): %w", spiMemory80, err)
         }
+	newSpiFlash, err := newSpiFlash(verbose, spiFlashFile, decodedSpiMemory60, decodedSpiMemory80)
+	if err != nil {
+                return nil, fmt.Errorf("can not create spi flash: %w", err)
+	}
+	leftStickCalibrationData, err := newSpiFlash.read(spiAddrLeftStickCalibration, stickCalibrationSize)
+	if err != nil {
+                return nil, fmt.Errorf("can not read left stick calibration: %w", err)
+	}
+	rightStickCalibrationData, err := newSpiFlash.read(spiAddrRightStickCalibration, stickCalibrationSize)
+	if err != nil {
+                return nil, fmt.Errorf("can not read right stick calibration: %w", err)
+	}
 	reverseMacAddr := make([]byte, len(decodedMacAddr))
 	for i, b := range decodedMacAddr {
 		reverseMacAddr[len(decodedMacAddr) - 1 - i] = b
 	}
-	return &NSProCon{
+	newNSProCon := &NSProCon{
 		BaseBackend: &BaseBackend{
 			verbose: verbose,
 		},
@@ -924,21 +1336,48 @@ func NewNSProCon(verbose bool, macAddr string, spiMemory60 string, spiMemory80 s
 		setupParams: setupParams,
 		macAddr: decodedMacAddr,
 		reverseMacAddr: reverseMacAddr,
-		spiMemory60: decodedSpiMemory60,
-		spiMemory80: decodedSpiMemory80,
+		spiFlash: newSpiFlash,
 		devFilePath: devFilePath,
-		devFile: nil,
+		supervisor: nil,
+		deviceType: deviceType,
 		comState: comStateInit,
+		comStateTime: time.Now(),
+		comRetry: 0,
 		usbTimeout: true,
 		reportCounter: 0,
+		reportMode: reportIdOutput30,
 		imuEnable: 0,
 		vibrationEnable: 0,
-		stopCh: make(chan int),
+		vibrating: false,
+		vibrationInterval: vibrationDefaultInterval,
 		controller: &controller{
 			buttons: &buttons{},
 			leftStick: &stick{},
 			rightStick: &stick{},
 		},
-		imuSensitivity: &imuSensitivity{},
-	}, nil
+		imuSensitivity: &imuSensitivity{
+			gyroSensitivity: 0x03,
+			accelerometerSensitivity: 0x00,
+			gyroPerformanceRate: 0x01,
+			accelerometerFilterBandwidth: 0x01,
+		},
+		motion: nil,
+		prevMotion: nil,
+		mcu: newNSMcu(verbose),
+		reportCh: make(chan *nsReport, 16),
+		hidCapturer: newHidCapturer(),
+		firmwareVersion: []byte{ 0x03, 0x48 },
+		battery: 0x08, /* full */
+		subCommandStats: make(map[byte]*NSSubCommandStat),
+		mcuReport: false,
+		reportInterval: nsDefaultReportInterval,
+		eventDrivenReport: false,
+		minReportInterval: DefaultMinReportInterval,
+		stateChangedCh: make(chan int, 1),
+		leftStickCalibration: decodeLeftStickCalibration(leftStickCalibrationData),
+		rightStickCalibration: decodeRightStickCalibration(rightStickCalibrationData),
+	}
+	newNSProCon.subCommandHandlers = newNSProCon.defaultSubCommandHandlers()
+	newNSProCon.defaultSubCommandHandler = newNSProCon.genericSubCommand
+	return newNSProCon, nil
 }
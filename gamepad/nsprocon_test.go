@@ -0,0 +1,190 @@
+package gamepad
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+const testReportIdOrder byte = 0x7f
+
+func newTestNSProCon(t *testing.T) *NSProCon {
+	t.Helper()
+	n, err := NewNSProCon(false, "", "", "", "", "", "", "")
+	if err != nil {
+		t.Fatalf("can not create nsprocon: %v", err)
+	}
+	return n
+}
+
+// writer end runs writeReportLoop, reports of the reader end are passed to fn until it returns false
+func runTestWriteReportLoop(t *testing.T, n *NSProCon, fn func(report []byte) bool) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("can not create pipe: %v", err)
+	}
+	stopCh := make(chan int)
+	doneCh := make(chan int)
+	go func() {
+		defer close(doneCh)
+		n.writeReportLoop(w, stopCh)
+	}()
+	defer func() {
+		close(stopCh)
+		// unblock a write to the full pipe
+		r.Close()
+		<-doneCh
+		w.Close()
+	}()
+	report := make([]byte, 64)
+	for {
+		if _, err := io.ReadFull(r, report); err != nil {
+			t.Fatalf("can not read report: %v", err)
+		}
+		if !fn(report) {
+			return
+		}
+	}
+}
+
+func TestQueueReportOrder(t *testing.T) {
+	const writers = 4
+	const reports = 200
+	n := newTestNSProCon(t)
+	if err := n.SetReportRate(1000); err != nil {
+		t.Fatalf("can not set report rate: %v", err)
+	}
+	// periodic reports are written between queued reports
+	n.comState = comStateSubCommand
+	stopCh := make(chan int)
+	defer close(stopCh)
+	for i := 0; i < writers; i++ {
+		go func(writer byte) {
+			for seq := 0; seq < reports; seq++ {
+				reportBytes := make([]byte, 63)
+				reportBytes[0] = writer
+				binary.LittleEndian.PutUint32(reportBytes[1:5], uint32(seq))
+				if err := n.queueReport(stopCh, testReportIdOrder, reportBytes); err != nil {
+					return
+				}
+			}
+		}(byte(i))
+	}
+	next := make([]uint32, writers)
+	received := 0
+	runTestWriteReportLoop(t, n, func(report []byte) bool {
+		switch report[0] {
+		case reportIdOutput30:
+			return true
+		case testReportIdOrder:
+		default:
+			t.Fatalf("unexpected report: %x", report)
+		}
+		writer := report[1]
+		seq := binary.LittleEndian.Uint32(report[2:6])
+		if seq != next[writer] {
+			t.Fatalf("writer %v: seq = %v, want %v", writer, seq, next[writer])
+		}
+		next[writer] += 1
+		received += 1
+		return received < writers * reports
+	})
+}
+
+func TestUpdateStateDuringReport(t *testing.T) {
+	const updates = 500
+	n := newTestNSProCon(t)
+	if err := n.SetReportRate(1000); err != nil {
+		t.Fatalf("can not set report rate: %v", err)
+	}
+	n.SetEventDrivenReport(true, time.Millisecond)
+	n.comState = comStateSubCommand
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < updates; i++ {
+			pressed := i % 2 == 0
+			state := &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ &message.GamepadButtonState{ Pressed: pressed } },
+				Axes: []float64{ float64(i % 3) - 1, 0, 0, float64(i % 3) - 1 },
+			}
+			if err := n.UpdateState(state); err != nil {
+				t.Errorf("can not update state: %v", err)
+				return
+			}
+			if err := n.UpdateMotion(&GamepadMotion{ AccelX: float64(i) }); err != nil {
+				t.Errorf("can not update motion: %v", err)
+				return
+			}
+		}
+	}()
+	doneCh := make(chan int)
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	runTestWriteReportLoop(t, n, func(report []byte) bool {
+		if report[0] != reportIdOutput30 {
+			t.Fatalf("unexpected report: %x", report)
+		}
+		select {
+		case <-doneCh:
+			return false
+		default:
+			return true
+		}
+	})
+}
+
+func TestListenerStartStop(t *testing.T) {
+	const rounds = 100
+	b := &BaseBackend{}
+	var wg sync.WaitGroup
+	stopCh := make(chan int)
+	for _, send := range []func(){
+		func() { b.SendVibration(&GamepadVibration{ Stopped: true }) },
+		func() { b.SendLights(&GamepadLights{}) },
+		func() { b.SendHandshake(&GamepadHandshake{}) },
+	} {
+		wg.Add(1)
+		go func(send func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				send()
+			}
+		}(send)
+	}
+	for i := 0; i < rounds; i++ {
+		b.StartVibrationListener(func(*GamepadVibration) {})
+		b.StartLightsListener(func(*GamepadLights) {})
+		b.StartHandshakeListener(func(*GamepadHandshake) {})
+		b.StopVibrationListener()
+		b.StopLightsListener()
+		b.StopHandshakeListener()
+		// stop without start does nothing
+		b.StopVibrationListener()
+	}
+	close(stopCh)
+	// senders do not block after the listeners stopped
+	waitCh := make(chan int)
+	go func() {
+		wg.Wait()
+		close(waitCh)
+	}()
+	select {
+	case <-waitCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("senders are blocked")
+	}
+}
@@ -0,0 +1,337 @@
+package gamepad
+
+//
+// subcommand handlers of switch controllers (output report 0x01 -> input report 0x21)
+//
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// the reply of spi flash read fits in an input report 0x21 of 64 bytes
+const spiMaxReadSize int = 0x1d
+
+// NSSubCommandRequest is a subcommand of output report 0x01.
+// Data is the bytes after the subcommand id.
+type NSSubCommandRequest struct {
+	SubCommand byte
+	Data       []byte
+}
+
+// NSSubCommandReply is written as input report 0x21 (ack, subcommand, data).
+type NSSubCommandReply struct {
+	Ack  byte
+	Data []byte
+}
+
+// returns nil if no reply
+type NSSubCommandHandler func(request *NSSubCommandRequest) *NSSubCommandReply
+
+type NSSubCommandStat struct {
+	Count    uint64
+	Unknown  uint64 // handled by the default handler
+	NoReply  uint64
+	LastTime time.Time
+}
+
+type SubCommandBackendIf interface {
+	SubCommandHandler(subCommand byte) NSSubCommandHandler
+	SetSubCommandHandler(subCommand byte, handler NSSubCommandHandler)
+	SetDefaultSubCommandHandler(handler NSSubCommandHandler)
+	SubCommandStats() map[byte]*NSSubCommandStat
+}
+
+// ack with or without the data of reply
+func NSSubCommandAck(subCommand byte, existsReplyData bool) byte {
+	ack := byte(0x80)
+	if existsReplyData {
+		ack |= subCommand
+	}
+	return ack
+}
+
+// zero padded if data is short
+func padSubCommandData(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	padded := make([]byte, size)
+	copy(padded, data)
+	return padded
+}
+
+func (n *NSProCon) genericSubCommand(request *NSSubCommandRequest) *NSSubCommandReply {
+	log.Printf("unsupported sub command, reply generic ack (%x): %x", request.SubCommand, request.Data)
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) bluetoothManualPairing(request *NSSubCommandRequest) *NSSubCommandReply {
+	// data[0:32] ???
+	// skip 0x81 01 01, 0x81 01 02
+	// last response only
+	return &NSSubCommandReply{
+		Ack: NSSubCommandAck(request.SubCommand, true),
+		Data: []byte{ 0x03 },
+	}
+}
+
+func (n *NSProCon) requestDeviceInfo(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.mutex.Lock()
+	data := make([]byte, 0, 12)
+	data = append(data, n.firmwareVersion...)
+	n.mutex.Unlock()
+	data = append(data, n.deviceType, 0x02)
+	data = append(data, n.reverseMacAddr...)
+	data = append(data, 0x03 /* ??? */, 0x02 /* default */)
+	return &NSSubCommandReply{
+		Ack: NSSubCommandAck(request.SubCommand, true),
+		Data: data,
+	}
+}
+
+func (n *NSProCon) setInputReportMode(request *NSSubCommandRequest) *NSSubCommandReply {
+	data := padSubCommandData(request.Data, 1)
+	if data[0] == 0x30 {
+		if n.verbose {
+			log.Printf("Standard full mode. Pushes current state @60Hz")
+		}
+	} else if data[0] == 0x31 {
+		if n.verbose {
+			log.Printf("NFC/IR mode. Pushes current state @60Hz")
+		}
+	}
+	n.mutex.Lock()
+	n.reportMode = data[0]
+	n.mutex.Unlock()
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) triggerButtonsElapsedTime(request *NSSubCommandRequest) *NSSubCommandReply {
+	return &NSSubCommandReply{ Ack: 0x83 /* from dump */ }
+}
+
+func (n *NSProCon) setHciState(request *NSSubCommandRequest) *NSSubCommandReply {
+	// data[0] = 0x00 Disconnect
+	// usb disconnect magic
+	// n.queueReport(stopCh, usbReportIdOutput81, []byte{ 0x01, 0x03 })
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) setShipmentLowPowerState(request *NSSubCommandRequest) *NSSubCommandReply {
+	// data[0] nothig to do
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) readSpi(request *NSSubCommandRequest) *NSSubCommandReply {
+	data := padSubCommandData(request.Data, 5)
+	addr := uint32(data[0]) | uint32(data[1]) << 8 | uint32(data[2]) << 16 | uint32(data[3]) << 24
+	if int(data[4]) > spiMaxReadSize {
+		log.Printf("can not read spi flash (%x:%x): too large size: %x", request.SubCommand, addr, data[4])
+		return &NSSubCommandReply{ Ack: 0x00 }
+	}
+	mem, err := n.spiFlash.read(addr, int(data[4]))
+	if err != nil {
+		log.Printf("can not read spi flash (%x:%x): %v", request.SubCommand, addr, err)
+		return &NSSubCommandReply{ Ack: 0x00 }
+	}
+	reply := make([]byte, 0, 5 + len(mem))
+	reply = append(reply, data[0:5]...)
+	reply = append(reply, mem...)
+	return &NSSubCommandReply{
+		Ack: NSSubCommandAck(request.SubCommand, true),
+		Data: reply,
+	}
+}
+
+func (n *NSProCon) writeSpi(request *NSSubCommandRequest) *NSSubCommandReply {
+	data := padSubCommandData(request.Data, 5)
+	addr := uint32(data[0]) | uint32(data[1]) << 8 | uint32(data[2]) << 16 | uint32(data[3]) << 24
+	size := int(data[4])
+	status := byte(0x00)
+	if 5 + size > len(request.Data) {
+		log.Printf("can not write spi flash (%x:%x): too short report: %v", request.SubCommand, addr, len(request.Data))
+		status = 0x01
+	} else if err := n.spiFlash.write(addr, request.Data[5:5 + size]); err != nil {
+		log.Printf("can not write spi flash (%x:%x): %v", request.SubCommand, addr, err)
+		status = 0x01
+	}
+	return &NSSubCommandReply{
+		Ack: NSSubCommandAck(request.SubCommand, false),
+		Data: []byte{ status },
+	}
+}
+
+func (n *NSProCon) eraseSpiSector(request *NSSubCommandRequest) *NSSubCommandReply {
+	data := padSubCommandData(request.Data, 4)
+	addr := uint32(data[0]) | uint32(data[1]) << 8 | uint32(data[2]) << 16 | uint32(data[3]) << 24
+	status := byte(0x00)
+	if err := n.spiFlash.eraseSector(addr); err != nil {
+		log.Printf("can not erase spi flash sector (%x:%x): %v", request.SubCommand, addr, err)
+		status = 0x01
+	}
+	return &NSSubCommandReply{
+		Ack: NSSubCommandAck(request.SubCommand, false),
+		Data: []byte{ status },
+	}
+}
+
+func (n *NSProCon) setNfcIrMcuConfiguration(request *NSSubCommandRequest) *NSSubCommandReply {
+	return &NSSubCommandReply{
+		Ack: 0xa0 /* from dump */,
+		Data: n.mcu.configure(request.Data),
+	}
+}
+
+func (n *NSProCon) setNfcIrMcuState(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.mcu.setState(padSubCommandData(request.Data, 1)[0])
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) setPlayerLights(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.SendLights(&GamepadLights{ PlayerLights: decodePlayerLights(padSubCommandData(request.Data, 1)[0]) })
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) subCommand33(request *NSSubCommandRequest) *NSSubCommandReply {
+	return &NSSubCommandReply{
+		Ack: 0x80 /* from dump */,
+		Data: []byte{ 0x03 /* XXX ???? */ },
+	}
+}
+
+func (n *NSProCon) setHomeLight(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.SendLights(&GamepadLights{ HomeLight: decodeHomeLight(request.Data) })
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) enableImu(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.mutex.Lock()
+	n.imuEnable = padSubCommandData(request.Data, 1)[0]
+	n.mutex.Unlock()
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) setImuSensitivity(request *NSSubCommandRequest) *NSSubCommandReply {
+	data := padSubCommandData(request.Data, 4)
+	n.mutex.Lock()
+	n.imuSensitivity.gyroSensitivity              = data[0]
+	n.imuSensitivity.accelerometerSensitivity     = data[1]
+	n.imuSensitivity.gyroPerformanceRate          = data[2]
+	n.imuSensitivity.accelerometerFilterBandwidth = data[3]
+	n.mutex.Unlock()
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) enableVibration(request *NSSubCommandRequest) *NSSubCommandReply {
+	n.mutex.Lock()
+	n.vibrationEnable = padSubCommandData(request.Data, 1)[0]
+	vibrationEnable := n.vibrationEnable
+	n.mutex.Unlock()
+	if n.verbose {
+		if vibrationEnable == 0 {
+			log.Printf("vibration disabled")
+		} else {
+			log.Printf("vibration enabled")
+		}
+	}
+	return &NSSubCommandReply{ Ack: NSSubCommandAck(request.SubCommand, false) }
+}
+
+func (n *NSProCon) defaultSubCommandHandlers() map[byte]NSSubCommandHandler {
+	return map[byte]NSSubCommandHandler{
+		subCommandBluetoothManualPairing: n.bluetoothManualPairing,
+		subCommandRequestDeviceInfo: n.requestDeviceInfo,
+		subCommandSetInputReportMode: n.setInputReportMode,
+		subCommandTriggerButtonsElapsedTime: n.triggerButtonsElapsedTime,
+		subCommandSetHciState: n.setHciState,
+		subCommandSetShipmentLowPowerState: n.setShipmentLowPowerState,
+		subCommandReadSpi: n.readSpi,
+		subCommandWriteSpi: n.writeSpi,
+		subCommandEraseSpiSector: n.eraseSpiSector,
+		subCommandSetNfcIrMcuConfiguration: n.setNfcIrMcuConfiguration,
+		subCommandSetNfcIrMcuState: n.setNfcIrMcuState,
+		subCommandSetPlayerLights: n.setPlayerLights,
+		subCommand33: n.subCommand33,
+		subCommandSetHomeLight: n.setHomeLight,
+		subCommandEnableImu: n.enableImu,
+		subCommandSetImuSensitivity: n.setImuSensitivity,
+		subCommandEnableVibration: n.enableVibration,
+	}
+}
+
+// returns the current handler to wrap it, nil if not registered
+func (n *NSProCon) SubCommandHandler(subCommand byte) NSSubCommandHandler {
+	n.subCommandMutex.Lock()
+	defer n.subCommandMutex.Unlock()
+	return n.subCommandHandlers[subCommand]
+}
+
+// nil handler unregisters, then the default handler is used
+func (n *NSProCon) SetSubCommandHandler(subCommand byte, handler NSSubCommandHandler) {
+	n.subCommandMutex.Lock()
+	defer n.subCommandMutex.Unlock()
+	if handler == nil {
+		delete(n.subCommandHandlers, subCommand)
+		return
+	}
+	n.subCommandHandlers[subCommand] = handler
+}
+
+// handler of unregistered subcommands, nil restores the generic ack
+func (n *NSProCon) SetDefaultSubCommandHandler(handler NSSubCommandHandler) {
+	n.subCommandMutex.Lock()
+	defer n.subCommandMutex.Unlock()
+	if handler == nil {
+		handler = n.genericSubCommand
+	}
+	n.defaultSubCommandHandler = handler
+}
+
+func (n *NSProCon) SubCommandStats() map[byte]*NSSubCommandStat {
+	n.subCommandMutex.Lock()
+	defer n.subCommandMutex.Unlock()
+	stats := make(map[byte]*NSSubCommandStat)
+	for subCommand, stat := range n.subCommandStats {
+		copied := *stat
+		stats[subCommand] = &copied
+	}
+	return stats
+}
+
+func (n *NSProCon) handleSubCommand(stopCh chan int, subCommand byte, data []byte) error {
+	request := &NSSubCommandRequest{
+		SubCommand: subCommand,
+		Data: make([]byte, len(data)),
+	}
+	copy(request.Data, data)
+	n.subCommandMutex.Lock()
+	handler, ok := n.subCommandHandlers[subCommand]
+	if !ok {
+		handler = n.defaultSubCommandHandler
+	}
+	stat, exists := n.subCommandStats[subCommand]
+	if !exists {
+		stat = &NSSubCommandStat{}
+		n.subCommandStats[subCommand] = stat
+	}
+	stat.Count += 1
+	stat.LastTime = time.Now()
+	if !ok {
+		stat.Unknown += 1
+	}
+	n.subCommandMutex.Unlock()
+	reply := handler(request)
+	if reply == nil {
+		n.subCommandMutex.Lock()
+		stat.NoReply += 1
+		n.subCommandMutex.Unlock()
+		return nil
+	}
+	err := n.queueReport(stopCh, reportIdOutput21, n.buildOutput21(reply.Ack, subCommand, reply.Data))
+	if err != nil {
+		return fmt.Errorf("can not queue reply of sub command (%x:%x): %w", reply.Ack, subCommand, err)
+	}
+	return nil
+}
@@ -1,75 +1,330 @@
 package gamepad
 
 //
-// XXX TODO
-// I don't have a PlayStation 4.
-// I want a PlayStation 5 rather than a PlayStation 4.
-// Perhaps I will never implement this in my lifetime.
+// DualShock 4 (CUH-ZCT1) over usb.
+// The PlayStation 4 itself also asks for the authentication feature reports (0xf0 - 0xf2),
+// which can not be answered without a real controller, so the main target is PC hosts
+// (steam, sdl, hid-playstation on linux, ...).
 //
 
 import(
         "fmt"
         "log"
+	"os"
+	"sync"
+	"time"
+	"encoding/hex"
 	"github.com/potix/regaprelay/gamepad/setup"
 	"github.com/potix/regapweb/message"
 )
 
+// Report IDs.
+const (
+	ps4ReportIdInput01               byte = 0x01
+	ps4ReportIdOutput05                   = 0x05
+	ps4ReportIdFeatureCalibration         = 0x02
+	ps4ReportIdFeaturePairingInfo         = 0x12
+	ps4ReportIdFeatureMacAddr             = 0x81
+	ps4ReportIdFeatureFirmwareInfo        = 0xa3
+)
+
+// Flags of the 0x05 output report.
+const (
+	ps4OutputFlagRumble   byte = 0x01
+	ps4OutputFlagLightbar      = 0x02
+	ps4OutputFlagFlash         = 0x04
+)
+
+// The real controller pushes the input report every 4 msec over usb.
+const ps4ReportInterval = 4 * time.Millisecond
+
+// Feature report lengths (excluding report id) declared by the report descriptor.
+var ps4FeatureReportLengths map[byte]int = map[byte]int{
+	0x02: 36, 0x04: 36, 0x08: 3,  0x10: 4,  0x11: 2,  0x12: 15,
+	0x13: 22, 0x14: 16, 0x15: 44, 0x80: 6,  0x81: 6,  0x82: 5,
+	0x83: 1,  0x84: 4,  0x85: 6,  0x86: 6,  0x87: 35, 0x88: 34,
+	0x89: 2,  0x90: 5,  0x91: 3,  0x92: 3,  0x93: 12, 0xa0: 6,
+	0xa1: 1,  0xa2: 1,  0xa3: 48, 0xa4: 13, 0xa5: 21, 0xa6: 21,
+	0xa7: 1,  0xa8: 1,  0xa9: 8,  0xaa: 1,  0xab: 57, 0xac: 57,
+	0xad: 11, 0xae: 1,  0xaf: 2,  0xb0: 63, 0xb1: 2,  0xb2: 2,
+	0xb3: 63, 0xb4: 63,
+}
+
 type PS4Con struct  {
 	*BaseBackend
-	setupParams *setup.UsbGadgetHidSetupParams
-	verbose     bool
-	devFilePath string
+	setupParams   *setup.UsbGadgetHidSetupParams
+	verbose       bool
+	macAddr       []byte
+	devFilePath   string
+	devFile       *os.File
+	startTime     time.Time
+	reportCounter byte
+	lastRumble    [2]byte
+	stopCh        chan int
+	mutex         sync.Mutex
+	controller    *sonyController
+}
+
+func (p *PS4Con) writeReport(f *os.File, reportId byte, reportBytes []byte) error {
+	buf := make([]byte, 64)
+	buf[0] = reportId
+	copy(buf[1:], reportBytes)
+	wl, err := f.Write(buf)
+	if err != nil {
+		return fmt.Errorf("can not write report (%x) to gadget device file: %w", reportId,  err)
+	}
+	if wl != len(buf) {
+		return fmt.Errorf("partial write report (%x) to gadget device file: write len = %v", reportId, wl)
+	}
+	return nil
+}
+
+func (p *PS4Con) buildFeatureReports() map[byte][]byte {
+	reports := make(map[byte][]byte)
+	for reportId, length := range ps4FeatureReportLengths {
+		reports[reportId] = make([]byte, length)
+	}
+	// mac address is little endian
+	reverseMacAddr := make([]byte, len(p.macAddr))
+	for i, b := range p.macAddr {
+		reverseMacAddr[len(p.macAddr) - 1 - i] = b
+	}
+	copy(reports[ps4ReportIdFeatureCalibration], sonyImuCalibration())
+	// pairing info: device mac address, class of device, host mac address
+	copy(reports[ps4ReportIdFeaturePairingInfo][0:6], reverseMacAddr)
+	copy(reports[ps4ReportIdFeaturePairingInfo][6:9], []byte{ 0x08, 0x25, 0x00 })
+	copy(reports[ps4ReportIdFeatureMacAddr][0:6], reverseMacAddr)
+	// firmware info: build date, build time, hardware version, firmware version
+	copy(reports[ps4ReportIdFeatureFirmwareInfo][0:16], "Sep 21 2018")
+	copy(reports[ps4ReportIdFeatureFirmwareInfo][16:32], "04:50:51")
+	copy(reports[ps4ReportIdFeatureFirmwareInfo][34:36], []byte{ 0x00, 0xb4 })
+	copy(reports[ps4ReportIdFeatureFirmwareInfo][40:42], []byte{ 0x1c, 0xa0 })
+	return reports
+}
+
+func (p *PS4Con) setupFeatureReports(f *os.File) {
+	for reportId, reportBytes := range p.buildFeatureReports() {
+		err := hidgSetGetReport(f, reportId, append([]byte{ reportId }, reportBytes...))
+		if err != nil {
+			// older kernel can not answer GET_REPORT
+			log.Printf("can not setup feature report in ps4con: %v", err)
+			return
+		}
+	}
+}
+
+func (p *PS4Con) readReportLoop(f *os.File) {
+	buf := make([]byte, 64)
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		default:
+		}
+		rl, err := f.Read(buf)
+		if err != nil {
+			log.Printf("can not read request report from gadget device file: %v", err)
+			return
+		}
+		if p.verbose {
+			log.Printf("read %x", buf[:rl])
+		}
+		switch buf[0] {
+		case ps4ReportIdOutput05:
+			if rl < 11 {
+				log.Printf("too short output report (05): %x", buf[:rl])
+				continue
+			}
+			if buf[1] & ps4OutputFlagRumble != 0 {
+				p.sendVibrationRequest(buf[4], buf[5])
+			}
+			if buf[1] & ps4OutputFlagLightbar != 0 && p.verbose {
+				log.Printf("lightbar r = %v, g = %v, b = %v", buf[6], buf[7], buf[8])
+			}
+			if buf[1] & ps4OutputFlagFlash != 0 && p.verbose {
+				log.Printf("lightbar flash on = %v, off = %v", buf[9], buf[10])
+			}
+		default:
+			log.Printf("unsupported output report (%x): %x", buf[0], buf[1:rl])
+		}
+	}
+}
+
+func (p *PS4Con) sendVibrationRequest(weak byte, strong byte) {
+	if p.lastRumble[0] == weak && p.lastRumble[1] == strong {
+		return
+	}
+	p.lastRumble[0] = weak
+	p.lastRumble[1] = strong
+	if p.verbose {
+		log.Printf("strong = %v, weak = %v", strong, weak)
+	}
+	vibrationMessage := newDualMotorVibration(strong, weak)
+	p.SendVibration(vibrationMessage)
+}
+
+func (p *PS4Con) buildInputReport() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	report := make([]byte, 63)
+	report[0] = sonyAxisToByte(p.controller.leftStick.x)
+	report[1] = sonyAxisToByte(p.controller.leftStick.y)
+	report[2] = sonyAxisToByte(p.controller.rightStick.x)
+	report[3] = sonyAxisToByte(p.controller.rightStick.y)
+	report[4] = sonyHat(p.controller.buttons)          |
+		    p.controller.buttons.square       << 4 |
+		    p.controller.buttons.cross        << 5 |
+		    p.controller.buttons.circle       << 6 |
+		    p.controller.buttons.triangle     << 7
+	report[5] = p.controller.buttons.l1               |
+		    p.controller.buttons.r1           << 1 |
+		    p.controller.buttons.l2           << 2 |
+		    p.controller.buttons.r2           << 3 |
+		    p.controller.buttons.share        << 4 |
+		    p.controller.buttons.options      << 5 |
+		    p.controller.leftStick.press      << 6 |
+		    p.controller.rightStick.press     << 7
+	report[6] = p.controller.buttons.ps               |
+		    p.controller.buttons.touchpad     << 1 |
+		    (p.reportCounter & 0x3f)          << 2
+	p.reportCounter += 1
+	report[7] = sonyTriggerToByte(p.controller.l2Value)
+	report[8] = sonyTriggerToByte(p.controller.r2Value)
+	// 5.33 usec unit
+	timestamp := uint16(time.Since(p.startTime).Microseconds() * 3 / 16)
+	report[9] = byte(timestamp & 0xff)
+	report[10] = byte(timestamp >> 8)
+	// report[11]: temperature, report[12:24]: gyro and accel
+	report[29] = 0x10 /* cable connected */ | 0x0b /* buttery full */
+	// touchpad: no finger
+	report[32] = 0x01
+	report[34] = 0x80
+	report[38] = 0x80
+	return report
+}
+
+func (p *PS4Con) writeInputReportLoop(f *os.File) {
+	ticker := time.NewTicker(ps4ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.RunFrameHooks()
+			err := p.writeReport(f, ps4ReportIdInput01, p.buildInputReport())
+			if err != nil {
+				log.Printf("can not write report (01) to gadget device file: %v", err)
+				return
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *PS4Con) AddGadgetFunctions(functions []*setup.UsbGadgetFunction) {
+	addGadgetFunctions(p.setupParams, functions)
+}
+
+func (p *PS4Con) GadgetHidDevFiles() (map[string]string, error) {
+	return gadgetHidDevFiles(p.setupParams, p.devFilePath)
 }
 
 func (p *PS4Con) Setup() error {
-        err := setup.UsbGadgetHidSetup(p.setupParams)
-        if err != nil {
-                return fmt.Errorf("setup error in ps4con: %w", err)
-        }
-        return nil
+	err := setup.UsbGadgetHidSetup(p.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not setup usb gadget hid device in ps4con: %w", err)
+	}
+	err = setup.UsbGadgetHidEnable(p.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not enable usb gadget hid device in ps4con: %w", err)
+	}
+	time.Sleep(time.Second)
+	p.devFilePath = resolveDevFilePath(p.setupParams, p.devFilePath)
+	_, err =  os.Stat(p.devFilePath)
+	if err != nil {
+		return fmt.Errorf("not found device file  (%v) in ps4con: %w", p.devFilePath, err)
+	}
+	return nil
 }
 
 func (p *PS4Con) Start() error {
-        err := setup.UsbGadgetHidEnable(p.setupParams)
+        f, err := os.OpenFile(p.devFilePath, os.O_RDWR, 0644)
         if err != nil {
-                return fmt.Errorf("can not enable usb gadget hid device in nsprocon: %w", err)
+                return fmt.Errorf("can not open device file (%v) in ps4con: %w", p.devFilePath, err)
         }
-        return nil
+	p.devFile = f
+	p.startTime = time.Now()
+	p.setupFeatureReports(f)
+	go p.readReportLoop(f)
+	go p.writeInputReportLoop(f)
+	return nil
 }
 
 func (p *PS4Con) Stop() {
-        err := setup.UsbGadgetHidDisable(p.setupParams)
-        if err != nil {
-                log.Printf("can not enable usb gadget hid device in nsprocon: %v", err)
-        }
+	close(p.stopCh)
+	p.devFile.Close()
+	err := setup.UsbGadgetHidDisable(p.setupParams)
+	if err != nil {
+		log.Printf("can not disable usb gadget hid device in ps4con: %v", err)
+	}
+	err = setup.UsbGadgetHidCleanup(p.setupParams)
+	if err != nil {
+		log.Printf("can not cleanup usb gadget hid device in ps4con: %v", err)
+	}
 }
 
 func (p *PS4Con) UpdateState(state *message.GamepadState) error {
-	// XXX TODO
-        return nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.updateState(state, "ps4con")
+	if p.verbose {
+		log.Printf("buttons = %+v, left stick = %+v, right stick = %+v, l2 = %v, r2 = %v",
+			p.controller.buttons, p.controller.leftStick, p.controller.rightStick, p.controller.l2Value, p.controller.r2Value)
+	}
+	return nil
 }
 
 func (p *PS4Con) Press(buttons []ButtonName) error {
-	// XXX TODO
-        return nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, button := range buttons {
+		err := p.controller.setButton(button, 1)
+		if err != nil {
+			return fmt.Errorf("can not press: %w", err)
+		}
+	}
+	return nil
 }
 
 func (p *PS4Con) Release(buttons []ButtonName) error {
-	// XXX TODO
-        return nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, button := range buttons {
+		err := p.controller.setButton(button, 0)
+		if err != nil {
+			return fmt.Errorf("can not release: %w", err)
+		}
+	}
+	return nil
 }
 
 func (p *PS4Con) StickL(xAxis float64, yAxis float64) error {
-	// XXX TODO
-        return nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.leftStick.x = xAxis
+	p.controller.leftStick.y = yAxis
+	return nil
 }
 
 func (p *PS4Con) StickR(xAxis float64, yAxis float64) error {
-	// XXX TODO
-        return nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.rightStick.x = xAxis
+	p.controller.rightStick.y = yAxis
+	return nil
 }
 
-func NewPS4Con(verbose bool, devFilePath string, configsHome string, udc string) *PS4Con {
+func NewPS4Con(verbose bool, macAddr string, devFilePath string, configsHome string, udc string) (*PS4Con, error) {
         setupParams := &setup.UsbGadgetHidSetupParams{
                 ConfigsHome:     configsHome,
                 GadgetName:      "ps4con",
@@ -94,13 +349,20 @@ func NewPS4Con(verbose bool, devFilePath string, configsHome string, udc string)
                 InstanceName:    "usb0",
                 Protocol:        "0",
                 Subclass:        "0",
-                ReportLength:    "499",
+                ReportLength:    "64",
                 ReportDesc:      "05010905A10185010930093109320935150026FF007508950481020939150025073500463B016514750495018142650005091901290E150025017501950E81020600FF0920750695011500257F8102050109330934150026FF007508950281020600FF09219536810285050922951F9102850409239524B102850209249524B102850809259503B102851009269504B102851109279502B10285120602FF0921950FB102851309229516B10285140605FF09209510B10285150921952CB1020680FF858009209506B102858109219506B102858209229505B102858309239501B102858409249504B102858509259506B102858609269506B102858709279523B102858809289522B102858909299502B102859009309505B102859109319503B102859209329503B10285930933950CB10285A009409506B10285A109419501B10285A209429501B10285A309439530B10285A40944950DB10285A509459515B10285A609469515B10285F00947953FB10285F10948953FB10285F20949950FB10285A7094A9501B10285A8094B9501B10285A9094C9508B10285AA094E9501B10285AB094F9539B10285AC09509539B10285AD0951950BB10285AE09529501B10285AF09539502B10285B00954953FB10285B109559502B10285B209569502B10285B30955953FB10285B40955953FB102C0",
 		UDC:             udc,
         }
-	defaultDevFilePath := "XXX"
-	if devFilePath == "" {
-		devFilePath = defaultDevFilePath
+	decodedMacAddr := make([]byte, 6)
+	if macAddr != "" {
+		var err error
+		decodedMacAddr, err = hex.DecodeString(macAddr)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode mac address string (%v): %w", macAddr, err)
+		}
+		if len(decodedMacAddr) != 6 {
+			return nil, fmt.Errorf("invalid mac address length (%v)", macAddr)
+		}
 	}
 	return &PS4Con{
 		BaseBackend: &BaseBackend{
@@ -108,6 +370,11 @@ func NewPS4Con(verbose bool, devFilePath string, configsHome string, udc string)
 		},
 		verbose: verbose,
 		setupParams: setupParams,
+		macAddr: decodedMacAddr,
 		devFilePath: devFilePath,
-	}
+		devFile: nil,
+		reportCounter: 0,
+		stopCh: make(chan int),
+		controller: newSonyController(),
+	}, nil
 }
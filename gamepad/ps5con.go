@@ -0,0 +1,460 @@
+package gamepad
+
+//
+// DualSense (CFI-ZCT1) over usb.
+// The input report 0x01 and the output report 0x02 are used over usb.
+// Bluetooth framed reports (0x31) are not declared in the usb report descriptor.
+//
+
+import(
+        "fmt"
+        "log"
+	"os"
+	"sync"
+	"time"
+	"encoding/hex"
+	"github.com/potix/regaprelay/gamepad/setup"
+	"github.com/potix/regapweb/message"
+)
+
+// Report IDs.
+const (
+	ps5ReportIdInput01               byte = 0x01
+	ps5ReportIdOutput02                   = 0x02
+	ps5ReportIdFeatureCalibration         = 0x05
+	ps5ReportIdFeaturePairingInfo         = 0x09
+	ps5ReportIdFeatureFirmwareInfo        = 0x20
+)
+
+// Flags of the output report.
+const (
+	ps5OutputFlag0CompatibleVibration byte = 0x01
+	ps5OutputFlag0HapticsSelect            = 0x02
+	ps5OutputFlag1MicMuteLed               = 0x01
+	ps5OutputFlag1LightbarControl          = 0x04
+	ps5OutputFlag1PlayerIndicatorControl   = 0x10
+)
+
+// player indicator patterns of the console (5 leds, bit 0 is the left led)
+var ps5PlayerLedsPatternMap map[byte]int = map[byte]int{
+	0x04: 1, 0x0a: 2, 0x15: 3, 0x1b: 4,
+}
+
+const (
+	ps5ReportInterval       = 4 * time.Millisecond
+	ps5InputReportLength    = 63
+	ps5OutputCommonLength   = 47
+)
+
+// Feature report lengths (excluding report id) declared by the report descriptor.
+var ps5FeatureReportLengths map[byte]int = map[byte]int{
+	0x05: 40, 0x08: 47, 0x09: 19, 0x0a: 26, 0x20: 63, 0x21: 4,
+	0x22: 63, 0x80: 63, 0x81: 63, 0x82: 9,  0x83: 63, 0x84: 63,
+	0x85: 2,  0xa0: 1,  0xe0: 63, 0xf0: 63, 0xf1: 63, 0xf2: 15,
+	0xf4: 63, 0xf5: 3,
+}
+
+type ps5OutputState struct {
+	motorRight   byte
+	motorLeft    byte
+	muteLight    *GamepadMuteLight
+	playerLights *GamepadPlayerLights
+	lightBar     *GamepadLightBar
+}
+
+// hosts repeat the lights in every output report, nil if nothing is changed
+func (o *ps5OutputState) changedLights(lights *GamepadLights) *GamepadLights {
+	if lights.MuteLight != nil && o.muteLight != nil && *lights.MuteLight == *o.muteLight {
+		lights.MuteLight = nil
+	} else if lights.MuteLight != nil {
+		o.muteLight = lights.MuteLight
+	}
+	if lights.PlayerLights != nil && o.playerLights != nil && *lights.PlayerLights == *o.playerLights {
+		lights.PlayerLights = nil
+	} else if lights.PlayerLights != nil {
+		o.playerLights = lights.PlayerLights
+	}
+	if lights.LightBar != nil && o.lightBar != nil && *lights.LightBar == *o.lightBar {
+		lights.LightBar = nil
+	} else if lights.LightBar != nil {
+		o.lightBar = lights.LightBar
+	}
+	if lights.MuteLight == nil && lights.PlayerLights == nil && lights.LightBar == nil {
+		return nil
+	}
+	return lights
+}
+
+type PS5Con struct  {
+	*BaseBackend
+	setupParams   *setup.UsbGadgetHidSetupParams
+	verbose       bool
+	macAddr       []byte
+	devFilePath   string
+	devFile       *os.File
+	startTime     time.Time
+	reportCounter byte
+	stopCh        chan int
+	mutex         sync.Mutex
+	controller    *sonyController
+	outputState   *ps5OutputState
+}
+
+func (p *PS5Con) writeReport(f *os.File, reportId byte, reportBytes []byte) error {
+	if len(reportBytes) + 1 > 64 {
+		return fmt.Errorf("too long report (%x): length = %v", reportId, len(reportBytes) + 1)
+	}
+	buf := make([]byte, 64)
+	buf[0] = reportId
+	copy(buf[1:], reportBytes)
+	wl, err := f.Write(buf)
+	if err != nil {
+		return fmt.Errorf("can not write report (%x) to gadget device file: %w", reportId,  err)
+	}
+	if wl != len(buf) {
+		return fmt.Errorf("partial write report (%x) to gadget device file: write len = %v", reportId, wl)
+	}
+	return nil
+}
+
+func (p *PS5Con) buildFeatureReports() map[byte][]byte {
+	reports := make(map[byte][]byte)
+	for reportId, length := range ps5FeatureReportLengths {
+		reports[reportId] = make([]byte, length)
+	}
+	// mac address is little endian
+	reverseMacAddr := make([]byte, len(p.macAddr))
+	for i, b := range p.macAddr {
+		reverseMacAddr[len(p.macAddr) - 1 - i] = b
+	}
+	copy(reports[ps5ReportIdFeatureCalibration], sonyImuCalibration())
+	// pairing info: device mac address, ...
+	copy(reports[ps5ReportIdFeaturePairingInfo][0:6], reverseMacAddr)
+	// firmware info: build date, build time, ..., hardware info, firmware version, ..., update version
+	copy(reports[ps5ReportIdFeatureFirmwareInfo][0:11], "Jun 19 2020")
+	copy(reports[ps5ReportIdFeatureFirmwareInfo][11:19], "09:02:34")
+	copy(reports[ps5ReportIdFeatureFirmwareInfo][23:27], []byte{ 0x11, 0x04, 0x00, 0x00 })
+	copy(reports[ps5ReportIdFeatureFirmwareInfo][27:31], []byte{ 0x2a, 0x00, 0x10, 0x01 })
+	copy(reports[ps5ReportIdFeatureFirmwareInfo][43:45], []byte{ 0x94, 0x02 })
+	return reports
+}
+
+func (p *PS5Con) setupFeatureReports(f *os.File) {
+	for reportId, reportBytes := range p.buildFeatureReports() {
+		err := hidgSetGetReport(f, reportId, append([]byte{ reportId }, reportBytes...))
+		if err != nil {
+			// older kernel can not answer GET_REPORT
+			log.Printf("can not setup feature report in ps5con: %v", err)
+			return
+		}
+	}
+}
+
+func (p *PS5Con) parseOutputCommon(common []byte) {
+	if len(common) < ps5OutputCommonLength {
+		log.Printf("too short output report: %x", common)
+		return
+	}
+	validFlag0 := common[0]
+	validFlag1 := common[1]
+	if validFlag0 & (ps5OutputFlag0CompatibleVibration | ps5OutputFlag0HapticsSelect) != 0 {
+		p.sendVibrationRequest(common[2], common[3])
+	}
+	// adaptive trigger effects (common[10:32]) are not forwarded
+	lights := decodePS5Lights(validFlag1, common)
+	if lights == nil {
+		return
+	}
+	lights = p.outputState.changedLights(lights)
+	if lights == nil {
+		return
+	}
+	if p.verbose {
+		log.Printf("lights = %+v", lights)
+	}
+	p.SendLights(lights)
+}
+
+// nil if the output report has no light
+func decodePS5Lights(validFlag1 byte, common []byte) *GamepadLights {
+	lights := &GamepadLights{}
+	updated := false
+	if validFlag1 & ps5OutputFlag1MicMuteLed != 0 {
+		lights.MuteLight = &GamepadMuteLight{ Mode: common[8] }
+		updated = true
+	}
+	if validFlag1 & ps5OutputFlag1PlayerIndicatorControl != 0 {
+		on := common[43] & 0x1f
+		player, ok := ps5PlayerLedsPatternMap[on]
+		if !ok {
+			player = 0
+		}
+		lights.PlayerLights = &GamepadPlayerLights{ Player: player, On: on }
+		updated = true
+	}
+	if validFlag1 & ps5OutputFlag1LightbarControl != 0 {
+		lights.LightBar = &GamepadLightBar{ Red: common[44], Green: common[45], Blue: common[46] }
+		updated = true
+	}
+	if !updated {
+		return nil
+	}
+	return lights
+}
+
+func (p *PS5Con) readReportLoop(f *os.File) {
+	buf := make([]byte, 128)
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		default:
+		}
+		rl, err := f.Read(buf)
+		if err != nil {
+			log.Printf("can not read request report from gadget device file: %v", err)
+			return
+		}
+		if p.verbose {
+			log.Printf("read %x", buf[:rl])
+		}
+		switch buf[0] {
+		case ps5ReportIdOutput02:
+			p.parseOutputCommon(buf[1:rl])
+		default:
+			log.Printf("unsupported output report (%x): %x", buf[0], buf[1:rl])
+		}
+	}
+}
+
+func (p *PS5Con) sendVibrationRequest(weak byte, strong byte) {
+	if p.outputState.motorRight == weak && p.outputState.motorLeft == strong {
+		return
+	}
+	p.outputState.motorRight = weak
+	p.outputState.motorLeft = strong
+	if p.verbose {
+		log.Printf("strong = %v, weak = %v", strong, weak)
+	}
+	vibrationMessage := newDualMotorVibration(strong, weak)
+	p.SendVibration(vibrationMessage)
+}
+
+func (p *PS5Con) buildInputReport() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	report := make([]byte, ps5InputReportLength)
+	report[0] = sonyAxisToByte(p.controller.leftStick.x)
+	report[1] = sonyAxisToByte(p.controller.leftStick.y)
+	report[2] = sonyAxisToByte(p.controller.rightStick.x)
+	report[3] = sonyAxisToByte(p.controller.rightStick.y)
+	report[4] = sonyTriggerToByte(p.controller.l2Value)
+	report[5] = sonyTriggerToByte(p.controller.r2Value)
+	report[6] = p.reportCounter
+	p.reportCounter += 1
+	report[7] = sonyHat(p.controller.buttons)          |
+		    p.controller.buttons.square       << 4 |
+		    p.controller.buttons.cross        << 5 |
+		    p.controller.buttons.circle       << 6 |
+		    p.controller.buttons.triangle     << 7
+	report[8] = p.controller.buttons.l1               |
+		    p.controller.buttons.r1           << 1 |
+		    p.controller.buttons.l2           << 2 |
+		    p.controller.buttons.r2           << 3 |
+		    p.controller.buttons.share        << 4 |
+		    p.controller.buttons.options      << 5 |
+		    p.controller.leftStick.press      << 6 |
+		    p.controller.rightStick.press     << 7
+	report[9] = p.controller.buttons.ps               |
+		    p.controller.buttons.touchpad     << 1 |
+		    p.controller.buttons.mute         << 2
+	// report[15:27]: gyro and accel
+	// 0.33 usec unit
+	timestamp := uint32(time.Since(p.startTime).Microseconds() * 3)
+	report[27] = byte(timestamp & 0xff)
+	report[28] = byte((timestamp >> 8) & 0xff)
+	report[29] = byte((timestamp >> 16) & 0xff)
+	report[30] = byte((timestamp >> 24) & 0xff)
+	// touchpad: no finger
+	report[32] = 0x80
+	report[36] = 0x80
+	report[52] = 0x20 /* charging complete */ | 0x0a /* buttery full */
+	return report
+}
+
+func (p *PS5Con) writeInputReportLoop(f *os.File) {
+	ticker := time.NewTicker(ps5ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.RunFrameHooks()
+			err := p.writeReport(f, ps5ReportIdInput01, p.buildInputReport())
+			if err != nil {
+				log.Printf("can not write report (01) to gadget device file: %v", err)
+				return
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *PS5Con) AddGadgetFunctions(functions []*setup.UsbGadgetFunction) {
+	addGadgetFunctions(p.setupParams, functions)
+}
+
+func (p *PS5Con) GadgetHidDevFiles() (map[string]string, error) {
+	return gadgetHidDevFiles(p.setupParams, p.devFilePath)
+}
+
+func (p *PS5Con) Setup() error {
+	err := setup.UsbGadgetHidSetup(p.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not setup usb gadget hid device in ps5con: %w", err)
+	}
+	err = setup.UsbGadgetHidEnable(p.setupParams)
+	if err != nil {
+		return fmt.Errorf("can not enable usb gadget hid device in ps5con: %w", err)
+	}
+	time.Sleep(time.Second)
+	p.devFilePath = resolveDevFilePath(p.setupParams, p.devFilePath)
+	_, err =  os.Stat(p.devFilePath)
+	if err != nil {
+		return fmt.Errorf("not found device file  (%v) in ps5con: %w", p.devFilePath, err)
+	}
+	return nil
+}
+
+func (p *PS5Con) Start() error {
+        f, err := os.OpenFile(p.devFilePath, os.O_RDWR, 0644)
+        if err != nil {
+                return fmt.Errorf("can not open device file (%v) in ps5con: %w", p.devFilePath, err)
+        }
+	p.devFile = f
+	p.startTime = time.Now()
+	p.setupFeatureReports(f)
+	go p.readReportLoop(f)
+	go p.writeInputReportLoop(f)
+	return nil
+}
+
+func (p *PS5Con) Stop() {
+	close(p.stopCh)
+	p.devFile.Close()
+	err := setup.UsbGadgetHidDisable(p.setupParams)
+	if err != nil {
+		log.Printf("can not disable usb gadget hid device in ps5con: %v", err)
+	}
+	err = setup.UsbGadgetHidCleanup(p.setupParams)
+	if err != nil {
+		log.Printf("can not cleanup usb gadget hid device in ps5con: %v", err)
+	}
+}
+
+func (p *PS5Con) UpdateState(state *message.GamepadState) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.updateState(state, "ps5con")
+	if p.verbose {
+		log.Printf("buttons = %+v, left stick = %+v, right stick = %+v, l2 = %v, r2 = %v",
+			p.controller.buttons, p.controller.leftStick, p.controller.rightStick, p.controller.l2Value, p.controller.r2Value)
+	}
+	return nil
+}
+
+func (p *PS5Con) Press(buttons []ButtonName) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, button := range buttons {
+		err := p.controller.setButton(button, 1)
+		if err != nil {
+			return fmt.Errorf("can not press: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *PS5Con) Release(buttons []ButtonName) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, button := range buttons {
+		err := p.controller.setButton(button, 0)
+		if err != nil {
+			return fmt.Errorf("can not release: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *PS5Con) StickL(xAxis float64, yAxis float64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.leftStick.x = xAxis
+	p.controller.leftStick.y = yAxis
+	return nil
+}
+
+func (p *PS5Con) StickR(xAxis float64, yAxis float64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.controller.rightStick.x = xAxis
+	p.controller.rightStick.y = yAxis
+	return nil
+}
+
+func NewPS5Con(verbose bool, macAddr string, devFilePath string, configsHome string, udc string) (*PS5Con, error) {
+        setupParams := &setup.UsbGadgetHidSetupParams{
+                ConfigsHome:     configsHome,
+                GadgetName:      "ps5con",
+                IdProduct:       "0x0ce6",
+                IdVendor:        "0x054c",
+                BcdDevice:       "0x0100",
+                BcdUsb:          "0x0200",
+                BMaxPacketSize0: "64",
+                BDeviceProtocol: "0",
+                BDeviceSubClass: "0",
+                BDeviceClass:    "0",
+                StringsLang:     "0x409",
+                ISerial:         "0",
+                IProduct:        "DualSense Wireless Controller",
+                IManufacturer:   "Sony Interactive Entertainment",
+                ConfigName:      "c",
+                ConfigNumber:    "1",
+                ConfigString:    "Play Station 5 Controller",
+                BmAttributes:    "0xc0",
+                MaxPower:        "500",
+                FunctionName:    "hid",
+                InstanceName:    "usb0",
+                Protocol:        "0",
+                Subclass:        "0",
+                ReportLength:    "64",
+                ReportDesc:      "05010905A1018501093009310932093509330934150026FF007508950681020600FF09209501810205010939150025073500463B016514750495018142650005091901290F150025017501950F81020600FF0921950D81020600FF0922150026FF0075089534810285020923953F9102850509339528B10285080934952FB102850909249513B102850A0925951AB10285200926953FB102852109279504B10285220940953FB10285800928953FB10285810929953FB1028582092A9509B1028583092B953FB1028584092C953FB1028585092D9502B10285A0092E9501B10285E0092F953FB10285F00930953FB10285F10931953FB10285F20932950FB10285F40935953FB10285F509369503B102C0",
+		UDC:             udc,
+        }
+	decodedMacAddr := make([]byte, 6)
+	if macAddr != "" {
+		var err error
+		decodedMacAddr, err = hex.DecodeString(macAddr)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode mac address string (%v): %w", macAddr, err)
+		}
+		if len(decodedMacAddr) != 6 {
+			return nil, fmt.Errorf("invalid mac address length (%v)", macAddr)
+		}
+	}
+	return &PS5Con{
+		BaseBackend: &BaseBackend{
+			verbose: verbose,
+		},
+		verbose: verbose,
+		setupParams: setupParams,
+		macAddr: decodedMacAddr,
+		devFilePath: devFilePath,
+		devFile: nil,
+		reportCounter: 0,
+		stopCh: make(chan int),
+		controller: newSonyController(),
+		outputState: &ps5OutputState{},
+	}, nil
+}
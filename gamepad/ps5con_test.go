@@ -0,0 +1,93 @@
+package gamepad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testPS5OutputCommon(validFlag1 byte, mute byte, playerLeds byte, red byte, green byte, blue byte) []byte {
+	common := make([]byte, ps5OutputCommonLength)
+	common[1] = validFlag1
+	common[8] = mute
+	common[43] = playerLeds
+	common[44] = red
+	common[45] = green
+	common[46] = blue
+	return common
+}
+
+func TestDecodePS5Lights(t *testing.T) {
+	tests := []struct {
+		name   string
+		common []byte
+		want   *GamepadLights
+	}{
+		{
+			name: "no lights",
+			common: testPS5OutputCommon(0x00, 1, 0x04, 0xff, 0x00, 0x00),
+			want: nil,
+		},
+		{
+			name: "mute",
+			common: testPS5OutputCommon(ps5OutputFlag1MicMuteLed, 2, 0x00, 0x00, 0x00, 0x00),
+			want: &GamepadLights{ MuteLight: &GamepadMuteLight{ Mode: 2 } },
+		},
+		{
+			name: "player 2",
+			common: testPS5OutputCommon(ps5OutputFlag1PlayerIndicatorControl, 0, 0x0a, 0x00, 0x00, 0x00),
+			want: &GamepadLights{ PlayerLights: &GamepadPlayerLights{ Player: 2, On: 0x0a } },
+		},
+		{
+			name: "unknown player pattern",
+			common: testPS5OutputCommon(ps5OutputFlag1PlayerIndicatorControl, 0, 0x21, 0x00, 0x00, 0x00),
+			want: &GamepadLights{ PlayerLights: &GamepadPlayerLights{ Player: 0, On: 0x01 } },
+		},
+		{
+			name: "light bar",
+			common: testPS5OutputCommon(ps5OutputFlag1LightbarControl, 0, 0x00, 0x00, 0x00, 0x40),
+			want: &GamepadLights{ LightBar: &GamepadLightBar{ Red: 0x00, Green: 0x00, Blue: 0x40 } },
+		},
+		{
+			name: "all",
+			common: testPS5OutputCommon(ps5OutputFlag1MicMuteLed | ps5OutputFlag1PlayerIndicatorControl | ps5OutputFlag1LightbarControl, 1, 0x1b, 0x10, 0x20, 0x30),
+			want: &GamepadLights{
+				PlayerLights: &GamepadPlayerLights{ Player: 4, On: 0x1b },
+				LightBar: &GamepadLightBar{ Red: 0x10, Green: 0x20, Blue: 0x30 },
+				MuteLight: &GamepadMuteLight{ Mode: 1 },
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodePS5Lights(tt.common[1], tt.common); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodePS5Lights() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPS5ChangedLights(t *testing.T) {
+	lightBar := func(blue byte) *GamepadLightBar {
+		return &GamepadLightBar{ Blue: blue }
+	}
+	tests := []struct {
+		name   string
+		lights *GamepadLights
+		want   *GamepadLights
+	}{
+		{ name: "first", lights: &GamepadLights{ LightBar: lightBar(0x40) }, want: &GamepadLights{ LightBar: lightBar(0x40) } },
+		{ name: "same", lights: &GamepadLights{ LightBar: lightBar(0x40) }, want: nil },
+		{
+			name: "same and new",
+			lights: &GamepadLights{ LightBar: lightBar(0x40), MuteLight: &GamepadMuteLight{ Mode: 1 } },
+			want: &GamepadLights{ MuteLight: &GamepadMuteLight{ Mode: 1 } },
+		},
+		{ name: "changed", lights: &GamepadLights{ LightBar: lightBar(0x80) }, want: &GamepadLights{ LightBar: lightBar(0x80) } },
+	}
+	o := &ps5OutputState{}
+	for _, tt := range tests {
+		if got := o.changedLights(tt.lights); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: changedLights() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
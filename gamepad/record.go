@@ -0,0 +1,256 @@
+package gamepad
+
+//
+// record and replay of gamepad state streams (json lines)
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+const (
+	recordFileTimeFormat string = "20060102-150405"
+)
+
+type RecordEntry struct {
+	Time  time.Time             `json:"time"`
+	State *message.GamepadState `json:"state"`
+}
+
+type recorder struct {
+	filePath string
+	file     *os.File
+	writer   *bufio.Writer
+	encoder  *json.Encoder
+	mutex    sync.Mutex
+}
+
+func (r *recorder) record(state *message.GamepadState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.encoder.Encode(&RecordEntry{ Time: time.Now(), State: state })
+	if err != nil {
+		return fmt.Errorf("can not write record entry (%v): %w", r.filePath, err)
+	}
+	// entries are kept on crash
+	err = r.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("can not flush record file (%v): %w", r.filePath, err)
+	}
+	return nil
+}
+
+func (r *recorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.writer.Flush()
+	if err != nil {
+		r.file.Close()
+		return fmt.Errorf("can not flush record file (%v): %w", r.filePath, err)
+	}
+	return r.file.Close()
+}
+
+// file name is the time of start in dirPath
+func newRecorder(dirPath string) (*recorder, error) {
+	err := os.MkdirAll(dirPath, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("can not create record dir (%v): %w", dirPath, err)
+	}
+	filePath := filepath.Join(dirPath, "gamepad-" + time.Now().Format(recordFileTimeFormat) + ".jsonl")
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can not open record file (%v): %w", filePath, err)
+	}
+	writer := bufio.NewWriter(file)
+	return &recorder{
+		filePath: filePath,
+		file: file,
+		writer: writer,
+		encoder: json.NewEncoder(writer),
+	}, nil
+}
+
+// returns path of the record file
+func (g *Gamepad) StartRecording(dirPath string) (string, error) {
+	newRecorder, err := newRecorder(dirPath)
+	if err != nil {
+		return "", fmt.Errorf("can not create recorder: %w", err)
+	}
+	g.StopRecording()
+	g.recorderMutex.Lock()
+	defer g.recorderMutex.Unlock()
+	g.recorder = newRecorder
+	if g.verbose {
+		log.Printf("start recording: %v", newRecorder.filePath)
+	}
+	return newRecorder.filePath, nil
+}
+
+func (g *Gamepad) StopRecording() {
+	g.recorderMutex.Lock()
+	defer g.recorderMutex.Unlock()
+	if g.recorder == nil {
+		return
+	}
+	if err := g.recorder.close(); err != nil {
+		log.Printf("can not close recorder: %v", err)
+	}
+	if g.verbose {
+		log.Printf("stop recording: %v", g.recorder.filePath)
+	}
+	g.recorder = nil
+}
+
+func (g *Gamepad) recordState(state *message.GamepadState) {
+	g.recorderMutex.Lock()
+	defer g.recorderMutex.Unlock()
+	if g.recorder == nil {
+		return
+	}
+	if err := g.recorder.record(state); err != nil {
+		log.Printf("can not record state: %v", err)
+	}
+}
+
+func LoadRecord(filePath string) ([]*RecordEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can not open record file (%v): %w", filePath, err)
+	}
+	defer file.Close()
+	entries := make([]*RecordEntry, 0)
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		entry := new(RecordEntry)
+		err := decoder.Decode(entry)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode record entry (%v): %w", filePath, err)
+		}
+		if entry.State == nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type replayerOptions struct {
+        verbose bool
+        speed   float64
+}
+
+func defaultReplayerOptions() *replayerOptions {
+        return &replayerOptions {
+                verbose: false,
+                speed: 1.0,
+        }
+}
+
+type ReplayerOption func(*replayerOptions)
+
+func ReplayerVerbose(verbose bool) ReplayerOption {
+        return func(opts *replayerOptions) {
+                opts.verbose = verbose
+        }
+}
+
+// 2.0 is twice as fast as the original, <= 0 is ignored
+func ReplayerSpeed(speed float64) ReplayerOption {
+        return func(opts *replayerOptions) {
+		if speed <= 0 {
+			return
+		}
+                opts.speed = speed
+        }
+}
+
+type Replayer struct {
+	verbose  bool
+	gamepad  *Gamepad
+	filePath string
+	speed    float64
+	entries  []*RecordEntry
+	stopOnce sync.Once
+	stopCh   chan int
+	doneCh   chan int
+}
+
+func (r *Replayer) replayLoop() {
+	defer close(r.doneCh)
+	if r.verbose {
+		log.Printf("start replay: %v (%v entries)", r.filePath, len(r.entries))
+		defer log.Printf("stop replay: %v", r.filePath)
+	}
+	if len(r.entries) == 0 {
+		return
+	}
+	startTime := time.Now()
+	firstTime := r.entries[0].Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for _, entry := range r.entries {
+		offset := time.Duration(float64(entry.Time.Sub(firstTime)) / r.speed)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(startTime.Add(offset)))
+		select {
+		case <-timer.C:
+		case <-r.stopCh:
+			return
+		}
+		// replayed states are not recorded again
+		if err := r.gamepad.updateState(entry.State); err != nil {
+			log.Printf("can not update state: %v", err)
+		}
+	}
+}
+
+func (r *Replayer) Start() {
+	go r.replayLoop()
+}
+
+func (r *Replayer) Stop() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+	<-r.doneCh
+}
+
+// closed when all entries are replayed or stopped
+func (r *Replayer) Done() <-chan int {
+	return r.doneCh
+}
+
+func NewReplayer(gpad *Gamepad, filePath string, opts ...ReplayerOption) (*Replayer, error) {
+        baseOpts := defaultReplayerOptions()
+        for _, opt := range opts {
+                if opt == nil {
+                        continue
+                }
+                opt(baseOpts)
+        }
+	entries, err := LoadRecord(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can not load record: %w", err)
+	}
+	return &Replayer{
+		verbose: baseOpts.verbose,
+		gamepad: gpad,
+		filePath: filePath,
+		speed: baseOpts.speed,
+		entries: entries,
+		stopCh: make(chan int),
+		doneCh: make(chan int),
+	}, nil
+}
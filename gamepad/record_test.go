@@ -0,0 +1,85 @@
+package gamepad
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+func TestRecordReplayRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []*message.GamepadState
+	}{
+		{
+			name: "empty",
+			states: []*message.GamepadState{},
+		},
+		{
+			name: "buttons and axes",
+			states: []*message.GamepadState{
+				&message.GamepadState{
+					GamepadId: "g",
+					Buttons: []*message.GamepadButtonState{ &message.GamepadButtonState{ Pressed: true, Value: 1 } },
+					Axes: []float64{ 0.5, -0.5, 0, 0 },
+				},
+				&message.GamepadState{
+					GamepadId: "g",
+					Buttons: []*message.GamepadButtonState{ &message.GamepadButtonState{}, &message.GamepadButtonState{ Pressed: true, Touched: true, Value: 0.75 } },
+					Axes: []float64{ 0, 0, -1, 1 },
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, backend := newTestGamepad(t)
+			filePath, err := g.StartRecording(t.TempDir())
+			if err != nil {
+				t.Fatalf("can not start recording: %v", err)
+			}
+			for _, state := range tt.states {
+				if err := g.UpdateState(state); err != nil {
+					t.Fatalf("can not update state: %v", err)
+				}
+			}
+			// entries are flushed without stop
+			entries, err := LoadRecord(filePath)
+			if err != nil {
+				t.Fatalf("can not load record: %v", err)
+			}
+			if len(entries) != len(tt.states) {
+				t.Fatalf("entries = %v, want %v", len(entries), len(tt.states))
+			}
+			for i, entry := range entries {
+				if !reflect.DeepEqual(entry.State, tt.states[i]) {
+					t.Errorf("entry %v: state = %+v, want %+v", i, entry.State, tt.states[i])
+				}
+			}
+			backend.state = nil
+			replayer, err := NewReplayer(g, filePath, ReplayerSpeed(100))
+			if err != nil {
+				t.Fatalf("can not create replayer: %v", err)
+			}
+			replayer.Start()
+			select {
+			case <-replayer.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("replay is not done")
+			}
+			g.StopRecording()
+			if len(tt.states) > 0 && !reflect.DeepEqual(backend.state, tt.states[len(tt.states) - 1]) {
+				t.Errorf("replayed state = %+v, want %+v", backend.state, tt.states[len(tt.states) - 1])
+			}
+			// replayed states are not recorded again
+			entries, err = LoadRecord(filePath)
+			if err != nil {
+				t.Fatalf("can not load record: %v", err)
+			}
+			if len(entries) != len(tt.states) {
+				t.Errorf("entries after replay = %v, want %v", len(entries), len(tt.states))
+			}
+		})
+	}
+}
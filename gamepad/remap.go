@@ -0,0 +1,73 @@
+package gamepad
+
+//
+// remapping of W3C gamepad indices applied before backends
+//
+
+import (
+	"math"
+	"github.com/potix/regapweb/message"
+)
+
+// RemapProfile is a named remapping of buttons and axes.
+//   ButtonMap:  source button index -> destination button index (-1 = drop)
+//   AxisMap:    source axis index -> destination axis index (-1 = drop)
+//   InvertAxes: destination axis indices to invert
+// unmapped indices are passed through as is.
+type RemapProfile struct {
+	Name       string
+	ButtonMap  map[int]int
+	AxisMap    map[int]int
+	InvertAxes []int
+}
+
+func (r *RemapProfile) apply(state *message.GamepadState) *message.GamepadState {
+	if r == nil {
+		return state
+	}
+	remapped := &message.GamepadState{
+		DelivererId: state.DelivererId,
+		ControllerId: state.ControllerId,
+		GamepadId: state.GamepadId,
+		Buttons: make([]*message.GamepadButtonState, 0, len(state.Buttons)),
+		Axes: make([]float64, 0, len(state.Axes)),
+	}
+	for i, button := range state.Buttons {
+		dst, ok := r.ButtonMap[i]
+		if !ok {
+			dst = i
+		}
+		if dst < 0 || button == nil {
+			continue
+		}
+		for len(remapped.Buttons) <= dst {
+			remapped.Buttons = append(remapped.Buttons, &message.GamepadButtonState{})
+		}
+		// several buttons can be mapped to one button
+		merged := remapped.Buttons[dst]
+		remapped.Buttons[dst] = &message.GamepadButtonState{
+			Pressed: merged.Pressed || button.Pressed,
+			Touched: merged.Touched || button.Touched,
+			Value: math.Max(merged.Value, button.Value),
+		}
+	}
+	for i, axis := range state.Axes {
+		dst, ok := r.AxisMap[i]
+		if !ok {
+			dst = i
+		}
+		if dst < 0 {
+			continue
+		}
+		for len(remapped.Axes) <= dst {
+			remapped.Axes = append(remapped.Axes, 0)
+		}
+		remapped.Axes[dst] = axis
+	}
+	for _, i := range r.InvertAxes {
+		if i >= 0 && i < len(remapped.Axes) {
+			remapped.Axes[i] *= -1.0
+		}
+	}
+	return remapped
+}
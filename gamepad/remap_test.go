@@ -0,0 +1,85 @@
+package gamepad
+
+import (
+	"reflect"
+	"testing"
+	"github.com/potix/regapweb/message"
+)
+
+func testButtons(pressed ...bool) []*message.GamepadButtonState {
+	buttons := make([]*message.GamepadButtonState, 0, len(pressed))
+	for _, p := range pressed {
+		value := 0.0
+		if p {
+			value = 1.0
+		}
+		buttons = append(buttons, &message.GamepadButtonState{ Pressed: p, Value: value })
+	}
+	return buttons
+}
+
+func TestRemapProfileApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *RemapProfile
+		state   *message.GamepadState
+		want    *message.GamepadState
+	}{
+		{
+			name: "nil",
+			profile: nil,
+			state: &message.GamepadState{ Buttons: testButtons(true, false), Axes: []float64{ 0.5 } },
+			want: &message.GamepadState{ Buttons: testButtons(true, false), Axes: []float64{ 0.5 } },
+		},
+		{
+			name: "pass through",
+			profile: &RemapProfile{},
+			state: &message.GamepadState{ GamepadId: "g", Buttons: testButtons(true, false), Axes: []float64{ 0.5, -0.5 } },
+			want: &message.GamepadState{ GamepadId: "g", Buttons: testButtons(true, false), Axes: []float64{ 0.5, -0.5 } },
+		},
+		{
+			name: "swap buttons",
+			profile: &RemapProfile{ ButtonMap: map[int]int{ 0: 1, 1: 0 } },
+			state: &message.GamepadState{ Buttons: testButtons(true, false), Axes: []float64{} },
+			want: &message.GamepadState{ Buttons: testButtons(false, true), Axes: []float64{} },
+		},
+		{
+			name: "drop button",
+			profile: &RemapProfile{ ButtonMap: map[int]int{ 1: -1 } },
+			state: &message.GamepadState{ Buttons: testButtons(false, true, true), Axes: []float64{} },
+			want: &message.GamepadState{ Buttons: testButtons(false, false, true), Axes: []float64{} },
+		},
+		{
+			name: "merge buttons",
+			profile: &RemapProfile{ ButtonMap: map[int]int{ 2: 0 } },
+			state: &message.GamepadState{ Buttons: testButtons(false, false, true), Axes: []float64{} },
+			want: &message.GamepadState{ Buttons: testButtons(true, false), Axes: []float64{} },
+		},
+		{
+			name: "button to higher index",
+			profile: &RemapProfile{ ButtonMap: map[int]int{ 0: 3 } },
+			state: &message.GamepadState{ Buttons: testButtons(true), Axes: []float64{} },
+			want: &message.GamepadState{ Buttons: testButtons(false, false, false, true), Axes: []float64{} },
+		},
+		{
+			name: "swap and invert axes",
+			profile: &RemapProfile{ AxisMap: map[int]int{ 0: 1, 1: 0 }, InvertAxes: []int{ 1, 5 } },
+			state: &message.GamepadState{ Buttons: testButtons(), Axes: []float64{ 0.25, 0.75 } },
+			want: &message.GamepadState{ Buttons: testButtons(), Axes: []float64{ 0.75, -0.25 } },
+		},
+		{
+			name: "drop axis",
+			profile: &RemapProfile{ AxisMap: map[int]int{ 0: -1 } },
+			state: &message.GamepadState{ Buttons: testButtons(), Axes: []float64{ 0.25, 0.75 } },
+			want: &message.GamepadState{ Buttons: testButtons(), Axes: []float64{ 0, 0.75 } },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.profile.apply(tt.state)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = buttons %+v, axes %v, want buttons %+v, axes %v", got.Buttons, got.Axes, tt.want.Buttons, tt.want.Axes)
+			}
+		})
+	}
+}
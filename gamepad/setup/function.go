@@ -0,0 +1,132 @@
+package setup
+
+//
+// functions of composite usb gadget
+//
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const sysDevCharDir = "/sys/dev/char"
+
+// attributes are written in order, hex value is decoded to binary (e.g. report_desc)
+type UsbGadgetAttribute struct {
+	Name  string
+	Value string
+	Hex   bool
+}
+
+// e.g. hid.usb1, acm.usb0, ecm.usb0
+type UsbGadgetFunction struct {
+	FunctionName string
+	InstanceName string
+	Attributes   []*UsbGadgetAttribute
+}
+
+func (f *UsbGadgetFunction) dirName() string {
+	return f.FunctionName + "." + f.InstanceName
+}
+
+func NewUsbGadgetHidFunction(instanceName string, protocol string, subclass string, reportLength string, reportDesc string) *UsbGadgetFunction {
+	return &UsbGadgetFunction{
+		FunctionName: "hid",
+		InstanceName: instanceName,
+		Attributes: []*UsbGadgetAttribute{
+			&UsbGadgetAttribute{ Name: "protocol", Value: protocol },
+			&UsbGadgetAttribute{ Name: "subclass", Value: subclass },
+			&UsbGadgetAttribute{ Name: "report_length", Value: reportLength },
+			&UsbGadgetAttribute{ Name: "report_desc", Value: reportDesc, Hex: true },
+		},
+	}
+}
+
+// serial console, /dev/ttyGS<N> on the device
+func NewUsbGadgetAcmFunction(instanceName string) *UsbGadgetFunction {
+	return &UsbGadgetFunction{
+		FunctionName: "acm",
+		InstanceName: instanceName,
+		Attributes: []*UsbGadgetAttribute{},
+	}
+}
+
+// ethernet, empty address is random
+func NewUsbGadgetEcmFunction(instanceName string, hostAddr string, devAddr string) *UsbGadgetFunction {
+	attrs := make([]*UsbGadgetAttribute, 0, 2)
+	if hostAddr != "" {
+		attrs = append(attrs, &UsbGadgetAttribute{ Name: "host_addr", Value: hostAddr })
+	}
+	if devAddr != "" {
+		attrs = append(attrs, &UsbGadgetAttribute{ Name: "dev_addr", Value: devAddr })
+	}
+	return &UsbGadgetFunction{
+		FunctionName: "ecm",
+		InstanceName: instanceName,
+		Attributes: attrs,
+	}
+}
+
+// attributes of existing function dir differ from desired values
+func (f *UsbGadgetFunction) attributesChanged(functionsDir string) (bool, error) {
+	for _, attr := range f.Attributes {
+		filePath := path.Join(functionsDir, attr.Name)
+		current, err := os.ReadFile(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return true, nil
+			}
+			return false, fmt.Errorf("can not read file (%v): %w", filePath, err)
+		}
+		if attr.Hex {
+			value, err := hex.DecodeString(attr.Value)
+			if err != nil {
+				return false, fmt.Errorf("can not decode hex string (%v): %w", attr.Value, err)
+			}
+			if !bytes.Equal(current, value) {
+				return true, nil
+			}
+		} else if !sameAttrValue(current, []byte(attr.Value)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// primary hid function and extra functions
+func (params *UsbGadgetHidSetupParams) functions() []*UsbGadgetFunction {
+	primary := NewUsbGadgetHidFunction(params.InstanceName, params.Protocol, params.Subclass, params.ReportLength, params.ReportDesc)
+	primary.FunctionName = params.FunctionName
+	functions := []*UsbGadgetFunction{ primary }
+	return append(functions, params.Functions...)
+}
+
+func (params *UsbGadgetHidSetupParams) functionsDir() string {
+	return path.Join(params.ConfigsHome, usbGadgetDir, params.GadgetName, "functions")
+}
+
+// UsbGadgetHidDevFile returns device file (e.g. /dev/hidg1) of hid function instance.
+// the kernel numbers hidg devices in creation order, so it is looked up by device number.
+func UsbGadgetHidDevFile(params *UsbGadgetHidSetupParams, instanceName string) (string, error) {
+	// if configsHome is empty, assume /sys/kernel/config as configsHome
+	if params.ConfigsHome == "" {
+		params.ConfigsHome = "/sys/kernel/config"
+	}
+	// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb1/dev
+	devAttrPath := path.Join(params.functionsDir(), "hid." + instanceName, "dev")
+	dev, err := os.ReadFile(devAttrPath)
+	if err != nil {
+		return "", fmt.Errorf("can not read device number (%v): %w", devAttrPath, err)
+	}
+	// e.g. /sys/dev/char/236:1 -> ../../devices/virtual/hidg/hidg1
+	devLinkPath := path.Join(sysDevCharDir, strings.TrimSpace(string(dev)))
+	target, err := os.Readlink(devLinkPath)
+	if err != nil {
+		return "", fmt.Errorf("can not read device link (%v): %w", devLinkPath, err)
+	}
+	return path.Join("/dev", path.Base(target)), nil
+}
@@ -0,0 +1,259 @@
+package setup
+
+//
+// transaction of gadget setup in configfs
+// existing entries are reconciled with desired values, changes are undone in reverse order on failure
+//
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type gadgetOpType int
+
+const (
+	gadgetOpMakeDir gadgetOpType = iota
+	gadgetOpWriteFile
+	gadgetOpSymlink
+	gadgetOpRemoveDir
+)
+
+type gadgetAttr struct {
+	name  string
+	value []byte
+}
+
+type gadgetOp struct {
+	opType  gadgetOpType
+	path    string
+	existed bool
+	prev    []byte /* previous file value or symlink target */
+	attrs   []*gadgetAttr /* writable attributes of removed dir, in dir order */
+}
+
+type gadgetTx struct {
+	ops     []*gadgetOp
+	created map[string]bool
+}
+
+// "0x057e" and "0x57e\n" are the same value
+func sameAttrValue(current []byte, value []byte) bool {
+	c := strings.TrimSpace(string(current))
+	v := strings.TrimSpace(string(value))
+	if c == v {
+		return true
+	}
+	cn, cerr := strconv.ParseInt(c, 0, 64)
+	vn, verr := strconv.ParseInt(v, 0, 64)
+	return cerr == nil && verr == nil && cn == vn
+}
+
+func (o *gadgetOp) undo() error {
+	switch o.opType {
+	case gadgetOpMakeDir:
+		err := os.Remove(o.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can not remove dir (%v): %w", o.path, err)
+		}
+	case gadgetOpWriteFile:
+		if !o.existed {
+			err := os.Remove(o.path)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("can not remove file (%v): %w", o.path, err)
+			}
+			return nil
+		}
+		err := os.WriteFile(o.path, o.prev, 0644)
+		if err != nil {
+			return fmt.Errorf("can not restore file (%v): %w", o.path, err)
+		}
+	case gadgetOpSymlink:
+		err := os.Remove(o.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can not remove symbolic link (%v): %w", o.path, err)
+		}
+		if o.existed {
+			err := os.Symlink(string(o.prev), o.path)
+			if err != nil {
+				return fmt.Errorf("can not restore symbolic link (%v -> %v): %w", o.path, string(o.prev), err)
+			}
+		}
+	case gadgetOpRemoveDir:
+		err := os.Mkdir(o.path, 0755)
+		if err != nil {
+			return fmt.Errorf("can not restore dir (%v): %w", o.path, err)
+		}
+		for _, attr := range o.attrs {
+			filePath := path.Join(o.path, attr.name)
+			err := os.WriteFile(filePath, attr.value, 0644)
+			if err != nil {
+				return fmt.Errorf("can not restore file (%v): %w", filePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// create missing dirs from the top, existing dirs are kept
+func (t *gadgetTx) makeDirAll(dir string, perm os.FileMode) error {
+	missing := make([]string, 0)
+	for d := dir; ; d = path.Dir(d) {
+		info, err := os.Stat(d)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("not a dir (%v)", d)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("can not stat dir (%v): %w", d, err)
+		}
+		missing = append(missing, d)
+		if d == path.Dir(d) {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := os.Mkdir(missing[i], perm)
+		if err != nil {
+			return fmt.Errorf("can not create dir (%v): %w", missing[i], err)
+		}
+		t.created[missing[i]] = true
+		t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpMakeDir, path: missing[i] })
+	}
+	return nil
+}
+
+func (t *gadgetTx) write(dirName string, fileName string, value []byte, perm os.FileMode, same func([]byte, []byte) bool) error {
+	filePath := path.Join(dirName, fileName)
+	current, err := os.ReadFile(filePath)
+	existed := true
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("can not read file (%v): %w", filePath, err)
+		}
+		existed = false
+	} else if same(current, value) {
+		return nil
+	}
+	err = os.WriteFile(filePath, value, perm)
+	if err != nil {
+		return fmt.Errorf("can not write file (%v): %w", filePath, err)
+	}
+	// attributes of configfs in a created dir are removed with the dir
+	if existed && t.created[dirName] {
+		return nil
+	}
+	t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpWriteFile, path: filePath, existed: existed, prev: current })
+	return nil
+}
+
+func (t *gadgetTx) writeFile(dirName string, fileName string, value string, perm os.FileMode) error {
+	return t.write(dirName, fileName, []byte(value), perm, sameAttrValue)
+}
+
+func (t *gadgetTx) writeHexStringFile(dirName string, fileName string, hexString string, perm os.FileMode) error {
+	decodedBytes, err := hex.DecodeString(hexString)
+	if err != nil {
+		return fmt.Errorf("can not decode hex string (%v): %w", hexString, err)
+	}
+	return t.write(dirName, fileName, decodedBytes, perm, bytes.Equal)
+}
+
+// a link to another target is replaced
+func (t *gadgetTx) symlink(oldName string, newName string) error {
+	target, err := os.Readlink(newName)
+	if err == nil {
+		if target == oldName {
+			return nil
+		}
+		err = os.Remove(newName)
+		if err != nil {
+			return fmt.Errorf("can not remove stale symbolic link (%v -> %v): %w", newName, target, err)
+		}
+		t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpSymlink, path: newName, existed: true, prev: []byte(target) })
+	} else if os.IsNotExist(err) {
+		t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpSymlink, path: newName, existed: false })
+	} else {
+		return fmt.Errorf("can not read symbolic link (%v): %w", newName, err)
+	}
+	err = os.Symlink(oldName, newName)
+	if err != nil {
+		return fmt.Errorf("can not create symbolic link (%v -> %v): %w", newName, oldName, err)
+	}
+	return nil
+}
+
+func (t *gadgetTx) removeSymlink(name string) error {
+	target, err := os.Readlink(name)
+	if err != nil {
+		return fmt.Errorf("can not read symbolic link (%v): %w", name, err)
+	}
+	err = os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("can not remove symbolic link (%v -> %v): %w", name, target, err)
+	}
+	t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpSymlink, path: name, existed: true, prev: []byte(target) })
+	return nil
+}
+
+// configfs removes attributes with the dir, writable attributes are kept for undo
+func (t *gadgetTx) removeDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("can not read dir (%v): %w", dir, err)
+	}
+	attrs := make([]*gadgetAttr, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("can not stat file (%v): %w", path.Join(dir, entry.Name()), err)
+		}
+		if info.Mode().Perm() & 0200 == 0 {
+			continue
+		}
+		value, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("can not read file (%v): %w", path.Join(dir, entry.Name()), err)
+		}
+		attrs = append(attrs, &gadgetAttr{ name: entry.Name(), value: value })
+	}
+	err = os.Remove(dir)
+	if err != nil {
+		return fmt.Errorf("can not remove dir (%v): %w", dir, err)
+	}
+	t.ops = append(t.ops, &gadgetOp{ opType: gadgetOpRemoveDir, path: dir, attrs: attrs })
+	return nil
+}
+
+// undo all changes in reverse order, continues on errors
+func (t *gadgetTx) rollback() error {
+	errs := make([]string, 0)
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		if err := t.ops[i].undo(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	t.ops = nil
+	t.created = make(map[string]bool)
+	if len(errs) > 0 {
+		return fmt.Errorf("can not rollback: %v", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func newGadgetTx() *gadgetTx {
+	return &gadgetTx{
+		ops: make([]*gadgetOp, 0),
+		created: make(map[string]bool),
+	}
+}
@@ -0,0 +1,208 @@
+package setup
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// path relative to root -> "dir", "file:<value>" or "link:<target>"
+func snapshotTestTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode() & os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "link:" + target
+		case info.IsDir():
+			tree[rel] = "dir"
+		default:
+			value, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "file:" + string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can not walk test tree (%v): %v", root, err)
+	}
+	return tree
+}
+
+func TestSameAttrValue(t *testing.T) {
+	tests := []struct {
+		current string
+		value   string
+		want    bool
+	}{
+		{ "0x057e\n", "0x057e", true },
+		{ "0x57e\n", "0x057e", true },
+		{ "1406\n", "0x057e", true },
+		{ "0x2009\n", "0x057e", false },
+		{ "Nintendo Co., Ltd.\n", "Nintendo Co., Ltd.", true },
+		{ "Pro Controller\n", "Nintendo Co., Ltd.", false },
+		{ "", "", true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.current + "/" + tt.value, func(t *testing.T) {
+			if got := sameAttrValue([]byte(tt.current), []byte(tt.value)); got != tt.want {
+				t.Errorf("sameAttrValue(%q, %q) = %v, want %v", tt.current, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGadgetTxRollback(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(root string) error
+		steps   []func(tx *gadgetTx, root string) error
+		ops     int
+	}{
+		{
+			name: "created dirs, files and links",
+			steps: []func(tx *gadgetTx, root string) error{
+				func(tx *gadgetTx, root string) error {
+					return tx.makeDirAll(path.Join(root, "g1/strings/0x409"), 0755)
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.writeFile(path.Join(root, "g1"), "idVendor", "0x057e", 0644)
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.writeHexStringFile(path.Join(root, "g1"), "report_desc", "0501", 0644)
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.symlink(path.Join(root, "g1/strings"), path.Join(root, "link"))
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.writeFile(path.Join(root, "missing"), "idProduct", "0x2009", 0644)
+				},
+			},
+			ops: 6,
+		},
+		{
+			name: "existing files and links",
+			prepare: func(root string) error {
+				if err := os.MkdirAll(path.Join(root, "g1/configs/c.1"), 0755); err != nil {
+					return err
+				}
+				if err := os.WriteFile(path.Join(root, "g1/idVendor"), []byte("0x0000\n"), 0644); err != nil {
+					return err
+				}
+				if err := os.WriteFile(path.Join(root, "g1/bcdDevice"), []byte("0x0200\n"), 0644); err != nil {
+					return err
+				}
+				return os.Symlink(path.Join(root, "g1/old"), path.Join(root, "g1/configs/c.1/hid.usb0"))
+			},
+			steps: []func(tx *gadgetTx, root string) error{
+				func(tx *gadgetTx, root string) error {
+					return tx.writeFile(path.Join(root, "g1"), "idVendor", "0x057e", 0644)
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.writeFile(path.Join(root, "g1"), "bcdDevice", "0x200", 0644)
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.symlink(path.Join(root, "g1/new"), path.Join(root, "g1/configs/c.1/hid.usb0"))
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.writeHexStringFile(path.Join(root, "g1"), "report_desc", "zz", 0644)
+				},
+			},
+			ops: 2,
+		},
+		{
+			name: "removed links and dirs",
+			prepare: func(root string) error {
+				if err := os.MkdirAll(path.Join(root, "g1/functions/hid.usb1"), 0755); err != nil {
+					return err
+				}
+				return os.Symlink(path.Join(root, "g1/functions/hid.usb1"), path.Join(root, "g1/hid.usb1"))
+			},
+			steps: []func(tx *gadgetTx, root string) error{
+				func(tx *gadgetTx, root string) error {
+					return tx.removeSymlink(path.Join(root, "g1/hid.usb1"))
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.removeDir(path.Join(root, "g1/functions/hid.usb1"))
+				},
+				func(tx *gadgetTx, root string) error {
+					return tx.removeSymlink(path.Join(root, "g1/hid.usb1"))
+				},
+			},
+			ops: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.prepare != nil {
+				if err := tt.prepare(root); err != nil {
+					t.Fatalf("can not prepare test tree: %v", err)
+				}
+			}
+			before := snapshotTestTree(t, root)
+			tx := newGadgetTx()
+			for i, step := range tt.steps {
+				err := step(tx, root)
+				last := i == len(tt.steps) - 1
+				if last && err == nil {
+					t.Fatalf("step %v: no error, want error", i)
+				}
+				if !last && err != nil {
+					t.Fatalf("step %v: %v", i, err)
+				}
+			}
+			if len(tx.ops) != tt.ops {
+				t.Errorf("ops = %v, want %v", len(tx.ops), tt.ops)
+			}
+			if err := tx.rollback(); err != nil {
+				t.Fatalf("can not rollback: %v", err)
+			}
+			if after := snapshotTestTree(t, root); !reflect.DeepEqual(after, before) {
+				t.Errorf("tree after rollback = %v, want %v", after, before)
+			}
+			if len(tx.ops) != 0 || len(tx.created) != 0 {
+				t.Errorf("transaction is not reset: ops = %v, created = %v", tx.ops, tx.created)
+			}
+		})
+	}
+}
+
+// attributes are restored in dir order, a failure stops the restore of later attributes
+func TestGadgetOpRemoveDirUndoOrder(t *testing.T) {
+	dir := path.Join(t.TempDir(), "hid.usb0")
+	op := &gadgetOp{
+		opType: gadgetOpRemoveDir,
+		path: dir,
+		attrs: []*gadgetAttr{
+			{ name: "protocol", value: []byte("0\n") },
+			{ name: "missing/report_length", value: []byte("64\n") },
+			{ name: "subclass", value: []byte("0\n") },
+		},
+	}
+	if err := op.undo(); err == nil {
+		t.Fatalf("undo: no error, want error")
+	}
+	want := map[string]string{
+		".": "dir",
+		"protocol": "file:0\n",
+	}
+	if got := snapshotTestTree(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored dir = %v, want %v", got, want)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"os"
 	"path"
 	"fmt"
-	"encoding/hex"
 	"io/ioutil"
+	"strings"
 )
 
 // ==============================
@@ -52,6 +52,8 @@ type UsbGadgetHidSetupParams struct {
 	ReportLength    string
 	ReportDesc      string
 	UDC             string
+	// composed after the hid function above
+	Functions       []*UsbGadgetFunction
 }
 
 
@@ -66,51 +68,11 @@ func remove(path string) error {
 	return nil
 }
 
-func makeDir(dir string, perm os.FileMode) error {
-	err := os.Mkdir(dir, perm)
-	if err != nil &&  !os.IsExist(err)  {
-		return fmt.Errorf("can not create gadget dir (%v): %w", dir, err)
-	}
-	return nil
-}
-
-func makeDirAll(dir string, perm os.FileMode) error {
-	err := os.MkdirAll(dir, perm)
-	if err != nil {
-		return fmt.Errorf("can not create gadget dir (%v): %w", dir, err)
-	}
-	return nil
-}
-
 func writeToFile(dirName string, fileName string, value string, perm os.FileMode) error {
 	filePath := path.Join(dirName, fileName)
 	return os.WriteFile(filePath, []byte(value), perm)
 }
 
-func writeHexStringToFile(dirName string, fileName string, hexString string, perm os.FileMode) error {
-	decodedBytes, err := hex.DecodeString(hexString)
-	if err != nil {
-		return fmt.Errorf("can not decode hex string (%v): %w", hexString, err)
-	}
-	filePath := path.Join(dirName, fileName)
-	return os.WriteFile(filePath, decodedBytes, perm)
-}
-
-func createSymlink(oldName string, newName string) error {
-	_, err := os.Stat(newName)
-	if err == nil {
-		err = os.Remove(newName)
-		if err != nil {
-			return fmt.Errorf("can not remove already exists symbolic link (%v): %w", newName, err)
-		}
-	}
-	err = os.Symlink(oldName, newName)
-	if err != nil {
-		return fmt.Errorf("can not create new symbolic link (%v -> %v): %w", newName, oldName, err)
-	}
-	return nil
-}
-
 func getUDC() (string, error) {
 	files, err := ioutil.ReadDir("/sys/class/udc")
 	if err != nil {
@@ -135,16 +97,17 @@ func UsbGadgetHidCleanup(params *UsbGadgetHidSetupParams) error {
 	configsDir := path.Join(gadgetDir, "configs", params.ConfigName + "." + params.ConfigNumber)
 	// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/strings/0x409
 	configsStringsDir := path.Join(configsDir, "strings", params.StringsLang)
-	// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
-	functionsDir := path.Join(gadgetDir, "functions", params.FunctionName + "." + params.InstanceName)
-	// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0
-	configsFunctionDir := path.Join(configsDir, params.FunctionName + "." + params.InstanceName)
+	functions := params.functions()
 	// cleanup
-	err := remove(configsFunctionDir)
-	if err != nil {
-		return fmt.Errorf("can not remove config function symlink (%v): %w", configsFunctionDir, err)
+	for _, function := range functions {
+		// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0
+		configsFunctionDir := path.Join(configsDir, function.dirName())
+		err := remove(configsFunctionDir)
+		if err != nil {
+			return fmt.Errorf("can not remove config function symlink (%v): %w", configsFunctionDir, err)
+		}
 	}
-	err = remove(configsStringsDir)
+	err := remove(configsStringsDir)
 	if err != nil {
 		return fmt.Errorf("can not remove strings dir in configs dir (%v): %w", configsStringsDir, err)
 	}
@@ -152,9 +115,13 @@ func UsbGadgetHidCleanup(params *UsbGadgetHidSetupParams) error {
 	if err != nil {
 		return fmt.Errorf("can not remove configs dir (%v): %w", configsDir, err)
 	}
-	err = remove(functionsDir)
-	if err != nil {
-		return fmt.Errorf("can not remove functions dir (%v): %w", functionsDir, err)
+	for _, function := range functions {
+		// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
+		functionsDir := path.Join(params.functionsDir(), function.dirName())
+		err = remove(functionsDir)
+		if err != nil {
+			return fmt.Errorf("can not remove functions dir (%v): %w", functionsDir, err)
+		}
 	}
 	err = remove(stringsDir)
 	if err != nil {
@@ -167,7 +134,7 @@ func UsbGadgetHidCleanup(params *UsbGadgetHidSetupParams) error {
 	return nil
 }
 
-func UsbGadgetHidSetup(params *UsbGadgetHidSetupParams) error {
+func usbGadgetHidSetup(tx *gadgetTx, params *UsbGadgetHidSetupParams) error {
 	// if configsHome is empty, assume /sys/kernel/config as configsHome
 	if params.ConfigsHome == "" {
 		params.ConfigsHome = "/sys/kernel/config"
@@ -180,111 +147,168 @@ func UsbGadgetHidSetup(params *UsbGadgetHidSetupParams) error {
 	configsDir := path.Join(gadgetDir, "configs", params.ConfigName + "." + params.ConfigNumber)
 	// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/strings/0x409
 	configsStringsDir := path.Join(configsDir, "strings", params.StringsLang)
-	// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
-	functionsDir := path.Join(gadgetDir, "functions", params.FunctionName + "." + params.InstanceName)
-	// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0
-	configsFunctionDir := path.Join(configsDir, params.FunctionName + "." + params.InstanceName)
+	// attributes of a bound gadget can not be changed
+	udc, err := os.ReadFile(path.Join(gadgetDir, usbDevCon))
+	if err == nil && strings.TrimSpace(string(udc)) != "" {
+		err = tx.writeFile(gadgetDir, usbDevCon, "\n", 0644)
+		if err != nil {
+			return fmt.Errorf("can not unbind gadget (%v): %w", gadgetDir, err)
+		}
+	}
 	// setup /sys/kernel/config/usb_gadget/<name>/*
-	err := makeDir(gadgetDir, 0755)
+	err = tx.makeDirAll(gadgetDir, 0755)
 	if err != nil {
 		return fmt.Errorf("can not create gadget dir (%v): %w", gadgetDir, err)
 	}
-	err = writeToFile(gadgetDir, "idVendor", params.IdVendor, 0644)
+	err = tx.writeFile(gadgetDir, "idVendor", params.IdVendor, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "idVendor", err)
 	}
-	err = writeToFile(gadgetDir, "idProduct", params.IdProduct, 0644)
+	err = tx.writeFile(gadgetDir, "idProduct", params.IdProduct, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "idProduct", err)
 	}
-	err = writeToFile(gadgetDir, "bcdDevice", params.BcdDevice, 0644)
+	err = tx.writeFile(gadgetDir, "bcdDevice", params.BcdDevice, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bcdDevice", err)
 	}
-	err = writeToFile(gadgetDir, "bcdUSB", params.BcdUsb, 0644)
+	err = tx.writeFile(gadgetDir, "bcdUSB", params.BcdUsb, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bcdUSB", err)
 	}
-	err = writeToFile(gadgetDir, "bMaxPacketSize0", params.BMaxPacketSize0, 0644)
+	err = tx.writeFile(gadgetDir, "bMaxPacketSize0", params.BMaxPacketSize0, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bMaxPacketSize0", err)
 	}
-	err = writeToFile(gadgetDir, "bDeviceClass", params.BDeviceClass, 0644)
+	err = tx.writeFile(gadgetDir, "bDeviceClass", params.BDeviceClass, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bDeviceClass", err)
 	}
-	err = writeToFile(gadgetDir, "bDeviceSubClass", params.BDeviceSubClass, 0644)
+	err = tx.writeFile(gadgetDir, "bDeviceSubClass", params.BDeviceSubClass, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bDeviceSubClass", err)
 	}
-	err = writeToFile(gadgetDir, "bDeviceProtocol", params.BDeviceProtocol, 0644)
+	err = tx.writeFile(gadgetDir, "bDeviceProtocol", params.BDeviceProtocol, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bDeviceProtocol", err)
 	}
 	// setup  /sys/kernel/config/usb_gadget/<name>/strings/0x409/*
-	err = makeDirAll(stringsDir, 0755)
+	err = tx.makeDirAll(stringsDir, 0755)
 	if err != nil {
 		return fmt.Errorf("can not create strings dir (%v): %w", stringsDir, err)
 	}
-	err = writeToFile(stringsDir, "serialnumber", params.ISerial, 0644)
+	err = tx.writeFile(stringsDir, "serialnumber", params.ISerial, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "serialnumber", err)
 	}
-	err = writeToFile(stringsDir, "manufacturer", params.IManufacturer, 0644)
+	err = tx.writeFile(stringsDir, "manufacturer", params.IManufacturer, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "manufacturer", err)
 	}
-	err = writeToFile(stringsDir, "product", params.IProduct, 0644)
+	err = tx.writeFile(stringsDir, "product", params.IProduct, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "product", err)
 	}
 	// setup /sys/kernel/config/usb_gadget/<name>/configs/c.1/*
-	err = makeDirAll(configsDir, 0755)
+	err = tx.makeDirAll(configsDir, 0755)
 	if err != nil {
 		return fmt.Errorf("can not create configs dir (%v): %w", configsDir, err)
 	}
-	err = writeToFile(configsDir, "bmAttributes", params.BmAttributes, 0644)
+	err = tx.writeFile(configsDir, "bmAttributes", params.BmAttributes, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "bmAttributes", err)
 	}
-	err = writeToFile(configsDir, "MaxPower", params.MaxPower, 0644)
+	err = tx.writeFile(configsDir, "MaxPower", params.MaxPower, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "MaxPower", err)
 	}
 	// setup /sys/kernel/config/usb_gadget/<name>/configs/c.1/strings/0x409/*
-	err = makeDirAll(configsStringsDir, 0755)
+	err = tx.makeDirAll(configsStringsDir, 0755)
 	if err != nil {
 		return fmt.Errorf("can not create strings dir in configs dir (%v): %w", configsStringsDir, err)
 	}
-	err = writeToFile(configsStringsDir, "configuration", params.ConfigString, 0644)
+	err = tx.writeFile(configsStringsDir, "configuration", params.ConfigString, 0644)
 	if err != nil {
 		return fmt.Errorf("can not write to file (%v): %w", "configuration", err)
 	}
-	// setup /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
-	err = makeDirAll(functionsDir, 0755)
-	if err != nil {
-		return fmt.Errorf("can not create functions dir (%v): %w", functionsDir, err)
-	}
-	err = writeToFile(functionsDir, "protocol", params.Protocol, 0644)
-	if err != nil {
-		return fmt.Errorf("can not write to file (%v): %w", "protocol", err)
-	}
-	err = writeToFile(functionsDir, "subclass", params.Subclass, 0644)
-	if err != nil {
-		return fmt.Errorf("can not write to file (%v): %w", "subclass", err)
+	functions := params.functions()
+	linked := make(map[string]bool)
+	for _, function := range functions {
+		// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
+		functionsDir := path.Join(params.functionsDir(), function.dirName())
+		// e.g. /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0
+		configsFunctionDir := path.Join(configsDir, function.dirName())
+		if linked[function.dirName()] {
+			return fmt.Errorf("duplicate function (%v)", function.dirName())
+		}
+		err = tx.makeDirAll(functionsDir, 0755)
+		if err != nil {
+			return fmt.Errorf("can not create functions dir (%v): %w", functionsDir, err)
+		}
+		changed, err := function.attributesChanged(functionsDir)
+		if err != nil {
+			return fmt.Errorf("can not compare attributes of function (%v): %w", function.dirName(), err)
+		}
+		// f_hid rejects attribute writes while the function is linked to the config
+		if _, err := os.Lstat(configsFunctionDir); changed && err == nil {
+			err = tx.removeSymlink(configsFunctionDir)
+			if err != nil {
+				return fmt.Errorf("can not unlink function (%v): %w", function.dirName(), err)
+			}
+		}
+		for _, attr := range function.Attributes {
+			if attr.Hex {
+				err = tx.writeHexStringFile(functionsDir, attr.Name, attr.Value, 0644)
+			} else {
+				err = tx.writeFile(functionsDir, attr.Name, attr.Value, 0644)
+			}
+			if err != nil {
+				return fmt.Errorf("can not write to file (%v): %w", attr.Name, err)
+			}
+		}
+		// setup /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0 -> /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
+		err = tx.symlink(functionsDir, configsFunctionDir)
+		if err != nil {
+			return fmt.Errorf("can not create symbolic link (%v -> %v): %w", configsFunctionDir, functionsDir, err)
+		}
+		linked[function.dirName()] = true
 	}
-	err = writeToFile(functionsDir, "report_length", params.ReportLength, 0644)
+	// functions of previous setup
+	entries, err := os.ReadDir(configsDir)
 	if err != nil {
-		return fmt.Errorf("can not write to file (%v): %w", "report_length", err)
+		return fmt.Errorf("can not read configs dir (%v): %w", configsDir, err)
 	}
-	err = writeHexStringToFile(functionsDir, "report_desc", params.ReportDesc, 0644)
-	if err != nil {
-		return fmt.Errorf("can not write to file (%v): %w", "report_desc", err)
+	for _, entry := range entries {
+		if entry.Type() & os.ModeSymlink == 0 || linked[entry.Name()] {
+			continue
+		}
+		err = tx.removeSymlink(path.Join(configsDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("can not remove stale function: %w", err)
+		}
+		// e.g. /sys/kernel/config/usb_gadget/<name>/functions/hid.usb1
+		staleFunctionDir := path.Join(params.functionsDir(), entry.Name())
+		if _, err := os.Stat(staleFunctionDir); err != nil {
+			continue
+		}
+		err = tx.removeDir(staleFunctionDir)
+		if err != nil {
+			return fmt.Errorf("can not remove stale function dir: %w", err)
+		}
 	}
-	// setup /sys/kernel/config/usb_gadget/<name>/configs/c.1/hid.usb0 -> /sys/kernel/config/usb_gadget/<name>/functions/hid.usb0
-	err = os.Symlink(functionsDir, configsFunctionDir)
+	return nil
+}
+
+// existing gadget is reconciled with params, all changes are rolled back on failure
+func UsbGadgetHidSetup(params *UsbGadgetHidSetupParams) error {
+	tx := newGadgetTx()
+	err := usbGadgetHidSetup(tx, params)
 	if err != nil {
-		return fmt.Errorf("can not create symbolic link (%v -> %v): %w", configsFunctionDir, functionsDir, err)
+		rollbackErr := tx.rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w (%v)", err, rollbackErr)
+		}
+		return err
 	}
 	return nil
 }
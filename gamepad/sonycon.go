@@ -0,0 +1,202 @@
+package gamepad
+
+//
+// common parts of DualShock 4 and DualSense
+//
+
+import(
+        "fmt"
+        "log"
+	"math"
+	"github.com/potix/regapweb/message"
+)
+
+type sonyButtons struct {
+	square   byte
+	cross    byte
+	circle   byte
+	triangle byte
+	l1       byte
+	r1       byte
+	l2       byte
+	r2       byte
+	share    byte
+	options  byte
+	ps       byte
+	touchpad byte
+	mute     byte
+	up       byte
+	down     byte
+	left     byte
+	right    byte
+}
+
+type sonyController struct {
+	buttons    *sonyButtons
+	leftStick  *stick
+	rightStick *stick
+	l2Value    float64
+	r2Value    float64
+}
+
+func newSonyController() *sonyController {
+	return &sonyController{
+		buttons: &sonyButtons{},
+		leftStick: &stick{},
+		rightStick: &stick{},
+	}
+}
+
+func sonyBoolToByte(v bool) byte {
+	if v {
+		return byte(1)
+	} else {
+		return byte(0)
+	}
+}
+
+func sonyAxisToByte(v float64) byte {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	return byte(math.Round((1 + v) * 127.5))
+}
+
+func sonyTriggerToByte(v float64) byte {
+	if v > 1 {
+		v = 1
+	} else if v < 0 {
+		v = 0
+	}
+	return byte(math.Round(v * 255))
+}
+
+func sonyHat(buttons *sonyButtons) byte {
+	return hatSwitch(buttons.up, buttons.right, buttons.down, buttons.left)
+}
+
+// imu calibration feature report (excluding report id)
+// gyro bias (pitch, yaw, roll), gyro +/- (pitch, yaw, roll), gyro speed +/-, accel +/- (x, y, z)
+func sonyImuCalibration() []byte {
+	calibration := []int16{
+		0, 0, 0,
+		8192, -8192, 8192, -8192, 8192, -8192,
+		540, 540,
+		8192, -8192, 8192, -8192, 8192, -8192,
+	}
+	calibrationBytes := make([]byte, len(calibration) * 2)
+	for i, v := range calibration {
+		calibrationBytes[i * 2] = byte(uint16(v) & 0xff)
+		calibrationBytes[i * 2 + 1] = byte(uint16(v) >> 8)
+	}
+	return calibrationBytes
+}
+
+func (c *sonyController) updateState(state *message.GamepadState, modelName string) {
+	for i, button := range state.Buttons {
+		switch i {
+		case 0:
+			c.buttons.cross = sonyBoolToByte(button.Pressed)
+		case 1:
+			c.buttons.circle = sonyBoolToByte(button.Pressed)
+		case 2:
+			c.buttons.square = sonyBoolToByte(button.Pressed)
+		case 3:
+			c.buttons.triangle = sonyBoolToByte(button.Pressed)
+		case 4:
+			c.buttons.l1 = sonyBoolToByte(button.Pressed)
+		case 5:
+			c.buttons.r1 = sonyBoolToByte(button.Pressed)
+		case 6:
+			c.buttons.l2 = sonyBoolToByte(button.Pressed)
+			c.l2Value = button.Value
+		case 7:
+			c.buttons.r2 = sonyBoolToByte(button.Pressed)
+			c.r2Value = button.Value
+		case 8:
+			c.buttons.share = sonyBoolToByte(button.Pressed)
+		case 9:
+			c.buttons.options = sonyBoolToByte(button.Pressed)
+		case 10:
+			c.leftStick.press = sonyBoolToByte(button.Pressed)
+		case 11:
+			c.rightStick.press = sonyBoolToByte(button.Pressed)
+		case 12:
+			c.buttons.up = sonyBoolToByte(button.Pressed)
+		case 13:
+			c.buttons.down = sonyBoolToByte(button.Pressed)
+		case 14:
+			c.buttons.left = sonyBoolToByte(button.Pressed)
+		case 15:
+			c.buttons.right = sonyBoolToByte(button.Pressed)
+		case 16:
+			c.buttons.ps = sonyBoolToByte(button.Pressed)
+		case 17:
+			c.buttons.touchpad = sonyBoolToByte(button.Pressed)
+		default:
+			log.Printf("can not update state because unsupported button in %v: button index = %v", modelName, i)
+		}
+	}
+	for i, axis := range state.Axes {
+		switch i {
+		case 0:
+			c.leftStick.x = axis
+		case 1:
+			c.leftStick.y = axis
+		case 2:
+			c.rightStick.x = axis
+		case 3:
+			c.rightStick.y = axis
+		default:
+			log.Printf("can not update state because unsupported axis in %v: axis index = %v", modelName, i)
+		}
+	}
+}
+
+func (c *sonyController) setButton(button ButtonName, v byte) error {
+	switch button {
+	case ButtonA:
+		c.buttons.circle = v
+	case ButtonB:
+		c.buttons.cross = v
+	case ButtonX:
+		c.buttons.triangle = v
+	case ButtonY:
+		c.buttons.square = v
+	case ButtonLeft:
+		c.buttons.left = v
+	case ButtonRight:
+		c.buttons.right = v
+	case ButtonUp:
+		c.buttons.up = v
+	case ButtonDown:
+		c.buttons.down = v
+	case ButtonPlus:
+		c.buttons.options = v
+	case ButtonMinus:
+		c.buttons.share = v
+	case ButtonHome:
+		c.buttons.ps = v
+	case ButtonCapture:
+		c.buttons.touchpad = v
+	case ButtonStickL:
+		c.leftStick.press = v
+	case ButtonStickR:
+		c.rightStick.press = v
+	case ButtonL:
+		c.buttons.l1 = v
+	case ButtonR:
+		c.buttons.r1 = v
+	case ButtonZL:
+		c.buttons.l2 = v
+		c.l2Value = float64(v)
+	case ButtonZR:
+		c.buttons.r2 = v
+		c.r2Value = float64(v)
+	default:
+		return fmt.Errorf("unsupported button: %v", button)
+	}
+	return nil
+}
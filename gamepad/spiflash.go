@@ -0,0 +1,142 @@
+package gamepad
+
+//
+// virtual spi flash of nintendo switch controllers
+//
+
+import(
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	spiFlashSize       int    = 0x80000
+	spiFlashSectorSize int    = 0x1000
+	spiFlashFactory    uint32 = 0x6000
+	spiFlashUser       uint32 = 0x8000
+)
+
+type spiFlash struct {
+	verbose  bool
+	filePath string
+	image    []byte
+	mutex    sync.Mutex
+}
+
+// load image from file. if image file does not exist, the image is erased (0xff) and
+// user area (0x8000) is seeded with spiMemory80.
+// factory area (0x6000) is always overwritten with spiMemory60.
+func (s *spiFlash) load(spiMemory60 []byte, spiMemory80 []byte) error {
+	for i := range s.image {
+		s.image[i] = 0xff
+	}
+	loaded := false
+	if s.filePath != "" {
+		image, err := os.ReadFile(s.filePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("can not read spi flash image file (%v): %w", s.filePath, err)
+			}
+		} else if len(image) != spiFlashSize {
+			return fmt.Errorf("invalid spi flash image size (%v): %v", s.filePath, len(image))
+		} else {
+			copy(s.image, image)
+			loaded = true
+		}
+	}
+	if !loaded {
+		copy(s.image[spiFlashUser:], spiMemory80)
+	}
+	copy(s.image[spiFlashFactory:], spiMemory60)
+	return nil
+}
+
+func (s *spiFlash) save() error {
+	if s.filePath == "" {
+		return nil
+	}
+	tmpFilePath := filepath.Join(filepath.Dir(s.filePath), "." + filepath.Base(s.filePath) + ".tmp")
+	err := os.WriteFile(tmpFilePath, s.image, 0600)
+	if err != nil {
+		return fmt.Errorf("can not write spi flash image file (%v): %w", tmpFilePath, err)
+	}
+	err = os.Rename(tmpFilePath, s.filePath)
+	if err != nil {
+		return fmt.Errorf("can not rename spi flash image file (%v -> %v): %w", tmpFilePath, s.filePath, err)
+	}
+	return nil
+}
+
+func (s *spiFlash) checkRange(addr uint32, size int) error {
+	if int(addr) + size > spiFlashSize {
+		return fmt.Errorf("out of range spi flash address: addr = %x, size = %x", addr, size)
+	}
+	return nil
+}
+
+func (s *spiFlash) read(addr uint32, size int) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkRange(addr, size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	copy(data, s.image[addr:int(addr) + size])
+	return data, nil
+}
+
+func (s *spiFlash) write(addr uint32, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkRange(addr, len(data)); err != nil {
+		return err
+	}
+	if s.verbose {
+		log.Printf("write spi flash: addr = %x, data = %x", addr, data)
+	}
+	copy(s.image[addr:], data)
+	return s.save()
+}
+
+// write without saving to the image file, for data that is not written by the host
+func (s *spiFlash) patch(addr uint32, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkRange(addr, len(data)); err != nil {
+		return err
+	}
+	copy(s.image[addr:], data)
+	return nil
+}
+
+func (s *spiFlash) eraseSector(addr uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkRange(addr, 1); err != nil {
+		return err
+	}
+	start := int(addr) - int(addr) % spiFlashSectorSize
+	if s.verbose {
+		log.Printf("erase spi flash sector: addr = %x", start)
+	}
+	for i := start; i < start + spiFlashSectorSize; i++ {
+		s.image[i] = 0xff
+	}
+	return s.save()
+}
+
+func newSpiFlash(verbose bool, filePath string, spiMemory60 []byte, spiMemory80 []byte) (*spiFlash, error) {
+	s := &spiFlash{
+		verbose: verbose,
+		filePath: filePath,
+		image: make([]byte, spiFlashSize),
+	}
+	err := s.load(spiMemory60, spiMemory80)
+	if err != nil {
+		return nil, fmt.Errorf("can not load spi flash: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,98 @@
+package gamepad
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpiFlashReadWriteErase(t *testing.T) {
+	erasedSector := bytes.Repeat([]byte{ 0xff }, 4)
+	tests := []struct {
+		name  string
+		write []byte
+		erase bool
+		addr  uint32
+		want  []byte
+		err   bool
+	}{
+		{ name: "factory", addr: spiFlashFactory, want: []byte{ 0x60, 0x61, 0xff, 0xff } },
+		{ name: "user", addr: spiFlashUser, want: []byte{ 0x80, 0x81, 0xff, 0xff } },
+		{ name: "erased", addr: 0x0000, want: erasedSector },
+		{ name: "write", write: []byte{ 0x01, 0x02, 0x03 }, addr: 0x8010, want: []byte{ 0x01, 0x02, 0x03, 0xff } },
+		{ name: "erase sector", erase: true, addr: 0x8fff, want: nil },
+		{ name: "last bytes", addr: uint32(spiFlashSize - 4), want: erasedSector },
+		{ name: "read out of range", addr: uint32(spiFlashSize - 3), err: true },
+		{ name: "write out of range", write: []byte{ 0x01, 0x02 }, addr: uint32(spiFlashSize - 1), err: true },
+		{ name: "erase out of range", erase: true, addr: uint32(spiFlashSize), err: true },
+	}
+	s, err := newSpiFlash(false, "", []byte{ 0x60, 0x61 }, []byte{ 0x80, 0x81 })
+	if err != nil {
+		t.Fatalf("can not create spi flash: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switch {
+			case tt.write != nil:
+				err = s.write(tt.addr, tt.write)
+			case tt.erase:
+				err = s.eraseSector(tt.addr)
+			default:
+				var data []byte
+				data, err = s.read(tt.addr, 4)
+				if err == nil && !bytes.Equal(data, tt.want) {
+					t.Errorf("read(%x) = %x, want %x", tt.addr, data, tt.want)
+				}
+			}
+			if tt.err != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if tt.write != nil && err == nil {
+				data, _ := s.read(tt.addr, 4)
+				if !bytes.Equal(data, tt.want) {
+					t.Errorf("read(%x) after write = %x, want %x", tt.addr, data, tt.want)
+				}
+			}
+			if tt.erase && err == nil {
+				start := tt.addr - tt.addr % uint32(spiFlashSectorSize)
+				data, _ := s.read(start, spiFlashSectorSize)
+				if !bytes.Equal(data, bytes.Repeat([]byte{ 0xff }, spiFlashSectorSize)) {
+					t.Errorf("sector %x is not erased", start)
+				}
+			}
+		})
+	}
+}
+
+func TestSpiFlashPersistence(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "spiflash.bin")
+	s, err := newSpiFlash(false, filePath, []byte{ 0x60 }, []byte{ 0x80 })
+	if err != nil {
+		t.Fatalf("can not create spi flash: %v", err)
+	}
+	if err := s.write(0x8010, []byte{ 0xb2, 0xa1 }); err != nil {
+		t.Fatalf("can not write spi flash: %v", err)
+	}
+	// the image file keeps user data, factory data is replaced
+	reloaded, err := newSpiFlash(false, filePath, []byte{ 0x61 }, []byte{ 0x81 })
+	if err != nil {
+		t.Fatalf("can not reload spi flash: %v", err)
+	}
+	tests := []struct {
+		addr uint32
+		want []byte
+	}{
+		{ addr: spiFlashFactory, want: []byte{ 0x61 } },
+		{ addr: spiFlashUser, want: []byte{ 0x80 } },
+		{ addr: 0x8010, want: []byte{ 0xb2, 0xa1 } },
+	}
+	for _, tt := range tests {
+		data, err := reloaded.read(tt.addr, len(tt.want))
+		if err != nil {
+			t.Fatalf("can not read spi flash: %v", err)
+		}
+		if !bytes.Equal(data, tt.want) {
+			t.Errorf("read(%x) = %x, want %x", tt.addr, data, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package gamepad
+
+//
+// stick shaping applied before backends
+//
+
+import (
+	"math"
+)
+
+// StickShape is shaping parameters of a stick. all values are 0.0 - 1.0 except Curve.
+//   InnerDeadzone: radius ignored around the center
+//   OuterDeadzone: radius treated as full tilt from the edge
+//   AntiDeadzone:  minimum output just outside the inner deadzone (cancels deadzone of the host)
+//   Curve:         response curve exponent (1.0 = linear, > 1.0 = fine control around the center)
+//   RadialClamp:   clamp to the unit circle instead of the square
+type StickShape struct {
+	InnerDeadzone float64
+	OuterDeadzone float64
+	AntiDeadzone  float64
+	Curve         float64
+	RadialClamp   bool
+}
+
+func clampAxis(v float64) float64 {
+	if v > 1 {
+		return 1
+	} else if v < -1 {
+		return -1
+	}
+	return v
+}
+
+func (s *StickShape) apply(x float64, y float64) (float64, float64) {
+	if s == nil {
+		return x, y
+	}
+	r := math.Hypot(x, y)
+	if r == 0 || r <= s.InnerDeadzone {
+		return 0, 0
+	}
+	live := 1.0 - s.InnerDeadzone - s.OuterDeadzone
+	scaled := 1.0
+	if live > 0 {
+		scaled = math.Min((r - s.InnerDeadzone) / live, 1.0)
+	}
+	if s.Curve > 0 && s.Curve != 1.0 {
+		scaled = math.Pow(scaled, s.Curve)
+	}
+	shaped := s.AntiDeadzone + (1.0 - s.AntiDeadzone) * scaled
+	if !s.RadialClamp {
+		// keep the reach of the corners
+		shaped *= math.Max(r, 1.0)
+	}
+	x = clampAxis(x / r * shaped)
+	y = clampAxis(y / r * shaped)
+	return x, y
+}
@@ -0,0 +1,36 @@
+package gamepad
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStickShapeApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		shape *StickShape
+		x     float64
+		y     float64
+		wantX float64
+		wantY float64
+	}{
+		{ name: "nil", shape: nil, x: 0.5, y: -0.5, wantX: 0.5, wantY: -0.5 },
+		{ name: "linear", shape: &StickShape{}, x: 0.5, y: 0, wantX: 0.5, wantY: 0 },
+		{ name: "center", shape: &StickShape{}, x: 0, y: 0, wantX: 0, wantY: 0 },
+		{ name: "inside inner deadzone", shape: &StickShape{ InnerDeadzone: 0.2 }, x: 0.1, y: -0.1, wantX: 0, wantY: 0 },
+		{ name: "outside inner deadzone", shape: &StickShape{ InnerDeadzone: 0.2 }, x: 0, y: 0.6, wantX: 0, wantY: 0.5 },
+		{ name: "outer deadzone", shape: &StickShape{ OuterDeadzone: 0.2 }, x: -0.8, y: 0, wantX: -1, wantY: 0 },
+		{ name: "anti deadzone", shape: &StickShape{ AntiDeadzone: 0.2 }, x: 0.5, y: 0, wantX: 0.6, wantY: 0 },
+		{ name: "curve", shape: &StickShape{ Curve: 2 }, x: 0, y: -0.5, wantX: 0, wantY: -0.25 },
+		{ name: "corner", shape: &StickShape{}, x: 1, y: 1, wantX: 1, wantY: 1 },
+		{ name: "radial clamp", shape: &StickShape{ RadialClamp: true }, x: 1, y: 1, wantX: math.Sqrt2 / 2, wantY: math.Sqrt2 / 2 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := tt.shape.apply(tt.x, tt.y)
+			if math.Abs(x - tt.wantX) > 1e-9 || math.Abs(y - tt.wantY) > 1e-9 {
+				t.Errorf("apply(%v, %v) = %v, %v, want %v, %v", tt.x, tt.y, x, y, tt.wantX, tt.wantY)
+			}
+		})
+	}
+}
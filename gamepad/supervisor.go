@@ -0,0 +1,204 @@
+package gamepad
+
+//
+// supervisor of gadget device sessions
+//
+// a session is the read/write loops of an opened device file.
+// the session is restarted when it ends by i/o error or the usb device controller
+// is detached (reboot, dock, undock or cable replug of the host).
+//
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	supervisorPollInterval     time.Duration = 500 * time.Millisecond
+	supervisorRetryInterval    time.Duration = time.Second
+	supervisorMaxRetryInterval time.Duration = 30 * time.Second
+	// a shorter session is a failure and the next backoff is doubled
+	supervisorStableSession    time.Duration = 10 * time.Second
+)
+
+// blocks until the session ends by itself or stopCh is closed, and closes f before return
+type supervisedSession func(f *os.File, stopCh chan int)
+
+// reset protocol state before the next session
+type supervisedReset func()
+
+type supervisor struct {
+	verbose      bool
+	name         string
+	devFilePath  string
+	udcStatePath string
+	runSession   supervisedSession
+	resetSession supervisedReset
+	stopCh       chan int
+	doneCh       chan int
+}
+
+func (s *supervisor) readUdcState() string {
+	if s.udcStatePath == "" {
+		return ""
+	}
+	state, err := os.ReadFile(s.udcStatePath)
+	if err != nil {
+		if s.verbose {
+			log.Printf("can not read udc state (%v): %v", s.udcStatePath, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(state))
+}
+
+// unknown state is treated as attached.
+// suspended is attached because the host sleeps without a new handshake.
+func (s *supervisor) udcAttached() bool {
+	state := s.readUdcState()
+	return state == "" || state == "configured" || state == "suspended"
+}
+
+// returns false if stopped
+func (s *supervisor) waitUdcConfigured() bool {
+	for {
+		state := s.readUdcState()
+		if state == "" || state == "configured" {
+			return true
+		}
+		select {
+		case <-time.After(supervisorPollInterval):
+		case <-s.stopCh:
+			return false
+		}
+	}
+}
+
+// returns nil if stopped
+func (s *supervisor) openDevFile() *os.File {
+	for {
+		if !s.waitUdcConfigured() {
+			return nil
+		}
+		f, err := os.OpenFile(s.devFilePath, os.O_RDWR, 0644)
+		if err == nil {
+			return f
+		}
+		log.Printf("can not open device file (%v) in %v: %v", s.devFilePath, s.name, err)
+		select {
+		case <-time.After(supervisorRetryInterval):
+		case <-s.stopCh:
+			return nil
+		}
+	}
+}
+
+// returns false if stopped
+func (s *supervisor) supervise(f *os.File) bool {
+	sessionStopCh := make(chan int)
+	sessionDoneCh := make(chan int)
+	go func() {
+		s.runSession(f, sessionStopCh)
+		close(sessionDoneCh)
+	}()
+	ticker := time.NewTicker(supervisorPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sessionDoneCh:
+			log.Printf("session of %v is ended, restart", s.name)
+			return true
+		case <-ticker.C:
+			if s.udcAttached() {
+				continue
+			}
+			log.Printf("usb device controller of %v is detached, restart", s.name)
+			close(sessionStopCh)
+			<-sessionDoneCh
+			return true
+		case <-s.stopCh:
+			close(sessionStopCh)
+			<-sessionDoneCh
+			return false
+		}
+	}
+}
+
+// returns false if stopped
+func (s *supervisor) backoff(interval time.Duration) bool {
+	select {
+	case <-time.After(interval):
+		return true
+	case <-s.stopCh:
+		return false
+	}
+}
+
+func (s *supervisor) superviseLoop(f *os.File) {
+	defer close(s.doneCh)
+	retryInterval := supervisorRetryInterval
+	for {
+		startTime := time.Now()
+		if !s.supervise(f) {
+			return
+		}
+		s.resetSession()
+		if time.Since(startTime) >= supervisorStableSession {
+			retryInterval = supervisorRetryInterval
+		}
+		if s.verbose {
+			log.Printf("wait %v before restart of %v", retryInterval, s.name)
+		}
+		if !s.backoff(retryInterval) {
+			return
+		}
+		retryInterval *= 2
+		if retryInterval > supervisorMaxRetryInterval {
+			retryInterval = supervisorMaxRetryInterval
+		}
+		f = s.openDevFile()
+		if f == nil {
+			return
+		}
+		if s.verbose {
+			log.Printf("restart session of %v", s.name)
+		}
+	}
+}
+
+// the first device file is opened synchronously to return the error
+func (s *supervisor) start() error {
+	f, err := os.OpenFile(s.devFilePath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("can not open device file (%v) in %v: %w", s.devFilePath, s.name, err)
+	}
+	go s.superviseLoop(f)
+	return nil
+}
+
+func (s *supervisor) stop() {
+	close(s.stopCh)
+	<-s.doneCh
+}
+
+// udc is the name in /sys/class/udc, "" does not watch the state
+func newSupervisor(verbose bool, name string, devFilePath string, udc string, runSession supervisedSession, resetSession supervisedReset) *supervisor {
+	udcStatePath := ""
+	if udc != "" {
+		udcStatePath = filepath.Join("/sys/class/udc", udc, "state")
+	}
+	return &supervisor{
+		verbose: verbose,
+		name: name,
+		devFilePath: devFilePath,
+		udcStatePath: udcStatePath,
+		runSession: runSession,
+		resetSession: resetSession,
+		stopCh: make(chan int),
+		doneCh: make(chan int),
+	}
+}
@@ -0,0 +1,225 @@
+package gamepad
+
+//
+// turbo (autofire) synchronized to input reports
+//
+
+import (
+	"log"
+	"github.com/potix/regapweb/message"
+)
+
+const (
+	turboFrameHookName string = "turbo"
+	turboDefaultFrames int    = 4
+)
+
+// TurboButton presses Button for Frames input reports and releases it for Frames input reports
+// while the user holds Button. Enable is initial state.
+type TurboButton struct {
+	Button ButtonName
+	Frames int
+	Enable bool
+}
+
+// button indices of GamepadState (W3C standard gamepad), several indices can be one button
+var standardButtonIndices map[ButtonName][]int = map[ButtonName][]int{
+	ButtonB: []int{ 0 },
+	ButtonA: []int{ 1 },
+	ButtonY: []int{ 2 },
+	ButtonX: []int{ 3 },
+	ButtonL: []int{ 4 },
+	ButtonR: []int{ 5 },
+	ButtonZL: []int{ 6 },
+	ButtonZR: []int{ 7 },
+	ButtonMinus: []int{ 8 },
+	ButtonPlus: []int{ 9 },
+	ButtonStickL: []int{ 10 },
+	ButtonStickR: []int{ 11 },
+	ButtonUp: []int{ 12 },
+	ButtonDown: []int{ 13 },
+	ButtonLeft: []int{ 14 },
+	ButtonRight: []int{ 15 },
+	ButtonHome: []int{ 16 },
+	ButtonCapture: []int{ 17 },
+}
+
+// joy-con (L) is held sideways, face buttons are the direction buttons
+var joyConLButtonIndices map[ButtonName][]int = map[ButtonName][]int{
+	ButtonLeft: []int{ 0 },
+	ButtonDown: []int{ 1 },
+	ButtonUp: []int{ 2 },
+	ButtonRight: []int{ 3 },
+	ButtonLeftSL: []int{ 4 },
+	ButtonLeftSR: []int{ 5 },
+	ButtonMinus: []int{ 8, 9 },
+	ButtonStickL: []int{ 10, 11 },
+	ButtonCapture: []int{ 16, 17 },
+}
+
+var joyConRButtonIndices map[ButtonName][]int = map[ButtonName][]int{
+	ButtonA: []int{ 0 },
+	ButtonX: []int{ 1 },
+	ButtonB: []int{ 2 },
+	ButtonY: []int{ 3 },
+	ButtonRightSL: []int{ 4 },
+	ButtonRightSR: []int{ 5 },
+	ButtonPlus: []int{ 8, 9 },
+	ButtonStickR: []int{ 10, 11 },
+	ButtonHome: []int{ 16, 17 },
+}
+
+func buttonIndices(model GamepadModel) map[ButtonName][]int {
+	switch model {
+	case ModelNSJoyConL:
+		return joyConLButtonIndices
+	case ModelNSJoyConR:
+		return joyConRButtonIndices
+	default:
+		return standardButtonIndices
+	}
+}
+
+type turboState struct {
+	frames     int
+	startFrame uint64
+	started    bool
+}
+
+func (g *Gamepad) turboFrames(button ButtonName) int {
+	for _, turboButton := range g.opts.turboButtons {
+		if turboButton.Button == button && turboButton.Frames > 0 {
+			return turboButton.Frames
+		}
+	}
+	return turboDefaultFrames
+}
+
+func (g *Gamepad) onTurboFrame(frame uint64) {
+	g.turboMutex.Lock()
+	defer g.turboMutex.Unlock()
+	press := make([]ButtonName, 0, len(g.turboStates))
+	release := make([]ButtonName, 0, len(g.turboStates))
+	for button, state := range g.turboStates {
+		if !g.heldButtons[button] {
+			// the user input is passed through, the next hold starts with a press
+			if state.started {
+				release = append(release, button)
+				state.started = false
+			}
+			continue
+		}
+		if !state.started {
+			state.startFrame = frame
+			state.started = true
+		}
+		// applied every frame while held, so turbo wins over the other inputs
+		if (frame - state.startFrame) / uint64(state.frames) % 2 == 0 {
+			press = append(press, button)
+		} else {
+			release = append(release, button)
+		}
+	}
+	if len(press) > 0 {
+		if err := g.backendIf.Press(press); err != nil {
+			log.Printf("can not press turbo buttons: %v", err)
+		}
+	}
+	if len(release) > 0 {
+		if err := g.backendIf.Release(release); err != nil {
+			log.Printf("can not release turbo buttons: %v", err)
+		}
+	}
+}
+
+// frames <= 0 uses frames of the config
+func (g *Gamepad) EnableTurbo(button ButtonName, frames int) {
+	if frames <= 0 {
+		frames = g.turboFrames(button)
+	}
+	g.turboMutex.Lock()
+	defer g.turboMutex.Unlock()
+	if g.verbose {
+		log.Printf("enable turbo: button = %v, frames = %v", button, frames)
+	}
+	g.turboStates[button] = &turboState{
+		frames: frames,
+		startFrame: 0,
+		started: false,
+	}
+	if len(g.turboStates) == 1 {
+		g.backendIf.AddFrameHook(turboFrameHookName, g.onTurboFrame)
+	}
+}
+
+func (g *Gamepad) DisableTurbo(button ButtonName) {
+	g.turboMutex.Lock()
+	defer g.turboMutex.Unlock()
+	_, ok := g.turboStates[button]
+	if !ok {
+		return
+	}
+	if g.verbose {
+		log.Printf("disable turbo: button = %v", button)
+	}
+	delete(g.turboStates, button)
+	if len(g.turboStates) == 0 {
+		g.backendIf.RemoveFrameHook(turboFrameHookName)
+	}
+	// back to the user input
+	if g.heldButtons[button] {
+		if err := g.backendIf.Press([]ButtonName{ button }); err != nil {
+			log.Printf("can not press turbo button: %v", err)
+		}
+		return
+	}
+	if err := g.backendIf.Release([]ButtonName{ button }); err != nil {
+		log.Printf("can not release turbo button: %v", err)
+	}
+}
+
+// buttons held by the user, turbo toggles only held buttons
+func (g *Gamepad) updateHeldButtons(state *message.GamepadState) {
+	g.turboMutex.Lock()
+	defer g.turboMutex.Unlock()
+	for button, indices := range g.buttonIndices {
+		held := false
+		for _, i := range indices {
+			if i < len(state.Buttons) && state.Buttons[i] != nil && state.Buttons[i].Pressed {
+				held = true
+			}
+		}
+		g.heldButtons[button] = held
+	}
+}
+
+func (g *Gamepad) setHeldButtons(buttons []ButtonName, held bool) {
+	g.turboMutex.Lock()
+	defer g.turboMutex.Unlock()
+	for _, button := range buttons {
+		g.heldButtons[button] = held
+	}
+}
+
+func (g *Gamepad) ToggleTurbo(button ButtonName) {
+	g.turboMutex.Lock()
+	_, ok := g.turboStates[button]
+	g.turboMutex.Unlock()
+	if ok {
+		g.DisableTurbo(button)
+	} else {
+		g.EnableTurbo(button, 0)
+	}
+}
+
+func (g *Gamepad) disableAllTurbo() {
+	g.turboMutex.Lock()
+	buttons := make([]ButtonName, 0, len(g.turboStates))
+	for button, _ := range g.turboStates {
+		buttons = append(buttons, button)
+	}
+	g.turboMutex.Unlock()
+	for _, button := range buttons {
+		g.DisableTurbo(button)
+	}
+}
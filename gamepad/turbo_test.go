@@ -0,0 +1,103 @@
+package gamepad
+
+import (
+	"testing"
+	"github.com/potix/regapweb/message"
+)
+
+func TestTurboFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		state  bool /* input by UpdateState instead of Press/Release */
+		held   []bool
+		want   []bool
+	}{
+		{
+			name: "held",
+			frames: 2,
+			held: []bool{ true, true, true, true, true, true },
+			want: []bool{ true, true, false, false, true, true },
+		},
+		{
+			name: "not held",
+			frames: 2,
+			held: []bool{ false, false, false, false },
+			want: []bool{ false, false, false, false },
+		},
+		{
+			name: "released and held again",
+			frames: 2,
+			held: []bool{ true, true, true, false, false, true, true, true },
+			want: []bool{ true, true, false, false, false, true, true, false },
+		},
+		{
+			name: "held by state",
+			frames: 1,
+			state: true,
+			held: []bool{ true, true, true, false, true },
+			want: []bool{ true, false, true, false, true },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, backend := newTestGamepad(t)
+			g.EnableTurbo(ButtonA, tt.frames)
+			for i, held := range tt.held {
+				var err error
+				if tt.state {
+					buttons := make([]*message.GamepadButtonState, 2)
+					buttons[0] = &message.GamepadButtonState{}
+					buttons[1] = &message.GamepadButtonState{ Pressed: held }
+					err = g.UpdateState(&message.GamepadState{ Buttons: buttons, Axes: []float64{} })
+				} else if held {
+					err = g.Press(ButtonA)
+				} else {
+					err = g.Release(ButtonA)
+				}
+				if err != nil {
+					t.Fatalf("can not input: %v", err)
+				}
+				backend.RunFrameHooks()
+				pressed := len(backend.pressedButtons()) > 0
+				if pressed != tt.want[i] {
+					t.Errorf("frame %v: pressed = %v, want %v", i, pressed, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDisableTurbo(t *testing.T) {
+	tests := []struct {
+		name string
+		held bool
+	}{
+		{ name: "held", held: true },
+		{ name: "not held", held: false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, backend := newTestGamepad(t)
+			g.EnableTurbo(ButtonA, 1)
+			if err := g.Press(ButtonA); err != nil {
+				t.Fatalf("can not press: %v", err)
+			}
+			// release phase of turbo
+			backend.RunFrameHooks()
+			backend.RunFrameHooks()
+			if !tt.held {
+				if err := g.Release(ButtonA); err != nil {
+					t.Fatalf("can not release: %v", err)
+				}
+			}
+			g.DisableTurbo(ButtonA)
+			if pressed := len(backend.pressedButtons()) > 0; pressed != tt.held {
+				t.Errorf("pressed = %v, want %v", pressed, tt.held)
+			}
+			if count := backend.frameHookCount(); count != 0 {
+				t.Errorf("frame hooks = %v after turbo", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package gamepad
+
+import (
+	"github.com/potix/regapweb/message"
+)
+
+// GamepadVibrationMotor is vibration of one side of the controller.
+// frequency is Hz (0 = unknown), amplitude is 0.0 - 1.0.
+type GamepadVibrationMotor struct {
+	HighFrequency float64
+	HighAmplitude float64
+	LowFrequency  float64
+	LowAmplitude  float64
+}
+
+// GamepadVibration is message.GamepadVibration with per-side motors.
+// Stopped is true when the host stops the vibration.
+type GamepadVibration struct {
+	message.GamepadVibration
+	Left    *GamepadVibrationMotor `json:"Left,omitempty"`
+	Right   *GamepadVibrationMotor `json:"Right,omitempty"`
+	Stopped bool                   `json:"Stopped,omitempty"`
+}
+
+// vibration of the dual motor controllers (strong = left, weak = right)
+func newDualMotorVibration(strong byte, weak byte) *GamepadVibration {
+	// the motors keep running until the next output report
+	duration := float64(1000)
+	stopped := false
+	if weak == 0 && strong == 0 {
+		duration = 0
+		stopped = true
+	}
+	return &GamepadVibration{
+		GamepadVibration: message.GamepadVibration{
+			Duration:        duration,
+			StartDelay:      0,
+			StrongMagnitude: float64(strong) / 255.0,
+			WeakMagnitude:   float64(weak) / 255.0,
+		},
+		Left: &GamepadVibrationMotor{
+			LowAmplitude: float64(strong) / 255.0,
+		},
+		Right: &GamepadVibrationMotor{
+			HighAmplitude: float64(weak) / 255.0,
+		},
+		Stopped: stopped,
+	}
+}
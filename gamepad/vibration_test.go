@@ -0,0 +1,137 @@
+package gamepad
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeVibrationMotor(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes []byte
+		want  *GamepadVibrationMotor
+		err   bool
+	}{
+		{
+			name: "neutral",
+			bytes: []byte{ 0x00, 0x01, 0x40, 0x40 },
+			want: &GamepadVibrationMotor{ HighFrequency: 320, HighAmplitude: 0, LowFrequency: 160, LowAmplitude: 0 },
+		},
+		{
+			name: "full high, low with msb",
+			bytes: []byte{ 0x00, 0xc9, 0xc0, 0x64 },
+			want: &GamepadVibrationMotor{ HighFrequency: 320, HighAmplitude: 1.0, LowFrequency: 160, LowAmplitude: 0.559 },
+		},
+		{
+			name: "lowest frequencies",
+			bytes: []byte{ 0x00, 0x00, 0x80, 0x40 },
+			want: &GamepadVibrationMotor{ HighFrequency: 80, HighAmplitude: 0, LowFrequency: 40, LowAmplitude: 0.01 },
+		},
+		{ name: "unknown high amplitude", bytes: []byte{ 0x00, 0xcb, 0x40, 0x40 }, err: true },
+		{ name: "unknown low amplitude", bytes: []byte{ 0x00, 0x01, 0x40, 0x00 }, err: true },
+	}
+	n := &NSProCon{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := n.decodeVibrationMotor(tt.bytes)
+			if tt.err {
+				if err == nil {
+					t.Errorf("decodeVibrationMotor(%x) = %+v, want error", tt.bytes, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeVibrationMotor(%x): %v", tt.bytes, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeVibrationMotor(%x) = %+v, want %+v", tt.bytes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendVibrationRequest(t *testing.T) {
+	type wantVibration struct {
+		stopped bool
+		left    float64 /* high amplitude */
+		right   float64 /* low amplitude */
+	}
+	tests := []struct {
+		name   string
+		enable byte
+		bytes  []byte
+		want   *wantVibration /* nil = not sent */
+	}{
+		{ name: "disabled", enable: 0, bytes: []byte{ 0x00, 0xc9, 0x40, 0x40, 0x00, 0x01, 0x40, 0x40 }, want: nil },
+		{ name: "left", enable: 1, bytes: []byte{ 0x00, 0xc9, 0x40, 0x40, 0x00, 0x00, 0x00, 0x00 }, want: &wantVibration{ left: 1.0 } },
+		{ name: "right", enable: 1, bytes: []byte{ 0x00, 0x01, 0x40, 0x40, 0x00, 0x01, 0xc0, 0x64 }, want: &wantVibration{ right: 0.559 } },
+		{ name: "stop", enable: 1, bytes: []byte{ 0x00, 0x01, 0x40, 0x40, 0x00, 0x01, 0x40, 0x40 }, want: &wantVibration{ stopped: true } },
+		{ name: "already stopped", enable: 1, bytes: []byte{ 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 }, want: nil },
+	}
+	n := newTestNSProCon(t)
+	receivedCh := make(chan *GamepadVibration, 1)
+	n.StartVibrationListener(func(v *GamepadVibration) {
+		receivedCh <- v
+	})
+	defer n.StopVibrationListener()
+	for _, tt := range tests {
+		n.vibrationEnable = tt.enable
+		if err := n.sendVibrationRequest(tt.bytes); err != nil {
+			t.Fatalf("%v: can not send vibration request: %v", tt.name, err)
+		}
+		if tt.want == nil {
+			select {
+			case v := <-receivedCh:
+				t.Errorf("%v: vibration = %+v, want none", tt.name, v)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case v := <-receivedCh:
+			if v.Stopped != tt.want.stopped {
+				t.Errorf("%v: stopped = %v, want %v", tt.name, v.Stopped, tt.want.stopped)
+			}
+			if tt.want.stopped {
+				continue
+			}
+			if v.Left.HighAmplitude != tt.want.left || v.Right.LowAmplitude != tt.want.right {
+				t.Errorf("%v: left = %+v, right = %+v", tt.name, v.Left, v.Right)
+			}
+			if v.StrongMagnitude != math.Max(v.Left.HighAmplitude, v.Right.HighAmplitude) {
+				t.Errorf("%v: strong magnitude = %v", tt.name, v.StrongMagnitude)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: vibration is not sent", tt.name)
+		}
+	}
+}
+
+func TestNewDualMotorVibration(t *testing.T) {
+	tests := []struct {
+		name    string
+		strong  byte
+		weak    byte
+		stopped bool
+	}{
+		{ name: "stopped", strong: 0, weak: 0, stopped: true },
+		{ name: "strong", strong: 255, weak: 0 },
+		{ name: "weak", strong: 0, weak: 51 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newDualMotorVibration(tt.strong, tt.weak)
+			if v.Stopped != tt.stopped {
+				t.Errorf("stopped = %v, want %v", v.Stopped, tt.stopped)
+			}
+			if v.StrongMagnitude != float64(tt.strong) / 255.0 || v.Left.LowAmplitude != v.StrongMagnitude {
+				t.Errorf("strong = %v, left = %+v", v.StrongMagnitude, v.Left)
+			}
+			if v.WeakMagnitude != float64(tt.weak) / 255.0 || v.Right.HighAmplitude != v.WeakMagnitude {
+				t.Errorf("weak = %v, right = %+v", v.WeakMagnitude, v.Right)
+			}
+		})
+	}
+}
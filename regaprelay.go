@@ -1,15 +1,20 @@
 package main
 
 import (
+        "encoding/hex"
         "encoding/json"
         "flag"
+        "fmt"
         "github.com/potix/utils/signal"
         "github.com/potix/utils/configurator"
         "github.com/potix/regaprelay/gamepad"
+        "github.com/potix/regaprelay/gamepad/setup"
         "github.com/potix/regaprelay/client"
         "github.com/potix/regaprelay/watcher"
         "log"
         "log/syslog"
+        "strings"
+        "time"
 )
 
 type regaprelayTcpClientConfig struct {
@@ -19,19 +24,104 @@ type regaprelayTcpClientConfig struct {
 	SkipVerify     bool   `toml:"skipVerify`
 }
 
+type regaprelayStickShapeConfig struct {
+	InnerDeadzone float64 `toml:"innerDeadzone"`
+	OuterDeadzone float64 `toml:"outerDeadzone"`
+	AntiDeadzone  float64 `toml:"antiDeadzone"`
+	Curve         float64 `toml:"curve"`
+	RadialClamp   bool    `toml:"radialClamp"`
+}
+
+// pairs of [source index, destination index]
+type regaprelayRemapProfileConfig struct {
+	Name       string  `toml:"name"`
+	ButtonMap  [][]int `toml:"buttonMap"`
+	AxisMap    [][]int `toml:"axisMap"`
+	InvertAxes []int   `toml:"invertAxes"`
+}
+
+type regaprelayMacroStepConfig struct {
+	Press   []string  `toml:"press"`
+	Release []string  `toml:"release"`
+	StickL  []float64 `toml:"stickL"`
+	StickR  []float64 `toml:"stickR"`
+	Frames  int       `toml:"frames"`
+}
+
+type regaprelayMacroConfig struct {
+	Name  string                       `toml:"name"`
+	Steps []*regaprelayMacroStepConfig `toml:"steps"`
+}
+
+type regaprelayTurboConfig struct {
+	Button string `toml:"button"`
+	Frames int    `toml:"frames"`
+	Enable bool   `toml:"enable"`
+}
+
+// colors are "rrggbb", firmwareVersion is "major.minor" (e.g. "3.72")
+type regaprelayIdentityConfig struct {
+	BodyColor       string `toml:"bodyColor"`
+	ButtonColor     string `toml:"buttonColor"`
+	LeftGripColor   string `toml:"leftGripColor"`
+	RightGripColor  string `toml:"rightGripColor"`
+	Serial          string `toml:"serial"`
+	FirmwareVersion string `toml:"firmwareVersion"`
+	BatteryLevel    *int   `toml:"batteryLevel"`
+	Charging        bool   `toml:"charging"`
+}
+
+// type is hid, acm or ecm. hid without reportDesc is the same device as the gamepad
+type regaprelayGadgetFunctionConfig struct {
+	Type         string `toml:"type"`
+	Instance     string `toml:"instance"`
+	Protocol     string `toml:"protocol"`
+	Subclass     string `toml:"subclass"`
+	ReportLength string `toml:"reportLength"`
+	ReportDesc   string `toml:"reportDesc"`
+	HostAddr     string `toml:"hostAddr"`
+	DevAddr      string `toml:"devAddr"`
+}
+
 type regaprelayGamepadConfig struct {
-	Model       gamepad.GamepadModel `toml:model`
-	MacAddr     string               `toml:macAddr`
-	SpiMemory60 string               `toml:spiMemory60`
-	SpiMemory80 string               `toml:spiMemory80`
-	DevFilePath string               `toml:devFilePath`
-	ConfigsHome string               `toml:configsHome`
-	Udc         string               `toml:udc`
+	Model             gamepad.GamepadModel              `toml:"model"`
+	MacAddr           string                            `toml:"macAddr"`
+	SpiMemory60       string                            `toml:"spiMemory60"`
+	SpiMemory80       string                            `toml:"spiMemory80"`
+	SpiFlashFile      string                            `toml:"spiFlashFile"`
+	DevFilePath       string                            `toml:"devFilePath"`
+	ConfigsHome       string                            `toml:"configsHome"`
+	Udc               string                            `toml:"udc"`
+	LeftStick         *regaprelayStickShapeConfig       `toml:"leftStick"`
+	RightStick        *regaprelayStickShapeConfig       `toml:"rightStick"`
+	RemapProfile      string                            `toml:"remapProfile"`
+	RemapProfiles     []*regaprelayRemapProfileConfig   `toml:"remapProfiles"`
+	Macros            []*regaprelayMacroConfig          `toml:"macros"`
+	Turbo             []*regaprelayTurboConfig          `toml:"turbo"`
+	RecordDir         string                            `toml:"recordDir"`
+	HidCapture        string                            `toml:"hidCapture"`
+	ReportRate        float64                           `toml:"reportRate"`
+	EventDrivenReport bool                              `toml:"eventDrivenReport"`
+	MinReportInterval int                               `toml:"minReportInterval"`
+	Identity          *regaprelayIdentityConfig         `toml:"identity"`
+	GadgetFunctions   []*regaprelayGadgetFunctionConfig `toml:"gadgetFunctions"`
+	McuReport         bool                              `toml:"mcuReport"`
+	AmiiboDir         string                            `toml:"amiiboDir"`
+	Amiibo            string                            `toml:"amiibo"`
 }
 
 type regaprelayWatcherConfig struct {
-	Enable         bool   `toml:enable`
-	KeyboardDevice string `toml:keyboardDevice`
+	Enable         bool              `toml:"enable"`
+	KeyboardDevice string            `toml:"keyboardDevice"`
+	MacroKeys      map[string]string `toml:"macroKeys"`
+	MacroCancelKey string            `toml:"macroCancelKey"`
+	TurboKeys      map[string]string `toml:"turboKeys"`
+}
+
+type regaprelayReplayConfig struct {
+	Enable bool    `toml:"enable"`
+	File   string  `toml:"file"`
+	Speed  float64 `toml:"speed"`
 }
 
 type regaprelayLogConfig struct {
@@ -43,9 +133,211 @@ type regaprelayConfig struct {
         TcpClient *regaprelayTcpClientConfig `toml:"tcpClient"`
         Gamepad   *regaprelayGamepadConfig   `toml:"gamepad"`
         Watcher   *regaprelayWatcherConfig   `toml:"watcher"`
+        Replay    *regaprelayReplayConfig    `toml:"replay"`
         Log       *regaprelayLogConfig       `toml:"log"`
 }
 
+func newStickShape(config *regaprelayStickShapeConfig) *gamepad.StickShape {
+	if config == nil {
+		return nil
+	}
+	return &gamepad.StickShape{
+		InnerDeadzone: config.InnerDeadzone,
+		OuterDeadzone: config.OuterDeadzone,
+		AntiDeadzone: config.AntiDeadzone,
+		Curve: config.Curve,
+		RadialClamp: config.RadialClamp,
+	}
+}
+
+func newRemapProfiles(configs []*regaprelayRemapProfileConfig) ([]*gamepad.RemapProfile, error) {
+	remapProfiles := make([]*gamepad.RemapProfile, 0, len(configs))
+	for _, config := range configs {
+		remapProfile := &gamepad.RemapProfile{
+			Name: config.Name,
+			ButtonMap: make(map[int]int),
+			AxisMap: make(map[int]int),
+			InvertAxes: config.InvertAxes,
+		}
+		for _, pair := range config.ButtonMap {
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid button map in remap profile (%v): %v", config.Name, pair)
+			}
+			remapProfile.ButtonMap[pair[0]] = pair[1]
+		}
+		for _, pair := range config.AxisMap {
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid axis map in remap profile (%v): %v", config.Name, pair)
+			}
+			remapProfile.AxisMap[pair[0]] = pair[1]
+		}
+		remapProfiles = append(remapProfiles, remapProfile)
+	}
+	return remapProfiles, nil
+}
+
+func newButtonNames(names []string) ([]gamepad.ButtonName, error) {
+	buttonNames := make([]gamepad.ButtonName, 0, len(names))
+	for _, name := range names {
+		buttonName, err := gamepad.ButtonNameFromString(name)
+		if err != nil {
+			return nil, err
+		}
+		buttonNames = append(buttonNames, buttonName)
+	}
+	return buttonNames, nil
+}
+
+func newMacroStick(axes []float64) (*gamepad.MacroStick, error) {
+	if axes == nil {
+		return nil, nil
+	}
+	if len(axes) != 2 {
+		return nil, fmt.Errorf("invalid stick: %v", axes)
+	}
+	return &gamepad.MacroStick{ X: axes[0], Y: axes[1] }, nil
+}
+
+func newMacros(configs []*regaprelayMacroConfig) ([]*gamepad.Macro, error) {
+	macros := make([]*gamepad.Macro, 0, len(configs))
+	for _, config := range configs {
+		macro := &gamepad.Macro{
+			Name: config.Name,
+			Steps: make([]*gamepad.MacroStep, 0, len(config.Steps)),
+		}
+		for i, stepConfig := range config.Steps {
+			press, err := newButtonNames(stepConfig.Press)
+			if err != nil {
+				return nil, fmt.Errorf("invalid press in macro (%v:%v): %w", config.Name, i, err)
+			}
+			release, err := newButtonNames(stepConfig.Release)
+			if err != nil {
+				return nil, fmt.Errorf("invalid release in macro (%v:%v): %w", config.Name, i, err)
+			}
+			stickL, err := newMacroStick(stepConfig.StickL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stickL in macro (%v:%v): %w", config.Name, i, err)
+			}
+			stickR, err := newMacroStick(stepConfig.StickR)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stickR in macro (%v:%v): %w", config.Name, i, err)
+			}
+			macro.Steps = append(macro.Steps, &gamepad.MacroStep{
+				Press: press,
+				Release: release,
+				StickL: stickL,
+				StickR: stickR,
+				Frames: stepConfig.Frames,
+			})
+		}
+		macros = append(macros, macro)
+	}
+	return macros, nil
+}
+
+func newTurboButtons(configs []*regaprelayTurboConfig) ([]*gamepad.TurboButton, error) {
+	turboButtons := make([]*gamepad.TurboButton, 0, len(configs))
+	for _, config := range configs {
+		button, err := gamepad.ButtonNameFromString(config.Button)
+		if err != nil {
+			return nil, fmt.Errorf("invalid button in turbo: %w", err)
+		}
+		turboButtons = append(turboButtons, &gamepad.TurboButton{
+			Button: button,
+			Frames: config.Frames,
+			Enable: config.Enable,
+		})
+	}
+	return turboButtons, nil
+}
+
+func newColor(color string) ([]byte, error) {
+	if color == "" {
+		return nil, nil
+	}
+	decoded, err := hex.DecodeString(strings.TrimPrefix(color, "#"))
+	if err != nil {
+		return nil, fmt.Errorf("can not decode color (%v): %w", color, err)
+	}
+	if len(decoded) != 3 {
+		return nil, fmt.Errorf("invalid color: %v", color)
+	}
+	return decoded, nil
+}
+
+func newFirmwareVersion(firmwareVersion string) ([]byte, error) {
+	if firmwareVersion == "" {
+		return nil, nil
+	}
+	var major, minor uint8
+	_, err := fmt.Sscanf(firmwareVersion, "%d.%d", &major, &minor)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse firmware version (%v): %w", firmwareVersion, err)
+	}
+	return []byte{ major, minor }, nil
+}
+
+func newIdentity(config *regaprelayIdentityConfig) (*gamepad.NSIdentity, error) {
+	if config == nil {
+		return nil, nil
+	}
+	identity := &gamepad.NSIdentity{
+		Serial: config.Serial,
+	}
+	colors := []struct {
+		dst   *[]byte
+		color string
+	}{
+		{ &identity.BodyColor, config.BodyColor },
+		{ &identity.ButtonColor, config.ButtonColor },
+		{ &identity.LeftGripColor, config.LeftGripColor },
+		{ &identity.RightGripColor, config.RightGripColor },
+	}
+	for _, c := range colors {
+		color, err := newColor(c.color)
+		if err != nil {
+			return nil, err
+		}
+		*c.dst = color
+	}
+	firmwareVersion, err := newFirmwareVersion(config.FirmwareVersion)
+	if err != nil {
+		return nil, err
+	}
+	identity.FirmwareVersion = firmwareVersion
+	if config.BatteryLevel != nil {
+		identity.Battery = &gamepad.GamepadBattery{
+			Level: *config.BatteryLevel,
+			Charging: config.Charging,
+		}
+	}
+	return identity, nil
+}
+
+func newGadgetFunctions(configs []*regaprelayGadgetFunctionConfig) ([]*setup.UsbGadgetFunction, error) {
+	functions := make([]*setup.UsbGadgetFunction, 0, len(configs))
+	for _, config := range configs {
+		if config.Instance == "" {
+			return nil, fmt.Errorf("no instance of gadget function: %v", config.Type)
+		}
+		switch config.Type {
+		case "hid":
+			if config.ReportDesc == "" {
+				functions = append(functions, &setup.UsbGadgetFunction{ FunctionName: "hid", InstanceName: config.Instance })
+			} else {
+				functions = append(functions, setup.NewUsbGadgetHidFunction(config.Instance, config.Protocol, config.Subclass, config.ReportLength, config.ReportDesc))
+			}
+		case "acm":
+			functions = append(functions, setup.NewUsbGadgetAcmFunction(config.Instance))
+		case "ecm":
+			functions = append(functions, setup.NewUsbGadgetEcmFunction(config.Instance, config.HostAddr, config.DevAddr))
+		default:
+			return nil, fmt.Errorf("unsupported gadget function: %v", config.Type)
+		}
+	}
+	return functions, nil
+}
+
 type commandArguments struct {
         configFile string
 }
@@ -89,12 +381,60 @@ func main() {
 	// setup gamepad
         gVerboseOpt := gamepad.GamepadVerbose(conf.Verbose)
         gDevFilePathOpt := gamepad.GamepadDevFilePath(conf.Gamepad.DevFilePath)
+        gSpiFlashFileOpt := gamepad.GamepadSpiFlashFile(conf.Gamepad.SpiFlashFile)
         gConfigsHomeOpt := gamepad.GamepadConfigsHome(conf.Gamepad.ConfigsHome)
         gUdcOpt := gamepad.GamepadUdc(conf.Gamepad.Udc)
-        newGamepad, err := gamepad.NewGamepad(conf.Gamepad.Model, conf.Gamepad.MacAddr, conf.Gamepad.SpiMemory60, conf.Gamepad.SpiMemory80, gDevFilePathOpt, gConfigsHomeOpt, gUdcOpt, gVerboseOpt)
+        gLeftStickShapeOpt := gamepad.GamepadLeftStickShape(newStickShape(conf.Gamepad.LeftStick))
+        gRightStickShapeOpt := gamepad.GamepadRightStickShape(newStickShape(conf.Gamepad.RightStick))
+	remapProfiles, err := newRemapProfiles(conf.Gamepad.RemapProfiles)
+	if err != nil {
+		log.Fatalf("can not create remap profiles: %v", err)
+	}
+        gRemapProfilesOpt := gamepad.GamepadRemapProfiles(remapProfiles)
+        gRemapProfileOpt := gamepad.GamepadRemapProfile(conf.Gamepad.RemapProfile)
+	macros, err := newMacros(conf.Gamepad.Macros)
+	if err != nil {
+		log.Fatalf("can not create macros: %v", err)
+	}
+        gMacrosOpt := gamepad.GamepadMacros(macros)
+	turboButtons, err := newTurboButtons(conf.Gamepad.Turbo)
+	if err != nil {
+		log.Fatalf("can not create turbo buttons: %v", err)
+	}
+        gTurboButtonsOpt := gamepad.GamepadTurboButtons(turboButtons)
+        gRecordDirOpt := gamepad.GamepadRecordDir(conf.Gamepad.RecordDir)
+        gHidCaptureFileOpt := gamepad.GamepadHidCaptureFile(conf.Gamepad.HidCapture)
+        gReportRateOpt := gamepad.GamepadReportRate(conf.Gamepad.ReportRate)
+	minReportInterval := gamepad.DefaultMinReportInterval
+	if conf.Gamepad.MinReportInterval > 0 {
+		minReportInterval = time.Duration(conf.Gamepad.MinReportInterval) * time.Millisecond
+	}
+        gEventDrivenReportOpt := gamepad.GamepadEventDrivenReport(conf.Gamepad.EventDrivenReport, minReportInterval)
+	identity, err := newIdentity(conf.Gamepad.Identity)
+	if err != nil {
+		log.Fatalf("can not create identity: %v", err)
+	}
+        gIdentityOpt := gamepad.GamepadIdentity(identity)
+	gadgetFunctions, err := newGadgetFunctions(conf.Gamepad.GadgetFunctions)
+	if err != nil {
+		log.Fatalf("can not create gadget functions: %v", err)
+	}
+        gGadgetFunctionsOpt := gamepad.GamepadGadgetFunctions(gadgetFunctions)
+        gMcuReportOpt := gamepad.GamepadMcuReport(conf.Gamepad.McuReport)
+        gAmiiboDirOpt := gamepad.GamepadAmiiboDir(conf.Gamepad.AmiiboDir)
+        gAmiiboFileOpt := gamepad.GamepadAmiiboFile(conf.Gamepad.Amiibo)
+        newGamepad, err := gamepad.NewGamepad(conf.Gamepad.Model, conf.Gamepad.MacAddr, conf.Gamepad.SpiMemory60, conf.Gamepad.SpiMemory80, gDevFilePathOpt, gSpiFlashFileOpt, gConfigsHomeOpt, gUdcOpt, gLeftStickShapeOpt, gRightStickShapeOpt, gRemapProfilesOpt, gRemapProfileOpt, gMacrosOpt, gTurboButtonsOpt, gRecordDirOpt, gHidCaptureFileOpt, gReportRateOpt, gEventDrivenReportOpt, gIdentityOpt, gGadgetFunctionsOpt, gMcuReportOpt, gAmiiboDirOpt, gAmiiboFileOpt, gVerboseOpt)
 	if err != nil {
 		log.Fatalf("can not create gamepad: %v", err)
 	}
+	if len(gadgetFunctions) > 0 {
+		devFiles, err := newGamepad.GadgetHidDevFiles()
+		if err != nil {
+			log.Printf("can not get device files of hid functions: %v", err)
+		} else {
+			log.Printf("device files of hid functions: %v", devFiles)
+		}
+	}
 	// setup tcp client
         tcVerboseOpt := client.TcpClientVerbose(conf.Verbose)
 	tcSkipVerify := client.TcpClientSkipVerify(conf.TcpClient.SkipVerify)
@@ -106,11 +446,24 @@ func main() {
 	if conf.Watcher.Enable {
 		// setup watcher
 		kwVerboseOpt := watcher.KeyboardWatcherVerbose(conf.Verbose)
-		newKeyboardWatcher, err = watcher.NewKeyboardWatcher(newGamepad, conf.Watcher.KeyboardDevice, watcher.ModeBulk, kwVerboseOpt)
+		kwMacroKeysOpt := watcher.KeyboardWatcherMacroKeys(conf.Watcher.MacroKeys)
+		kwMacroCancelKeyOpt := watcher.KeyboardWatcherMacroCancelKey(conf.Watcher.MacroCancelKey)
+		kwTurboKeysOpt := watcher.KeyboardWatcherTurboKeys(conf.Watcher.TurboKeys)
+		newKeyboardWatcher, err = watcher.NewKeyboardWatcher(newGamepad, conf.Watcher.KeyboardDevice, watcher.ModeBulk, kwMacroKeysOpt, kwMacroCancelKeyOpt, kwTurboKeysOpt, kwVerboseOpt)
 		if err != nil {
 			 log.Fatalf("can not create keyboard watcher: %v", err)
 		}
 	}
+	var newReplayer *gamepad.Replayer
+	if conf.Replay != nil && conf.Replay.Enable {
+		// setup replayer
+		rVerboseOpt := gamepad.ReplayerVerbose(conf.Verbose)
+		rSpeedOpt := gamepad.ReplayerSpeed(conf.Replay.Speed)
+		newReplayer, err = gamepad.NewReplayer(newGamepad, conf.Replay.File, rSpeedOpt, rVerboseOpt)
+		if err != nil {
+			 log.Fatalf("can not create replayer: %v", err)
+		}
+	}
 	err = newGamepad.Start()
 	if err != nil {
 		log.Fatalf("can not start gamepad: %v", err)
@@ -122,7 +475,13 @@ func main() {
 	if newKeyboardWatcher != nil {
 		newKeyboardWatcher.Start()
 	}
+	if newReplayer != nil {
+		newReplayer.Start()
+	}
         signal.SignalWait(nil)
+	if newReplayer != nil {
+		newReplayer.Stop()
+	}
 	if newKeyboardWatcher != nil {
 		newKeyboardWatcher.Stop()
 	}
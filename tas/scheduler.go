@@ -0,0 +1,186 @@
+package tas
+
+//
+// frame-accurate input scheduler
+//
+// inputs are written to the backend without stick shaping and remapping,
+// so playback is the same with any gamepad config. do not run macros or turbo while playing.
+//
+
+import (
+	"log"
+	"sync"
+	"github.com/potix/regaprelay/gamepad"
+)
+
+const (
+	schedulerFrameHookName string = "tas"
+)
+
+type Stick struct {
+	X float64
+	Y float64
+}
+
+// FrameInput is the whole input state, held until the next scheduled input.
+// Buttons not in Buttons are released.
+type FrameInput struct {
+	Buttons []gamepad.ButtonName
+	StickL  Stick
+	StickR  Stick
+}
+
+type schedulerOptions struct {
+        verbose bool
+}
+
+func defaultSchedulerOptions() *schedulerOptions {
+        return &schedulerOptions {
+                verbose: false,
+        }
+}
+
+type SchedulerOption func(*schedulerOptions)
+
+func SchedulerVerbose(verbose bool) SchedulerOption {
+        return func(opts *schedulerOptions) {
+                opts.verbose = verbose
+        }
+}
+
+type Scheduler struct {
+	verbose    bool
+	gamepad    *gamepad.Gamepad
+	inputs     map[uint64]*FrameInput
+	lastFrame  uint64
+	startFrame uint64
+	started    bool
+	running    bool
+	pressed    map[gamepad.ButtonName]bool
+	doneCh     chan int
+	mutex      sync.Mutex
+}
+
+// frame is relative to the first report after Start
+func (s *Scheduler) Schedule(frame uint64, input *FrameInput) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inputs[frame] = input
+	if frame > s.lastFrame {
+		s.lastFrame = frame
+	}
+}
+
+// caller must hold the mutex
+func (s *Scheduler) apply(input *FrameInput) {
+	buttons := make(map[gamepad.ButtonName]bool)
+	for _, button := range input.Buttons {
+		buttons[button] = true
+	}
+	release := make([]gamepad.ButtonName, 0, len(s.pressed))
+	for button, _ := range s.pressed {
+		if !buttons[button] {
+			release = append(release, button)
+		}
+	}
+	if len(release) > 0 {
+		if err := s.gamepad.ReleaseRaw(release...); err != nil {
+			log.Printf("can not release buttons: %v", err)
+		}
+	}
+	if len(input.Buttons) > 0 {
+		if err := s.gamepad.PressRaw(input.Buttons...); err != nil {
+			log.Printf("can not press buttons: %v", err)
+		}
+	}
+	s.pressed = buttons
+	if err := s.gamepad.StickLRaw(input.StickL.X, input.StickL.Y); err != nil {
+		log.Printf("can not move left stick: %v", err)
+	}
+	if err := s.gamepad.StickRRaw(input.StickR.X, input.StickR.Y); err != nil {
+		log.Printf("can not move right stick: %v", err)
+	}
+}
+
+// caller must hold the mutex
+func (s *Scheduler) finish() {
+	if !s.running {
+		return
+	}
+	s.running = false
+	s.gamepad.RemoveFrameHook(schedulerFrameHookName)
+	s.apply(&FrameInput{})
+	close(s.doneCh)
+}
+
+func (s *Scheduler) onFrame(frame uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.running {
+		return
+	}
+	if !s.started {
+		s.startFrame = frame
+		s.started = true
+	}
+	relFrame := frame - s.startFrame
+	if relFrame > s.lastFrame {
+		if s.verbose {
+			log.Printf("finish schedule: frame = %v", relFrame)
+		}
+		s.finish()
+		return
+	}
+	input, ok := s.inputs[relFrame]
+	if !ok {
+		return
+	}
+	if s.verbose {
+		log.Printf("apply input: frame = %v, input = %+v", relFrame, input)
+	}
+	s.apply(input)
+}
+
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	s.started = false
+	s.doneCh = make(chan int)
+	s.gamepad.AddFrameHook(schedulerFrameHookName, s.onFrame)
+}
+
+// release all inputs
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.finish()
+}
+
+// closed when all inputs are applied or stopped, call after Start
+func (s *Scheduler) Done() <-chan int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.doneCh
+}
+
+func NewScheduler(gpad *gamepad.Gamepad, opts ...SchedulerOption) *Scheduler {
+        baseOpts := defaultSchedulerOptions()
+        for _, opt := range opts {
+                if opt == nil {
+                        continue
+                }
+                opt(baseOpts)
+        }
+	return &Scheduler{
+		verbose: baseOpts.verbose,
+		gamepad: gpad,
+		inputs: make(map[uint64]*FrameInput),
+		lastFrame: 0,
+		pressed: make(map[gamepad.ButtonName]bool),
+		doneCh: make(chan int),
+	}
+}
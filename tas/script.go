@@ -0,0 +1,180 @@
+package tas
+
+//
+// nx-TAS script
+//
+// each line is "<frame> <keys> <left stick> <right stick>"
+//   e.g. "120 KEY_A;KEY_ZR 0;32767 0;0"
+// keys are separated by ';' or NONE, sticks are "x;y" in -32767..32767 (y is up).
+// frames not in the script have no input.
+//
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"github.com/potix/regaprelay/gamepad"
+)
+
+const (
+	scriptStickMax float64 = 32767
+)
+
+var scriptKeyMap map[string]gamepad.ButtonName = map[string]gamepad.ButtonName{
+	"KEY_A": gamepad.ButtonA,
+	"KEY_B": gamepad.ButtonB,
+	"KEY_X": gamepad.ButtonX,
+	"KEY_Y": gamepad.ButtonY,
+	"KEY_LSTICK": gamepad.ButtonStickL,
+	"KEY_RSTICK": gamepad.ButtonStickR,
+	"KEY_L": gamepad.ButtonL,
+	"KEY_R": gamepad.ButtonR,
+	"KEY_ZL": gamepad.ButtonZL,
+	"KEY_ZR": gamepad.ButtonZR,
+	"KEY_PLUS": gamepad.ButtonPlus,
+	"KEY_MINUS": gamepad.ButtonMinus,
+	"KEY_DLEFT": gamepad.ButtonLeft,
+	"KEY_DUP": gamepad.ButtonUp,
+	"KEY_DRIGHT": gamepad.ButtonRight,
+	"KEY_DDOWN": gamepad.ButtonDown,
+	"KEY_HOME": gamepad.ButtonHome,
+	"KEY_CAPTURE": gamepad.ButtonCapture,
+}
+
+type ScriptLine struct {
+	Frame uint64
+	Input *FrameInput
+}
+
+type Script struct {
+	Lines []*ScriptLine
+}
+
+func parseScriptKeys(field string) ([]gamepad.ButtonName, error) {
+	buttons := make([]gamepad.ButtonName, 0)
+	if field == "NONE" {
+		return buttons, nil
+	}
+	for _, key := range strings.Split(field, ";") {
+		if key == "" {
+			continue
+		}
+		button, ok := scriptKeyMap[key]
+		if !ok {
+			return nil, fmt.Errorf("unsupported key: %v", key)
+		}
+		buttons = append(buttons, button)
+	}
+	return buttons, nil
+}
+
+func parseScriptStick(field string) (Stick, error) {
+	values := strings.Split(field, ";")
+	if len(values) != 2 {
+		return Stick{}, fmt.Errorf("invalid stick: %v", field)
+	}
+	x, err := strconv.Atoi(values[0])
+	if err != nil {
+		return Stick{}, fmt.Errorf("can not parse stick x (%v): %w", field, err)
+	}
+	y, err := strconv.Atoi(values[1])
+	if err != nil {
+		return Stick{}, fmt.Errorf("can not parse stick y (%v): %w", field, err)
+	}
+	// y of gamepad is down
+	return Stick{
+		X: clampStick(float64(x) / scriptStickMax),
+		Y: clampStick(float64(y) / scriptStickMax * -1.0),
+	}, nil
+}
+
+func clampStick(value float64) float64 {
+	if value > 1.0 {
+		return 1.0
+	} else if value < -1.0 {
+		return -1.0
+	}
+	return value
+}
+
+func parseScriptLine(line string) (*ScriptLine, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid number of fields: %v", len(fields))
+	}
+	frame, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse frame: %w", err)
+	}
+	buttons, err := parseScriptKeys(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("can not parse keys: %w", err)
+	}
+	stickL, err := parseScriptStick(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("can not parse left stick: %w", err)
+	}
+	stickR, err := parseScriptStick(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("can not parse right stick: %w", err)
+	}
+	return &ScriptLine{
+		Frame: frame,
+		Input: &FrameInput{
+			Buttons: buttons,
+			StickL: stickL,
+			StickR: stickR,
+		},
+	}, nil
+}
+
+// empty lines and lines starting with '#' are ignored
+func ParseScript(r io.Reader) (*Script, error) {
+	script := &Script{
+		Lines: make([]*ScriptLine, 0),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		scriptLine, err := parseScriptLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse line %v: %w", lineNumber, err)
+		}
+		if len(script.Lines) > 0 && scriptLine.Frame <= script.Lines[len(script.Lines) - 1].Frame {
+			return nil, fmt.Errorf("frame is not increasing at line %v: %v", lineNumber, scriptLine.Frame)
+		}
+		script.Lines = append(script.Lines, scriptLine)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can not read script: %w", err)
+	}
+	return script, nil
+}
+
+func LoadScript(filePath string) (*Script, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can not open script file (%v): %w", filePath, err)
+	}
+	defer f.Close()
+	return ParseScript(f)
+}
+
+// frames without line are scheduled as no input
+func (s *Script) Schedule(scheduler *Scheduler) {
+	for i, line := range s.Lines {
+		scheduler.Schedule(line.Frame, line.Input)
+		if i + 1 < len(s.Lines) && s.Lines[i + 1].Frame == line.Frame + 1 {
+			continue
+		}
+		scheduler.Schedule(line.Frame + 1, &FrameInput{})
+	}
+}
@@ -0,0 +1,62 @@
+package tas
+
+import (
+	"reflect"
+	"testing"
+	"github.com/potix/regaprelay/gamepad"
+)
+
+func TestParseScriptLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want *ScriptLine
+		err  bool
+	}{
+		{
+			name: "no input",
+			line: "0 NONE 0;0 0;0",
+			want: &ScriptLine{ Frame: 0, Input: &FrameInput{ Buttons: []gamepad.ButtonName{} } },
+		},
+		{
+			name: "keys and sticks",
+			line: "120 KEY_A;KEY_ZR 0;32767 -32767;0",
+			want: &ScriptLine{ Frame: 120, Input: &FrameInput{
+				Buttons: []gamepad.ButtonName{ gamepad.ButtonA, gamepad.ButtonZR },
+				StickL: Stick{ X: 0, Y: -1 },
+				StickR: Stick{ X: -1, Y: 0 },
+			} },
+		},
+		{
+			name: "stick is clamped",
+			line: "5 KEY_DUP; 40000;-40000 0;0",
+			want: &ScriptLine{ Frame: 5, Input: &FrameInput{
+				Buttons: []gamepad.ButtonName{ gamepad.ButtonUp },
+				StickL: Stick{ X: 1, Y: 1 },
+			} },
+		},
+		{ name: "too few fields", line: "1 KEY_A 0;0", err: true },
+		{ name: "too many fields", line: "1 KEY_A 0;0 0;0 0;0", err: true },
+		{ name: "negative frame", line: "-1 KEY_A 0;0 0;0", err: true },
+		{ name: "unsupported key", line: "1 KEY_SL 0;0 0;0", err: true },
+		{ name: "invalid stick", line: "1 KEY_A 0 0;0", err: true },
+		{ name: "invalid stick value", line: "1 KEY_A 0;0 x;0", err: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseScriptLine(tt.line)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parseScriptLine(%q) = %+v, want error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseScriptLine(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseScriptLine(%q) = %+v, want %+v", tt.line, got.Input, tt.want.Input)
+			}
+		})
+	}
+}
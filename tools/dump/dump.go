@@ -4,13 +4,14 @@ import (
 	"os"
 	"log"
 	"fmt"
+	"flag"
 	"syscall"
 	"github.com/potix/utils/signal"
 	"github.com/potix/regaprelay/gamepad"
 	"errors"
 )
 
-func rwLoop(rf *os.File, wf *os.File, direction string) {
+func rwLoop(rf *os.File, wf *os.File, direction string, captureDirection gamepad.HidCaptureDirection, captureWriter *gamepad.HidCaptureWriter) {
 	buf := make([]byte, 1024)
 	for {
 		rl, err := rf.Read(buf)
@@ -32,16 +33,34 @@ func rwLoop(rf *os.File, wf *os.File, direction string) {
 			}
 			break
 		}
+		if captureWriter != nil {
+			err := captureWriter.Write(captureDirection, buf[:rl])
+			if err != nil {
+				log.Printf("can not capture (%v): %v", direction, err)
+			}
+		}
 		log.Printf("%v: %x", direction, buf[:rl])
 		fmt.Printf("%v: %x", direction, buf[:rl])
 	}
 }
 
 func main() {
+	var captureFile string
+        flag.StringVar(&captureFile, "capture", "", "hid capture file ('' is not captured)")
+        flag.Parse()
         _, err := gamepad.NewGamepad(gamepad.ModelNSProCon, "", "", "")
         if err != nil {
                 log.Fatalf("can not create gamepad: %v", err)
         }
+	var captureWriter *gamepad.HidCaptureWriter
+	if captureFile != "" {
+		captureWriter, err = gamepad.NewHidCaptureWriter(captureFile)
+		if err != nil {
+			log.Printf("can not create hid capture writer: %v", err)
+			return
+		}
+		defer captureWriter.Close()
+	}
 	fhidg0, err := os.OpenFile("/dev/hidg0", os.O_RDWR, 0644)
 	if err != nil {
                 log.Printf("can not open /dev/hidg0: %v", err)
@@ -54,7 +73,7 @@ func main() {
 		return
 	}
 	defer fhidraw.Close()
-	go rwLoop(fhidg0, fhidraw, "switch -> procon")
-	go rwLoop(fhidraw, fhidg0, "procon -> switch")
+	go rwLoop(fhidg0, fhidraw, "switch -> procon", gamepad.HidCaptureDirectionOut, captureWriter)
+	go rwLoop(fhidraw, fhidg0, "procon -> switch", gamepad.HidCaptureDirectionIn, captureWriter)
 	signal.SignalWait(nil)
 }
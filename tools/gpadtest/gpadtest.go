@@ -3,7 +3,6 @@ package main
 import (
         "encoding/json"
         "flag"
-	"github.com/potix/regapweb/handler"
         "github.com/potix/utils/signal"
         "github.com/potix/utils/configurator"
         "github.com/potix/regaprelay/gamepad"
@@ -13,13 +12,13 @@ import (
 
 
 type gpadtestGamepadConfig struct {
-	Model       gamepad.GamepadModel `toml:model`
-	MacAddr     string               `toml:macAddr`
-	SpiMemory60 string               `toml:spiMemory60`
-	SpiMemory80 string               `toml:spiMemory80`
-	DevFilePath string               `toml:devFilePath`
-	ConfigsHome string               `toml:configsHome`
-	Udc         string               `toml:udc`
+	Model       gamepad.GamepadModel `toml:"model"`
+	MacAddr     string               `toml:"macAddr"`
+	SpiMemory60 string               `toml:"spiMemory60"`
+	SpiMemory80 string               `toml:"spiMemory80"`
+	DevFilePath string               `toml:"devFilePath"`
+	ConfigsHome string               `toml:"configsHome"`
+	Udc         string               `toml:"udc"`
 }
 
 type gpadtestConfig struct {
@@ -45,10 +44,14 @@ func verboseLoadedConfig(config *gpadtestConfig) {
         log.Printf("loaded config: %v", string(j))
 }
 
-func onVibration(vibration *handler.GamepadVibrationMessage) {
+func onVibration(vibration *gamepad.GamepadVibration) {
 	log.Printf("get vibration -> %v", vibration)
 }
 
+func onHandshake(handshake *gamepad.GamepadHandshake) {
+	log.Printf("get handshake -> %+v", handshake)
+}
+
 func main() {
         cmdArgs := new(commandArguments)
         flag.StringVar(&cmdArgs.configFile, "config", "./gpadtest.conf", "config file")
@@ -78,6 +81,7 @@ func main() {
 		log.Fatalf("can not create gamepad: %v", err)
 	}
         newGamepad.StartVibrationListener(onVibration)
+        newGamepad.StartHandshakeListener(onHandshake)
 	// setup watcher
 	var mode watcher.Mode = watcher.ModeBulk
 	if cmdArgs.mode == "split" {
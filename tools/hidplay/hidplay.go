@@ -0,0 +1,167 @@
+package main
+
+//
+// play host side reports of a hid capture against the emulator
+// and compare the replies with the capture
+//
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+	"github.com/potix/utils/signal"
+	"github.com/potix/regaprelay/gamepad"
+)
+
+const (
+	replyTimeout time.Duration = time.Second
+)
+
+// periodic input reports are not compared
+func isPeriodicReport(report []byte) bool {
+	return len(report) > 0 && (report[0] == 0x30 || report[0] == 0x31)
+}
+
+// timer, battery, buttons, sticks and vibrator of 0x21 depend on time
+func compareReport(expected []byte, actual []byte) bool {
+	size := len(expected)
+	if len(actual) < size {
+		size = len(actual)
+	}
+	if size == 0 || expected[0] != actual[0] {
+		return false
+	}
+	if expected[0] == 0x21 && size > 13 {
+		return bytes.Equal(expected[13:size], actual[13:size])
+	}
+	return bytes.Equal(expected[:size], actual[:size])
+}
+
+func readLoop(f *os.File, replyCh chan []byte) {
+	buf := make([]byte, 512)
+	for {
+		rl, err := f.Read(buf)
+		if err != nil {
+			log.Printf("can not read: %v", err)
+			close(replyCh)
+			return
+		}
+		if isPeriodicReport(buf[:rl]) {
+			continue
+		}
+		reply := make([]byte, rl)
+		copy(reply, buf[:rl])
+		replyCh <- reply
+	}
+}
+
+func loadRecords(captureFile string) ([]*gamepad.HidCaptureRecord, error) {
+	reader, err := gamepad.OpenHidCapture(captureFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	records := make([]*gamepad.HidCaptureRecord, 0)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func play(f *os.File, records []*gamepad.HidCaptureRecord, speed float64, compare bool, stopCh chan int) {
+	replyCh := make(chan []byte, 64)
+	go readLoop(f, replyCh)
+	if len(records) == 0 {
+		return
+	}
+	mismatch := 0
+	startTime := time.Now()
+	firstTime := records[0].Time
+	for _, record := range records {
+		if record.Direction != gamepad.HidCaptureDirectionOut {
+			if !compare || isPeriodicReport(record.Report) {
+				continue
+			}
+			select {
+			case reply, ok := <-replyCh:
+				if !ok {
+					return
+				}
+				if !compareReport(record.Report, reply) {
+					mismatch += 1
+					log.Printf("mismatch reply: expected = %x, actual = %x", record.Report, reply)
+				}
+			case <-time.After(replyTimeout):
+				mismatch += 1
+				log.Printf("no reply: expected = %x", record.Report)
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+		offset := time.Duration(float64(record.Time.Sub(firstTime)) / speed)
+		select {
+		case <-time.After(time.Until(startTime.Add(offset))):
+		case <-stopCh:
+			return
+		}
+		_, err := f.Write(record.Report)
+		if err != nil {
+			log.Printf("can not write: %v", err)
+			return
+		}
+		log.Printf("host -> device: %x", record.Report)
+	}
+	log.Printf("finish play: records = %v, mismatch = %v", len(records), mismatch)
+}
+
+func main() {
+	var devFile string
+	var captureFile string
+	var speed float64
+	var compare bool
+        flag.StringVar(&devFile, "dev", "/dev/hidraw0", "hidraw device file of the emulator")
+        flag.StringVar(&captureFile, "capture", "./capture.bin", "hid capture file")
+        flag.Float64Var(&speed, "speed", 1.0, "play speed (2.0 is twice as fast)")
+        flag.BoolVar(&compare, "compare", true, "compare replies with the capture")
+        flag.Parse()
+	if speed <= 0 {
+		log.Fatalf("invalid speed: %v", speed)
+	}
+	records, err := loadRecords(captureFile)
+	if err != nil {
+		log.Fatalf("can not load hid capture: %v", err)
+	}
+	f, err := os.OpenFile(devFile, os.O_RDWR, 0644)
+	if err != nil {
+		log.Fatalf("can not open %v: %v", devFile, err)
+	}
+	defer f.Close()
+	stopCh := make(chan int)
+	doneCh := make(chan int)
+	go func() {
+		play(f, records, speed, compare, stopCh)
+		close(doneCh)
+	}()
+	signalCh := make(chan int)
+	go func() {
+		signal.SignalWait(nil)
+		close(signalCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-signalCh:
+		close(stopCh)
+		<-doneCh
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+        "encoding/json"
+        "flag"
+        "github.com/potix/utils/signal"
+        "github.com/potix/utils/configurator"
+        "github.com/potix/regaprelay/gamepad"
+        "log"
+        "time"
+)
+
+type replayGamepadConfig struct {
+	Model        gamepad.GamepadModel `toml:"model"`
+	MacAddr      string               `toml:"macAddr"`
+	SpiMemory60  string               `toml:"spiMemory60"`
+	SpiMemory80  string               `toml:"spiMemory80"`
+	SpiFlashFile string               `toml:"spiFlashFile"`
+	DevFilePath  string               `toml:"devFilePath"`
+	ConfigsHome  string               `toml:"configsHome"`
+	Udc          string               `toml:"udc"`
+}
+
+type replayConfig struct {
+        Verbose   bool                    `toml:"verbose"`
+        Gamepad   *replayGamepadConfig   `toml:"gamepad"`
+}
+
+type commandArguments struct {
+        configFile string
+        recordFile string
+        speed      float64
+        delay      int
+}
+
+func verboseLoadedConfig(config *replayConfig) {
+        if !config.Verbose {
+                return
+        }
+        j, err := json.Marshal(config)
+        if err != nil {
+                log.Printf("can not dump config: %v", err)
+                return
+        }
+        log.Printf("loaded config: %v", string(j))
+}
+
+func main() {
+        cmdArgs := new(commandArguments)
+        flag.StringVar(&cmdArgs.configFile, "config", "./replay.conf", "config file")
+        flag.StringVar(&cmdArgs.recordFile, "record", "./gamepad.jsonl", "record file")
+        flag.Float64Var(&cmdArgs.speed, "speed", 1.0, "replay speed (2.0 is twice as fast)")
+        flag.IntVar(&cmdArgs.delay, "delay", 5, "seconds to wait before playback")
+        flag.Parse()
+        cf, err := configurator.NewConfigurator(cmdArgs.configFile)
+        if err != nil {
+                log.Fatalf("can not create configurator: %v", err)
+        }
+        var conf replayConfig
+        err = cf.Load(&conf)
+        if err != nil {
+                log.Fatalf("can not load config: %v", err)
+        }
+        if conf.Gamepad == nil {
+                log.Fatalf("invalid config")
+        }
+        if conf.Gamepad.Model == "" {
+                conf.Gamepad.Model = gamepad.ModelNSProCon
+        }
+        verboseLoadedConfig(&conf)
+	// setup gamepad
+        gVerboseOpt := gamepad.GamepadVerbose(conf.Verbose)
+        gDevFilePathOpt := gamepad.GamepadDevFilePath(conf.Gamepad.DevFilePath)
+        gSpiFlashFileOpt := gamepad.GamepadSpiFlashFile(conf.Gamepad.SpiFlashFile)
+        gConfigsHomeOpt := gamepad.GamepadConfigsHome(conf.Gamepad.ConfigsHome)
+        gUdcOpt := gamepad.GamepadUdc(conf.Gamepad.Udc)
+        newGamepad, err := gamepad.NewGamepad(conf.Gamepad.Model, conf.Gamepad.MacAddr, conf.Gamepad.SpiMemory60, conf.Gamepad.SpiMemory80, gDevFilePathOpt, gSpiFlashFileOpt, gConfigsHomeOpt, gUdcOpt, gVerboseOpt)
+	if err != nil {
+		log.Fatalf("can not create gamepad: %v", err)
+	}
+	// setup replayer
+	rVerboseOpt := gamepad.ReplayerVerbose(conf.Verbose)
+	rSpeedOpt := gamepad.ReplayerSpeed(cmdArgs.speed)
+	replayer, err := gamepad.NewReplayer(newGamepad, cmdArgs.recordFile, rSpeedOpt, rVerboseOpt)
+	if err != nil {
+		log.Fatalf("can not create replayer: %v", err)
+	}
+	// start gamepad
+	err = newGamepad.Start()
+	if err != nil {
+		log.Fatalf("can not start gamepad: %v", err)
+	}
+	signalCh := make(chan int)
+	go func() {
+		signal.SignalWait(nil)
+		close(signalCh)
+	}()
+	log.Printf("start replay after %v seconds", cmdArgs.delay)
+	select {
+	case <-time.After(time.Duration(cmdArgs.delay) * time.Second):
+		replayer.Start()
+		select {
+		case <-replayer.Done():
+			log.Printf("finish replay")
+		case <-signalCh:
+			replayer.Stop()
+		}
+	case <-signalCh:
+	}
+        newGamepad.Stop()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+        "flag"
+        "fmt"
+        "github.com/potix/regaprelay/gamepad"
+        "log"
+)
+
+type commandArguments struct {
+        model  string
+        serial string
+}
+
+func main() {
+        cmdArgs := new(commandArguments)
+        flag.StringVar(&cmdArgs.model, "model", "nsprocon", "nsprocon, nsjoyconl, nsjoyconr")
+        flag.StringVar(&cmdArgs.serial, "serial", "", "serial number written to spi flash (max 16 characters)")
+        flag.Parse()
+        macAddr, err := gamepad.GenerateNSMacAddr()
+        if err != nil {
+                log.Fatalf("can not generate mac address: %v", err)
+        }
+        spiMemory60, err := gamepad.GenerateNSSpiMemory60(gamepad.GamepadModel(cmdArgs.model), cmdArgs.serial)
+        if err != nil {
+                log.Fatalf("can not generate spi memory 60XX: %v", err)
+        }
+        fmt.Printf("macAddr=\"%v\"\n", macAddr)
+        fmt.Printf("spiMemory60=\"%v\"\n", spiMemory60)
+        fmt.Printf("spiMemory80=\"%v\"\n", gamepad.GenerateNSSpiMemory80())
+}
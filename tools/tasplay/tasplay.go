@@ -0,0 +1,110 @@
+package main
+
+import (
+        "encoding/json"
+        "flag"
+        "github.com/potix/utils/signal"
+        "github.com/potix/utils/configurator"
+        "github.com/potix/regaprelay/gamepad"
+        "github.com/potix/regaprelay/tas"
+        "log"
+        "time"
+)
+
+type tasplayGamepadConfig struct {
+	Model        gamepad.GamepadModel `toml:"model"`
+	MacAddr      string               `toml:"macAddr"`
+	SpiMemory60  string               `toml:"spiMemory60"`
+	SpiMemory80  string               `toml:"spiMemory80"`
+	SpiFlashFile string               `toml:"spiFlashFile"`
+	DevFilePath  string               `toml:"devFilePath"`
+	ConfigsHome  string               `toml:"configsHome"`
+	Udc          string               `toml:"udc"`
+}
+
+type tasplayConfig struct {
+        Verbose   bool                    `toml:"verbose"`
+        Gamepad   *tasplayGamepadConfig   `toml:"gamepad"`
+}
+
+type commandArguments struct {
+        configFile string
+        scriptFile string
+        delay      int
+}
+
+func verboseLoadedConfig(config *tasplayConfig) {
+        if !config.Verbose {
+                return
+        }
+        j, err := json.Marshal(config)
+        if err != nil {
+                log.Printf("can not dump config: %v", err)
+                return
+        }
+        log.Printf("loaded config: %v", string(j))
+}
+
+func main() {
+        cmdArgs := new(commandArguments)
+        flag.StringVar(&cmdArgs.configFile, "config", "./tasplay.conf", "config file")
+        flag.StringVar(&cmdArgs.scriptFile, "script", "./script.txt", "nx-TAS script file")
+        flag.IntVar(&cmdArgs.delay, "delay", 5, "seconds to wait before playback")
+        flag.Parse()
+        cf, err := configurator.NewConfigurator(cmdArgs.configFile)
+        if err != nil {
+                log.Fatalf("can not create configurator: %v", err)
+        }
+        var conf tasplayConfig
+        err = cf.Load(&conf)
+        if err != nil {
+                log.Fatalf("can not load config: %v", err)
+        }
+        if conf.Gamepad == nil {
+                log.Fatalf("invalid config")
+        }
+        if conf.Gamepad.Model == "" {
+                conf.Gamepad.Model = gamepad.ModelNSProCon
+        }
+        verboseLoadedConfig(&conf)
+	script, err := tas.LoadScript(cmdArgs.scriptFile)
+	if err != nil {
+		log.Fatalf("can not load script: %v", err)
+	}
+	// setup gamepad
+        gVerboseOpt := gamepad.GamepadVerbose(conf.Verbose)
+        gDevFilePathOpt := gamepad.GamepadDevFilePath(conf.Gamepad.DevFilePath)
+        gSpiFlashFileOpt := gamepad.GamepadSpiFlashFile(conf.Gamepad.SpiFlashFile)
+        gConfigsHomeOpt := gamepad.GamepadConfigsHome(conf.Gamepad.ConfigsHome)
+        gUdcOpt := gamepad.GamepadUdc(conf.Gamepad.Udc)
+        newGamepad, err := gamepad.NewGamepad(conf.Gamepad.Model, conf.Gamepad.MacAddr, conf.Gamepad.SpiMemory60, conf.Gamepad.SpiMemory80, gDevFilePathOpt, gSpiFlashFileOpt, gConfigsHomeOpt, gUdcOpt, gVerboseOpt)
+	if err != nil {
+		log.Fatalf("can not create gamepad: %v", err)
+	}
+	// setup scheduler
+	scheduler := tas.NewScheduler(newGamepad, tas.SchedulerVerbose(conf.Verbose))
+	script.Schedule(scheduler)
+	// start gamepad
+	err = newGamepad.Start()
+	if err != nil {
+		log.Fatalf("can not start gamepad: %v", err)
+	}
+	signalCh := make(chan int)
+	go func() {
+		signal.SignalWait(nil)
+		close(signalCh)
+	}()
+	log.Printf("start playback after %v seconds", cmdArgs.delay)
+	select {
+	case <-time.After(time.Duration(cmdArgs.delay) * time.Second):
+		scheduler.Start()
+		select {
+		case <-scheduler.Done():
+			log.Printf("finish playback")
+		case <-signalCh:
+			scheduler.Stop()
+		}
+	case <-signalCh:
+	}
+        newGamepad.Stop()
+}
@@ -16,12 +16,18 @@ const (
 )
 
 type keyboardWatcherOptions struct {
-        verbose    bool
+        verbose        bool
+	macroKeys      map[string]string
+	macroCancelKey string
+	turboKeys      map[string]string
 }
 
 func defaultKeyboardWatcherOptions() *keyboardWatcherOptions {
         return &keyboardWatcherOptions {
                 verbose: false,
+		macroKeys: make(map[string]string),
+		macroCancelKey: "",
+		turboKeys: make(map[string]string),
         }
 }
 
@@ -33,6 +39,26 @@ func KeyboardWatcherVerbose(verbose bool) KeyboardWatcherOption {
         }
 }
 
+// key -> macro name
+func KeyboardWatcherMacroKeys(macroKeys map[string]string) KeyboardWatcherOption {
+        return func(opts *keyboardWatcherOptions) {
+                opts.macroKeys = macroKeys
+        }
+}
+
+func KeyboardWatcherMacroCancelKey(macroCancelKey string) KeyboardWatcherOption {
+        return func(opts *keyboardWatcherOptions) {
+                opts.macroCancelKey = macroCancelKey
+        }
+}
+
+// key -> button name, toggles turbo of the button
+func KeyboardWatcherTurboKeys(turboKeys map[string]string) KeyboardWatcherOption {
+        return func(opts *keyboardWatcherOptions) {
+                opts.turboKeys = turboKeys
+        }
+}
+
 type KeyboardWatcher struct {
 	verbose	            bool
 	keyLogger           *keylogger.KeyLogger
@@ -45,6 +71,9 @@ type KeyboardWatcher struct {
 	shiftState          bool
 	checkKeys           []string
 	stickToggle         bool
+	macroKeys           map[string]string
+	macroCancelKey      string
+	turboKeys           map[string]gamepad.ButtonName
 	stopCh              chan int
 }
 
@@ -58,6 +87,19 @@ func (k *KeyboardWatcher) updateState(event keylogger.InputEvent) {
 			if k.verbose {
 				log.Printf("[event] press key %v", key)
 			}
+			if key == k.macroCancelKey {
+				k.gamepad.CancelMacro()
+				break
+			} else if macroName, ok := k.macroKeys[key]; ok {
+				err := k.gamepad.RunMacro(macroName)
+				if err != nil {
+					log.Printf("can not run macro: %v", err)
+				}
+				break
+			} else if button, ok := k.turboKeys[key]; ok {
+				k.gamepad.ToggleTurbo(button)
+				break
+			}
 			if key == "L_SHIFT" {
 				// シフトが押された
 				k.shiftState = true
@@ -270,6 +312,14 @@ func NewKeyboardWatcher(gpad *gamepad.Gamepad, keyboardDevice string, mode Mode,
                 }
                 opt(baseOpts)
         }
+	turboKeys := make(map[string]gamepad.ButtonName)
+	for key, buttonName := range baseOpts.turboKeys {
+		button, err := gamepad.ButtonNameFromString(buttonName)
+		if err != nil {
+			return nil, fmt.Errorf("can not use turbo key (%v): %w", key, err)
+		}
+		turboKeys[key] = button
+	}
 	gamepadButtonsOrder := []string{
 		 "K", // 0 : B 
 		 "L", // 1 : A
@@ -364,6 +414,9 @@ func NewKeyboardWatcher(gpad *gamepad.Gamepad, keyboardDevice string, mode Mode,
 		shiftState: false,
 		checkKeys: checkKeys,
 		stickToggle: false,
+		macroKeys: baseOpts.macroKeys,
+		macroCancelKey: baseOpts.macroCancelKey,
+		turboKeys: turboKeys,
 		stopCh: make(chan int),
 	}, nil
 }